@@ -0,0 +1,243 @@
+package bridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+// newAdminRouter returns the router for the admin API. It's used to manage
+// the bridge itself and is separate from the Hue REST API
+func (s *Server) newAdminRouter() *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(Logger(s.logger))
+	r.Use(middleware.Recoverer)
+	r.Use(render.SetContentType(render.ContentTypeJSON))
+	r.Use(rejectCrossOrigin)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		renderAdminError(w, r, http.StatusNotFound, "not found")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		renderAdminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	})
+	r.Post("/linkbutton", s.adminPressLinkButton)
+	r.Post("/whitelist/{username}/clientkey", s.adminRotateClientKey)
+	r.Delete("/whitelist/{username}/clientkey", s.adminRevokeClientKey)
+	r.Put("/whitelist/{username}/scope", s.adminSetScope)
+	r.Get("/backup", s.adminBackup)
+	r.Post("/restore", s.adminRestore)
+	return r
+}
+
+// rejectCrossOrigin keeps web pages open on the host out of the admin API,
+// which isn't authenticated. Browsers send an Origin header with
+// cross-origin requests, and can only send JSON after a preflight request
+// the admin API doesn't answer
+func rejectCrossOrigin(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			renderAdminError(w, r, http.StatusForbidden, "cross-origin requests are not allowed")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		default:
+			mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mt != "application/json" {
+				renderAdminError(w, r, http.StatusUnsupportedMediaType,
+					"Content-Type must be application/json")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+type adminErrorResp struct {
+	Error string `json:"error"`
+}
+
+func (*adminErrorResp) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func renderAdminError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	render.Status(r, status)
+	render.Render(w, r, &adminErrorResp{Error: msg})
+}
+
+type linkButtonResp struct {
+	LinkButton bool   `json:"linkbutton"`
+	Until      string `json:"until"`
+}
+
+func (*linkButtonResp) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s *Server) adminPressLinkButton(w http.ResponseWriter, r *http.Request) {
+	until := s.PressLinkButton("admin API")
+	renderOK(w, r, &linkButtonResp{
+		LinkButton: true,
+		Until:      DateTimeToISO8600(until.UTC()),
+	})
+}
+
+type clientKeyResp struct {
+	Username  string `json:"username"`
+	ClientKey string `json:"clientkey"`
+}
+
+func (*clientKeyResp) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s *Server) adminRotateClientKey(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	key, err := newClientKey()
+	if err != nil {
+		s.logger.Error(err.Error())
+		renderAdminError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.updateClientKey(w, r, username, key)
+}
+
+func (s *Server) adminRevokeClientKey(w http.ResponseWriter, r *http.Request) {
+	s.updateClientKey(w, r, chi.URLParam(r, "username"), "")
+}
+
+func (s *Server) updateClientKey(w http.ResponseWriter, r *http.Request, username, key string) {
+	err := s.setClientKey(username, key)
+	switch {
+	case err == errUnknownUser:
+		renderAdminError(w, r, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		s.logger.Error(err.Error())
+		renderAdminError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if key == "" {
+		s.logger.Info(fmt.Sprintf("revoked clientkey of %s", username))
+	} else {
+		s.logger.Info(fmt.Sprintf("rotated clientkey of %s", username))
+	}
+	renderOK(w, r, &clientKeyResp{Username: username, ClientKey: key})
+}
+
+type scopeReq struct {
+	scope
+}
+
+func (req *scopeReq) Bind(r *http.Request) error {
+	return req.validate()
+}
+
+type scopeResp struct {
+	Username string `json:"username"`
+	Scope    *scope `json:"scope"`
+}
+
+func (*scopeResp) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s *Server) adminSetScope(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	data := &scopeReq{}
+	if err := render.Bind(r, data); err != nil {
+		renderAdminError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	sc := &data.scope
+	if sc.Access == AccessFull && !sc.limited() {
+		sc = nil
+	}
+	err := s.setScope(username, sc)
+	switch {
+	case err == errUnknownUser:
+		renderAdminError(w, r, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		s.logger.Error(err.Error())
+		renderAdminError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.logger.Info(fmt.Sprintf("changed scope of %s", username))
+	renderOK(w, r, &scopeResp{Username: username, Scope: sc})
+}
+
+// maxBackupSize is the largest backup we'll try to restore
+const maxBackupSize = 10 << 20
+
+func (s *Server) adminBackup(w http.ResponseWriter, r *http.Request) {
+	b := s.createBackup()
+	data, err := encodeBackup(b)
+	if err != nil {
+		s.logger.Error(err.Error())
+		renderAdminError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		`attachment; filename="fargton-%s.json"`, b.Bridge.BridgeID))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+type restoreResp struct {
+	Restored bool   `json:"restored"`
+	BridgeID string `json:"bridgeid"`
+}
+
+func (*restoreResp) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s *Server) adminRestore(w http.ResponseWriter, r *http.Request) {
+	identity := Identity(r.URL.Query().Get("identity"))
+	switch identity {
+	case IdentityUnchanged, IdentityKeep, IdentityArchive:
+	default:
+		renderAdminError(w, r, http.StatusBadRequest, fmt.Sprintf(
+			"identity must be one of %s or %s, got %s", IdentityKeep, IdentityArchive, identity))
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBackupSize))
+	if err != nil {
+		renderAdminError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	b, err := decodeBackup(data)
+	if err != nil {
+		renderAdminError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = s.restoreBackup(b, identity)
+	switch {
+	case err == errIdentityMismatch:
+		renderAdminError(w, r, http.StatusConflict, fmt.Sprintf(
+			"backup is of bridge %s, pass identity=%s to keep the ID of this bridge or identity=%s to take over the ID of the backup",
+			b.Bridge.BridgeID, IdentityKeep, IdentityArchive))
+		return
+	case err != nil:
+		s.logger.Error(err.Error())
+		renderAdminError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.config.RLock()
+	id := s.config.BridgeID
+	s.config.RUnlock()
+	renderOK(w, r, &restoreResp{Restored: true, BridgeID: id})
+}
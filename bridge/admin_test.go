@@ -0,0 +1,121 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newAdminRequest returns a request to the admin API the way the fargton
+// command sends it
+func newAdminRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	if method != http.MethodGet {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+func TestLinkButton(t *testing.T) {
+	s := newTestServer(t)
+	r := s.newAdminRouter()
+
+	start := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+
+	assert.False(t, s.config.linkButtonPressed(start))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newAdminRequest(http.MethodPost, "/linkbutton", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	resp := linkButtonResp{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.True(t, resp.LinkButton)
+	assert.Equal(t, "2019-10-01T12:00:30", resp.Until)
+
+	assert.True(t, s.config.linkButtonPressed(start.Add(29*time.Second)))
+	assert.False(t, s.config.linkButtonPressed(start.Add(LinkButtonWindow)))
+	assert.True(t, createAuthenticatedConfig(s.config, "", nil).LinkButtonPressed)
+
+	t.Run("not found", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/nope", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+	t.Run("method not allowed", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/linkbutton", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	})
+	t.Run("browsers", func(t *testing.T) {
+		now = func() time.Time { return start.Add(time.Hour) }
+		rec := httptest.NewRecorder()
+		req := newAdminRequest(http.MethodPost, "/linkbutton", nil)
+		req.Header.Set("Origin", "http://example.com")
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code, "cross-origin requests should be rejected")
+
+		for _, ct := range []string{"", "text/plain", "application/x-www-form-urlencoded"} {
+			rec = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodPost, "/linkbutton", nil)
+			if ct != "" {
+				req.Header.Set("Content-Type", ct)
+			}
+			r.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code, ct)
+		}
+		assert.False(t, s.config.linkButtonPressed(now()))
+	})
+}
+
+func TestClientKey(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Whitelist = &map[string]whitelist{
+		"user": {Name: "app#phone"},
+	}
+	r := s.newAdminRouter()
+
+	key, err := newClientKey()
+	assert.NoError(t, err)
+	assert.Regexp(t, "^[0-9A-F]{32}$", key)
+
+	_, ok := s.clientKey("user")
+	assert.False(t, ok)
+
+	t.Run("rotate", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newAdminRequest(http.MethodPost, "/whitelist/user/clientkey", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		resp := clientKeyResp{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf(err.Error())
+		}
+		assert.Equal(t, "user", resp.Username)
+		assert.Equal(t, resp.ClientKey, (*s.config.Whitelist)["user"].ClientKey)
+
+		psk, ok := s.clientKey("user")
+		assert.True(t, ok)
+		assert.Len(t, psk, 16)
+		assert.Equal(t, "", (*publicWhitelist(s.config.Whitelist, "", nil))["user"].ClientKey)
+	})
+	t.Run("revoke", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newAdminRequest(http.MethodDelete, "/whitelist/user/clientkey", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		_, ok := s.clientKey("user")
+		assert.False(t, ok)
+	})
+	t.Run("unknown user", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, newAdminRequest(http.MethodPost, "/whitelist/nope/clientkey", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
@@ -0,0 +1,217 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// LenientCtxKey is the context.Context key to indicate a request should
+	// be handled leniently, as voice assistants expect
+	LenientCtxKey = &contextKey{"Lenient"}
+)
+
+// alexaMaxNameLength is the longest device name the Alexa app accepts
+const alexaMaxNameLength = 32
+
+var ssdpMulticastAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// Lenient marks requests to be handled leniently. Voice assistants send
+// parameters we don't support, like transitiontime, along with the ones we
+// do and expect values outside of a light's range to be clamped
+func Lenient(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), LenientCtxKey, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// isLenient returns whether the request should be handled leniently
+func isLenient(r *http.Request) bool {
+	if r == nil || r.Context() == nil {
+		return false
+	}
+	lenient, _ := r.Context().Value(LenientCtxKey).(bool)
+	return lenient
+}
+
+// alexaName turns a device name into one the Alexa app accepts and that
+// can be spoken, falling back to fallback if nothing remains
+func alexaName(name string, fallback string) string {
+	clean := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, name)
+	clean = strings.Join(strings.Fields(clean), " ")
+	if len([]rune(clean)) > alexaMaxNameLength {
+		clean = strings.TrimSpace(string([]rune(clean)[:alexaMaxNameLength]))
+	}
+	if clean == "" {
+		return fallback
+	}
+	return clean
+}
+
+// parseMSearch returns the search target of an SSDP M-SEARCH request
+func parseMSearch(data []byte) (string, bool) {
+	rd := bufio.NewReader(bytes.NewReader(data))
+	req, err := http.ReadRequest(rd)
+	if err != nil || req.Method != "M-SEARCH" {
+		return "", false
+	}
+	if req.Header.Get("Man") != `"ssdp:discover"` {
+		return "", false
+	}
+	st := req.Header.Get("St")
+	return st, st != ""
+}
+
+// ssdpTarget is a search target the bridge is advertised as
+type ssdpTarget struct {
+	st  string
+	usn string
+}
+
+// ssdpTargets returns the targets a Hue bridge advertises
+func ssdpTargets(c *Config) []ssdpTarget {
+	return []ssdpTarget{
+		{"upnp:rootdevice", fmt.Sprintf("uuid:%s::upnp:rootdevice", c.uuid)},
+		{fmt.Sprintf("uuid:%s", c.uuid), fmt.Sprintf("uuid:%s", c.uuid)},
+		{"urn:schemas-upnp-org:device:basic:1", fmt.Sprintf("uuid:%s", c.uuid)},
+	}
+}
+
+// ssdpSearchResponses returns the responses to an M-SEARCH for the search
+// target. The Echo expects the hue-bridgeid header and a response for each
+// of the targets we advertise
+func ssdpSearchResponses(c *Config, st string) [][]byte {
+	resps := [][]byte{}
+	for _, t := range ssdpTargets(c) {
+		if st != "ssdp:all" && !strings.EqualFold(st, t.st) {
+			continue
+		}
+		resps = append(resps, []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+			"HOST: 239.255.255.250:1900\r\n"+
+			"EXT:\r\n"+
+			"CACHE-CONTROL: max-age=100\r\n"+
+			"LOCATION: http://%s:%d/description.xml\r\n"+
+			"SERVER: Linux/3.14.0 UPnP/1.0 IpBridge/%s\r\n"+
+			"hue-bridgeid: %s\r\n"+
+			"ST: %s\r\n"+
+			"USN: %s\r\n"+
+			"\r\n",
+			c.advertiseIP, c.port, c.APIVersion, c.BridgeID, t.st, t.usn)))
+	}
+	return resps
+}
+
+// ssdpNotifications returns the NOTIFY messages for each of the targets we
+// advertise, nts is either ssdp:alive or ssdp:byebye
+func ssdpNotifications(c *Config, nts string) [][]byte {
+	msgs := [][]byte{}
+	for _, t := range ssdpTargets(c) {
+		if nts != "ssdp:alive" {
+			msgs = append(msgs, []byte(fmt.Sprintf("NOTIFY * HTTP/1.1\r\n"+
+				"HOST: 239.255.255.250:1900\r\n"+
+				"NT: %s\r\n"+
+				"NTS: %s\r\n"+
+				"USN: %s\r\n"+
+				"\r\n",
+				t.st, nts, t.usn)))
+			continue
+		}
+		msgs = append(msgs, []byte(fmt.Sprintf("NOTIFY * HTTP/1.1\r\n"+
+			"HOST: 239.255.255.250:1900\r\n"+
+			"CACHE-CONTROL: max-age=100\r\n"+
+			"LOCATION: http://%s:%d/description.xml\r\n"+
+			"SERVER: Linux/3.14.0 UPnP/1.0 IpBridge/%s\r\n"+
+			"NTS: %s\r\n"+
+			"hue-bridgeid: %s\r\n"+
+			"NT: %s\r\n"+
+			"USN: %s\r\n"+
+			"\r\n",
+			c.advertiseIP, c.port, c.APIVersion, nts, c.BridgeID, t.st, t.usn)))
+	}
+	return msgs
+}
+
+// newSSDPSearchResponder answers SSDP M-SEARCH requests the way a real Hue
+// bridge does, including the hue-bridgeid header the Echo looks for. It
+// replaces the SSDP/UPnP responder so it also announces the bridge
+func newSSDPSearchResponder(c *Config, l *zap.Logger, quit chan bool, announce <-chan struct{}) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, ssdpMulticastAddr)
+	if err != nil {
+		l.Error(fmt.Sprintf("failed to listen for SSDP searches: %v", err))
+		<-quit
+		return
+	}
+	defer conn.Close()
+
+	notify := func(nts string) {
+		c.RLock()
+		msgs := ssdpNotifications(c, nts)
+		c.RUnlock()
+		for _, msg := range msgs {
+			if _, err := conn.WriteToUDP(msg, ssdpMulticastAddr); err != nil {
+				l.Error(err.Error())
+			}
+		}
+	}
+	notify("ssdp:alive")
+	aliveTick := time.NewTicker(60 * time.Second)
+	defer aliveTick.Stop()
+
+	buf := make([]byte, 2048)
+	for {
+		select {
+		case <-quit:
+			notify("ssdp:byebye")
+			l.Info("stopped SSDP search responder")
+			return
+		case <-aliveTick.C:
+			// Yes, twice
+			notify("ssdp:alive")
+			notify("ssdp:alive")
+		case <-announce:
+			// Say goodbye first so control points fetch the description
+			// again instead of using what they've cached
+			notify("ssdp:byebye")
+			notify("ssdp:alive")
+			l.Info("re-announced SSDP/UPnP service")
+		default:
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			l.Error(err.Error())
+			continue
+		}
+		st, ok := parseMSearch(buf[:n])
+		if !ok {
+			continue
+		}
+		c.RLock()
+		resps := ssdpSearchResponses(c, st)
+		c.RUnlock()
+		for _, resp := range resps {
+			if _, err := conn.WriteToUDP(resp, src); err != nil {
+				l.Error(err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package bridge
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/render"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlexaName(t *testing.T) {
+	assert.Equal(t, "Kitchen ceiling", alexaName("Kitchen/ceiling ", "Light 1"))
+	assert.Equal(t, "Köket 2", alexaName("Köket #2", "Light 1"))
+	assert.Equal(t, "Light 1", alexaName("--", "Light 1"))
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyzabcdef",
+		alexaName("abcdefghijklmnopqrstuvwxyzabcdefghij", "Light 1"))
+}
+
+func TestParseMSearch(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		st   string
+		ok   bool
+	}{
+		{
+			name: "discover",
+			req:  "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 3\r\nST: ssdp:all\r\n\r\n",
+			st:   "ssdp:all",
+			ok:   true,
+		},
+		{
+			name: "notify",
+			req:  "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\n\r\n",
+		},
+		{
+			name: "missing man",
+			req:  "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nST: ssdp:all\r\n\r\n",
+		},
+		{
+			name: "garbage",
+			req:  "hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, ok := parseMSearch([]byte(tt.req))
+			assert.Equal(t, tt.st, st)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+func TestSSDPSearchResponses(t *testing.T) {
+	c, err := NewConfig(Name(t.Name()), AlexaCompatibility(true))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Len(t, ssdpSearchResponses(c, "ssdp:all"), 3)
+	assert.Len(t, ssdpSearchResponses(c, "urn:schemas-upnp-org:device:unknown:1"), 0)
+
+	resps := ssdpSearchResponses(c, "urn:schemas-upnp-org:device:basic:1")
+	if !assert.Len(t, resps, 1) {
+		t.FailNow()
+	}
+	resp := string(resps[0])
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "hue-bridgeid: "+c.BridgeID+"\r\n")
+	assert.Contains(t, resp, "ST: urn:schemas-upnp-org:device:basic:1\r\n")
+	assert.Contains(t, resp, "/description.xml\r\n")
+}
+
+func TestSSDPNotifications(t *testing.T) {
+	c, err := NewConfig(Name(t.Name()), AlexaCompatibility(true))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	alive := ssdpNotifications(c, "ssdp:alive")
+	if !assert.Len(t, alive, 3) {
+		t.FailNow()
+	}
+	msg := string(alive[0])
+	assert.True(t, strings.HasPrefix(msg, "NOTIFY * HTTP/1.1\r\n"))
+	assert.Contains(t, msg, "NTS: ssdp:alive\r\n")
+	assert.Contains(t, msg, "NT: upnp:rootdevice\r\n")
+	assert.Contains(t, msg, "hue-bridgeid: "+c.BridgeID+"\r\n")
+	assert.Contains(t, msg, "/description.xml\r\n")
+
+	bye := ssdpNotifications(c, "ssdp:byebye")
+	if !assert.Len(t, bye, 3) {
+		t.FailNow()
+	}
+	msg = string(bye[2])
+	assert.Contains(t, msg, "NTS: ssdp:byebye\r\n")
+	assert.Contains(t, msg, "NT: urn:schemas-upnp-org:device:basic:1\r\n")
+	assert.NotContains(t, msg, "LOCATION")
+}
+
+func TestIDMap(t *testing.T) {
+	m := newIDMap()
+	id, assigned := m.get("lights/a")
+	assert.Equal(t, "1", id)
+	assert.True(t, assigned)
+	id, assigned = m.get("lights/b")
+	assert.Equal(t, "2", id)
+	assert.True(t, assigned)
+	id, assigned = m.get("lights/a")
+	assert.Equal(t, "1", id)
+	assert.False(t, assigned)
+
+	id, ok := m.lookup("lights/b")
+	assert.Equal(t, "2", id)
+	assert.True(t, ok)
+	_, ok = m.lookup("lights/c")
+	assert.False(t, ok)
+	id, _ = m.get("lights/c")
+	assert.Equal(t, "3", id, "looking up an ID shouldn't use one up")
+}
+
+func TestLenientBind(t *testing.T) {
+	bind := func(body string, lenient bool) (*lightStateUpdate, error) {
+		r := httptest.NewRequest(http.MethodPut, "/", bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+		if lenient {
+			var res *http.Request
+			Lenient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				res = r
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			r = res
+		}
+		upd := &lightStateUpdate{}
+		return upd, render.Bind(r, upd)
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		_, err := bind(`{"on": true, "transitiontime": 4}`, false)
+		assert.NotNil(t, err)
+	})
+	t.Run("transitiontime", func(t *testing.T) {
+		upd, err := bind(`{"on": true, "transitiontime": 4}`, true)
+		assert.Nil(t, err)
+		assert.Nil(t, upd.TransitionTime)
+		assert.True(t, *upd.On)
+	})
+	t.Run("hue and sat", func(t *testing.T) {
+		upd, err := bind(`{"hue": 0, "sat": 254}`, true)
+		assert.Nil(t, err)
+		assert.Nil(t, upd.Hue)
+		assert.Nil(t, upd.Saturation)
+		if assert.NotNil(t, upd.XY) {
+			assert.Equal(t, HemtjanstHStoCIExy(0, 100), *upd.XY)
+		}
+	})
+	t.Run("clamp", func(t *testing.T) {
+		l := &light{Capabilities: &lightCapabilities{Control: &lightControl{
+			MiredColorTemp: &lightMiredColorTemperature{Min: 153, Max: 454},
+		}}}
+		upd := &lightStateUpdate{Brightness: IntPtr(255), ColorTemperature: IntPtr(500), lenient: true}
+		l.clampValues(upd)
+		assert.Equal(t, 254, *upd.Brightness)
+		assert.Equal(t, 454, *upd.ColorTemperature)
+		assert.Len(t, l.invalidValues(upd), 0)
+	})
+}
@@ -0,0 +1,316 @@
+package bridge
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// backupSchema is how backups are versioned. There are no backups from
+// before they were versioned so anything unversioned isn't a backup
+var backupSchema = &schema{
+	Version: 1,
+	Migrations: []migration{
+		func(data json.RawMessage) (json.RawMessage, error) {
+			return nil, errors.New("not a Färgton backup")
+		},
+	},
+}
+
+// errIdentityMismatch is returned when restoring a backup of another bridge
+// without saying which identity to keep
+var errIdentityMismatch = errors.New("backup is of another bridge")
+
+// Identity decides which bridge ID and MAC to use when restoring a backup
+// of another bridge
+type Identity string
+
+const (
+	// IdentityUnchanged refuses to restore backups of another bridge
+	IdentityUnchanged Identity = ""
+	// IdentityKeep restores the backup but keeps the ID of this bridge.
+	// Apps will see a different bridge and will have to find it again
+	IdentityKeep Identity = "keep"
+	// IdentityArchive takes over the ID of the bridge in the backup
+	IdentityArchive Identity = "archive"
+)
+
+type backupBridge struct {
+	Name     string  `json:"name"`
+	BridgeID string  `json:"bridgeid"`
+	MAC      MACAddr `json:"mac"`
+	Timezone string  `json:"timezone"`
+}
+
+// backupArchive is the state of the bridge. It only holds what the bridge
+// owns, light profiles and calibration are files you manage yourself
+type backupArchive struct {
+	CreatedAt     string                    `json:"created"`
+	Bridge        backupBridge              `json:"bridge"`
+	Whitelist     map[string]whitelist      `json:"whitelist"`
+	IDMap         *idMap                    `json:"idmap,omitempty"`
+	Entertainment *storedEntertainmentAreas `json:"entertainment,omitempty"`
+}
+
+// validate ensures the backup can be restored as a whole
+func (b *backupArchive) validate() error {
+	if len(b.Bridge.MAC) != 6 {
+		return fmt.Errorf("invalid bridge MAC %s", net.HardwareAddr(b.Bridge.MAC))
+	}
+	if id := bridgeIDfromMAC(b.Bridge.MAC); id != b.Bridge.BridgeID {
+		return fmt.Errorf("bridge ID %s doesn't match MAC, expected %s", b.Bridge.BridgeID, id)
+	}
+	if _, err := time.LoadLocation(b.Bridge.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %v", err)
+	}
+	for id, entry := range b.Whitelist {
+		if entry.ClientKey != "" {
+			if key, err := hex.DecodeString(entry.ClientKey); err != nil || len(key) != 16 {
+				return fmt.Errorf("invalid clientkey for whitelist entry %s", id)
+			}
+		}
+		if entry.Scope != nil {
+			if err := entry.Scope.validate(); err != nil {
+				return fmt.Errorf("invalid scope for whitelist entry %s: %v", id, err)
+			}
+		}
+	}
+	if b.IDMap != nil {
+		seen := map[string]bool{}
+		for topic, id := range b.IDMap.IDs {
+			n, err := strconv.Atoi(id)
+			if err != nil || n < 1 || n >= b.IDMap.Next {
+				return fmt.Errorf("invalid ID %s for light %s", id, topic)
+			}
+			if seen[id] {
+				return fmt.Errorf("ID %s is used by more than one light", id)
+			}
+			seen[id] = true
+		}
+	}
+	if b.Entertainment != nil {
+		for id, a := range b.Entertainment.Areas {
+			n, err := strconv.Atoi(id)
+			if err != nil || n < firstEntertainmentGroupID || n >= b.Entertainment.Next {
+				return fmt.Errorf("invalid ID %s for entertainment group", id)
+			}
+			if a == nil {
+				return fmt.Errorf("entertainment group %s is empty", id)
+			}
+			if err := a.validate(); err != nil {
+				return fmt.Errorf("invalid entertainment group %s: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// createBackup returns the current state of the bridge
+func (s *Server) createBackup() *backupArchive {
+	s.config.RLock()
+	b := &backupArchive{
+		CreatedAt: DateTimeToISO8600(now().UTC()),
+		Bridge: backupBridge{
+			Name:     s.config.Name,
+			BridgeID: s.config.BridgeID,
+			MAC:      s.config.MACAddress,
+			Timezone: s.config.timezone.String(),
+		},
+		Whitelist: copyWhitelist(*s.config.Whitelist),
+	}
+	alexa := s.config.alexa
+	s.config.RUnlock()
+
+	s.entertainment.Lock()
+	areas := make(map[string]*entertainmentArea, len(s.entertainment.Areas))
+	for id, a := range s.entertainment.Areas {
+		areas[id] = a.clone()
+	}
+	b.Entertainment = &storedEntertainmentAreas{Areas: areas, Next: s.entertainment.Next}
+	s.entertainment.Unlock()
+
+	if alexa {
+		s.ids.Lock()
+		ids := make(map[string]string, len(s.ids.IDs))
+		for topic, id := range s.ids.IDs {
+			ids[topic] = id
+		}
+		b.IDMap = &idMap{IDs: ids, Next: s.ids.Next}
+		s.ids.Unlock()
+	}
+	return b
+}
+
+// encodeBackup returns the versioned archive of the backup
+func encodeBackup(b *backupArchive) ([]byte, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode as JSON: %v", err)
+	}
+	return backupSchema.encode(data)
+}
+
+// decodeBackup reads and validates a versioned archive
+func decodeBackup(archive []byte) (*backupArchive, error) {
+	data, err := backupSchema.decode(archive)
+	if err != nil {
+		return nil, err
+	}
+	b := &backupArchive{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("failed to decode backup: %v", err)
+	}
+	if b.Whitelist == nil {
+		b.Whitelist = map[string]whitelist{}
+	}
+	if err := b.validate(); err != nil {
+		return nil, fmt.Errorf("invalid backup: %v", err)
+	}
+	return b, nil
+}
+
+// bridgeState is everything a restore replaces, so it can be put back if
+// the restore can't be persisted
+type bridgeState struct {
+	whitelist  *map[string]whitelist
+	name       string
+	timezone   *time.Location
+	mac        MACAddr
+	adoptedMAC MACAddr
+	ids        map[string]string
+	nextID     int
+	areas      map[string]*entertainmentArea
+	nextArea   int
+}
+
+// state returns the current state, the caller must hold the lock of the
+// entertainment groups and then the config
+func (s *Server) state() *bridgeState {
+	st := &bridgeState{
+		whitelist:  s.config.Whitelist,
+		name:       s.config.Name,
+		timezone:   s.config.timezone,
+		mac:        s.config.MACAddress,
+		adoptedMAC: s.config.adoptedMAC,
+	}
+	s.ids.Lock()
+	st.ids, st.nextID = s.ids.IDs, s.ids.Next
+	s.ids.Unlock()
+	st.areas, st.nextArea = s.entertainment.Areas, s.entertainment.Next
+	return st
+}
+
+// setState replaces the current state, the caller must hold the lock of
+// the entertainment groups and then the config
+func (s *Server) setState(st *bridgeState) {
+	s.config.Whitelist = st.whitelist
+	s.config.Name = st.name
+	s.config.timezone = st.timezone
+	s.config.setMAC(st.mac)
+	s.config.adoptedMAC = st.adoptedMAC
+	s.ids.Lock()
+	s.ids.IDs, s.ids.Next = st.ids, st.nextID
+	s.ids.Unlock()
+	s.entertainment.Areas, s.entertainment.Next = st.areas, st.nextArea
+	for id := range st.areas {
+		s.ids.reserveGroups(id)
+	}
+}
+
+// restoreBackup replaces the state of the bridge with the backup. Backups
+// of another bridge are only restored if identity says what to do with its
+// ID. Either all of the backup is restored or none of it is
+func (s *Server) restoreBackup(b *backupArchive, identity Identity) error {
+	// Saving the entertainment groups takes the config lock while holding
+	// theirs, so they're locked first
+	s.entertainment.Lock()
+	defer s.entertainment.Unlock()
+	s.config.Lock()
+	defer s.config.Unlock()
+
+	adopt := false
+	if b.Bridge.BridgeID != s.config.BridgeID {
+		switch identity {
+		case IdentityKeep:
+			s.logger.Warn(fmt.Sprintf(
+				"restoring backup of bridge %s as bridge %s, apps will have to find the bridge again",
+				b.Bridge.BridgeID, s.config.BridgeID))
+		case IdentityArchive:
+			adopt = true
+		default:
+			return errIdentityMismatch
+		}
+	}
+
+	tz, err := time.LoadLocation(b.Bridge.Timezone)
+	if err != nil {
+		return err
+	}
+
+	old := s.state()
+	wt := copyWhitelist(b.Whitelist)
+	restored := *old
+	restored.whitelist = &wt
+	restored.name = b.Bridge.Name
+	restored.timezone = tz
+	if adopt {
+		restored.mac = b.Bridge.MAC
+		restored.adoptedMAC = b.Bridge.MAC
+	}
+	saves := []func() error{s.saveWhitelist, s.saveSettings}
+	if b.IDMap != nil {
+		restored.ids = make(map[string]string, len(b.IDMap.IDs))
+		for topic, id := range b.IDMap.IDs {
+			restored.ids[topic] = id
+		}
+		restored.nextID = b.IDMap.Next
+		saves = append(saves, s.saveIDMap)
+	}
+	if b.Entertainment != nil {
+		restored.areas = make(map[string]*entertainmentArea, len(b.Entertainment.Areas))
+		for id, a := range b.Entertainment.Areas {
+			restored.areas[id] = a.clone()
+		}
+		restored.nextArea = b.Entertainment.Next
+		if restored.nextArea < firstEntertainmentGroupID {
+			restored.nextArea = firstEntertainmentGroupID
+		}
+		saves = append(saves, func() error {
+			path := s.config.entertainmentPath
+			if path == "" {
+				return nil
+			}
+			return writeEntertainment(s.config.store, path, s.entertainment)
+		})
+	}
+
+	streaming, _ := s.entertainment.streaming()
+	s.setState(&restored)
+	for i, save := range saves {
+		if err := save(); err != nil {
+			s.setState(old)
+			for _, undo := range saves[:i] {
+				if uerr := undo(); uerr != nil {
+					s.logger.Error(fmt.Sprintf("failed to roll back restore: %v", uerr))
+				}
+			}
+			return fmt.Errorf("failed to restore backup: %v", err)
+		}
+	}
+
+	s.announcer.announce()
+	if streaming != "" && b.Entertainment != nil {
+		s.stream.stop()
+	}
+	if adopt {
+		s.logger.Warn(fmt.Sprintf("took over the identity of bridge %s with MAC %s",
+			b.Bridge.BridgeID, net.HardwareAddr(b.Bridge.MAC)))
+	}
+	s.logger.Info(fmt.Sprintf("restored backup of bridge %s from %s",
+		b.Bridge.BridgeID, b.CreatedAt))
+	return nil
+}
@@ -0,0 +1,183 @@
+package bridge
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingStore fails to write fail
+type failingStore struct {
+	Store
+	fail string
+}
+
+func (fs *failingStore) Write(name string, data []byte) error {
+	if name == fs.fail {
+		return errors.New("disk full")
+	}
+	return fs.Store.Write(name, data)
+}
+
+func TestBackup(t *testing.T) {
+	newServer := func(t *testing.T, mac string, opts ...ConfigOption) *Server {
+		return newTestServer(t, append([]ConfigOption{MAC(mac), Timezone("Europe/Stockholm"),
+			AlexaCompatibility(true), Storage(NewMemoryStore()),
+			WhitelistConfigPath("whitelist.json"), IDMapPath("idmap.json"),
+			EntertainmentPath("entertainment.json"), SettingsPath("settings.json")}, opts...)...)
+	}
+
+	src := newServer(t, "00:17:88:a1:b2:c3")
+	src.config.Whitelist = &map[string]whitelist{
+		"user": {Name: "app#phone", ClientKey: "00112233445566778899AABBCCDDEEFF"},
+	}
+	src.ids.get("lights/a")
+	src.ids.get("lights/b")
+	src.entertainment.add(&entertainmentArea{Name: "TV", Class: tvRoom, Lights: []string{"1", "2"},
+		Locations: map[string]lightLocation{"1": {-1, 1, 0}, "2": {1, 1, 0}}}, src.ids.taken)
+
+	archive, err := encodeBackup(src.createBackup())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	t.Run("same bridge", func(t *testing.T) {
+		dst := newServer(t, "00:17:88:a1:b2:c3")
+		b, err := decodeBackup(archive)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.NoError(t, dst.restoreBackup(b, IdentityUnchanged))
+		assert.Equal(t, *src.config.Whitelist, *dst.config.Whitelist)
+		assert.Equal(t, src.config.Name, dst.config.Name)
+		id, assigned := dst.ids.get("lights/b")
+		assert.Equal(t, "2", id)
+		assert.False(t, assigned)
+		if assert.Contains(t, dst.entertainment.Areas, "200") {
+			assert.Equal(t, src.entertainment.Areas["200"], dst.entertainment.Areas["200"])
+		}
+		assert.Equal(t, 201, dst.entertainment.Next)
+
+		wt, err := dst.loadWhitelist()
+		assert.NoError(t, err)
+		assert.Equal(t, *src.config.Whitelist, *wt)
+
+		dst.entertainment = newEntertainmentAreas()
+		assert.NoError(t, dst.loadEntertainment())
+		assert.Len(t, dst.entertainment.Areas, 1)
+	})
+	t.Run("other bridge", func(t *testing.T) {
+		b, err := decodeBackup(archive)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		dst := newServer(t, "00:17:88:00:00:01")
+		assert.Equal(t, errIdentityMismatch, dst.restoreBackup(b, IdentityUnchanged))
+		assert.Len(t, *dst.config.Whitelist, 0)
+
+		assert.NoError(t, dst.restoreBackup(b, IdentityKeep))
+		assert.Equal(t, "001788FFFE000001", dst.config.BridgeID)
+		assert.Len(t, *dst.config.Whitelist, 1)
+
+		st := NewMemoryStore()
+		dst = newServer(t, "00:17:88:00:00:01", Storage(st))
+		assert.NoError(t, dst.restoreBackup(b, IdentityArchive))
+		assert.Equal(t, src.config.BridgeID, dst.config.BridgeID)
+		assert.Equal(t, src.config.uuid, dst.config.uuid)
+
+		restarted := newServer(t, "00:17:88:00:00:01", Storage(st))
+		assert.NoError(t, restarted.loadSettings())
+		assert.Equal(t, src.config.BridgeID, restarted.config.BridgeID, "the identity should survive a restart")
+		assert.Equal(t, src.config.uuid, restarted.config.uuid)
+	})
+	t.Run("rollback", func(t *testing.T) {
+		b, err := decodeBackup(archive)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		for _, fail := range []string{"whitelist.json", "settings.json", "idmap.json", "entertainment.json"} {
+			st := NewMemoryStore()
+			dst := newServer(t, "00:17:88:00:00:01", Storage(&failingStore{Store: st, fail: fail}))
+			dst.ids.get("lights/c")
+			assert.Error(t, dst.restoreBackup(b, IdentityArchive), fail)
+
+			assert.Equal(t, "001788FFFE000001", dst.config.BridgeID, fail)
+			assert.Equal(t, t.Name(), dst.config.Name, fail)
+			assert.Len(t, *dst.config.Whitelist, 0, fail)
+			assert.Equal(t, map[string]string{"lights/c": "1"}, dst.ids.IDs, fail)
+			assert.Len(t, dst.entertainment.Areas, 0, fail)
+
+			restarted := newServer(t, "00:17:88:00:00:01", Storage(st))
+			wt, err := restarted.loadWhitelist()
+			assert.NoError(t, err)
+			assert.Len(t, *wt, 0, fail)
+			assert.NoError(t, restarted.loadSettings())
+			assert.Equal(t, "001788FFFE000001", restarted.config.BridgeID, fail)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for name, archive := range map[string]string{
+			"garbage":     `nope`,
+			"unversioned": `{"bridge": {}}`,
+			"newer":       `{"version": 2, "data": {}}`,
+			"bad bridge id": `{"version": 1, "data": {"bridge": {"mac": "00:17:88:a1:b2:c3",
+				"bridgeid": "nope", "timezone": "UTC"}}}`,
+			"bad clientkey": `{"version": 1, "data": {"bridge": {"mac": "00:17:88:a1:b2:c3",
+				"bridgeid": "001788FFFEA1B2C3", "timezone": "UTC"},
+				"whitelist": {"a": {"clientkey": "abc"}}}}`,
+			"bad ids": `{"version": 1, "data": {"bridge": {"mac": "00:17:88:a1:b2:c3",
+				"bridgeid": "001788FFFEA1B2C3", "timezone": "UTC"},
+				"idmap": {"ids": {"a": "1", "b": "1"}, "next": 2}}}`,
+			"bad entertainment id": `{"version": 1, "data": {"bridge": {"mac": "00:17:88:a1:b2:c3",
+				"bridgeid": "001788FFFEA1B2C3", "timezone": "UTC"},
+				"entertainment": {"areas": {"1": {"name": "TV", "class": "TV", "lights": ["1"]}}, "next": 201}}}`,
+			"bad entertainment location": `{"version": 1, "data": {"bridge": {"mac": "00:17:88:a1:b2:c3",
+				"bridgeid": "001788FFFEA1B2C3", "timezone": "UTC"},
+				"entertainment": {"areas": {"200": {"name": "TV", "class": "TV", "lights": ["1"],
+				"locations": {"2": [0, 0, 0]}}}, "next": 201}}}`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := decodeBackup([]byte(archive))
+				assert.Error(t, err)
+			})
+		}
+	})
+	t.Run("admin", func(t *testing.T) {
+		dst := newServer(t, "00:17:88:00:00:01")
+		r := dst.newAdminRouter()
+		restore := func(query, body string) int {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, newAdminRequest(http.MethodPost, "/restore"+query, bytes.NewBufferString(body)))
+			return rec.Code
+		}
+		browser := func(header, value string) int {
+			rec := httptest.NewRecorder()
+			req := newAdminRequest(http.MethodPost, "/restore?identity=keep", bytes.NewBuffer(archive))
+			req.Header.Set(header, value)
+			r.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		assert.Equal(t, http.StatusUnsupportedMediaType, browser("Content-Type", "text/plain"))
+		assert.Equal(t, http.StatusForbidden, browser("Origin", "http://example.com"))
+		assert.Len(t, *dst.config.Whitelist, 0, "a web page shouldn't be able to restore a backup")
+
+		assert.Equal(t, http.StatusBadRequest, restore("", "nope"))
+		assert.Equal(t, http.StatusBadRequest, restore("?identity=mine", string(archive)))
+		assert.Equal(t, http.StatusConflict, restore("", string(archive)))
+		assert.Equal(t, http.StatusOK, restore("?identity=keep", string(archive)))
+
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/backup", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		b, err := decodeBackup(rec.Body.Bytes())
+		if assert.NoError(t, err) {
+			assert.Equal(t, dst.config.BridgeID, b.Bridge.BridgeID)
+			assert.Len(t, b.Whitelist, 1)
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+)
+
+// calibration sits between the Hue API and a Hemtjanst device. Hue clients
+// assume brightness is perceptually linear, most dimmers are linear in power
+// instead, and colour lights don't all agree on what white looks like.
+//
+// A nil *calibration is valid and converts values without altering them.
+type calibration struct {
+	// Gamma applies a power curve to brightness, 2.2 is a good start
+	// for dimmers that are linear in power
+	Gamma float64 `json:"gamma,omitempty"`
+	// Table is a lookup table of [bri, level] points with bri between 1-254
+	// and level the percentage of the device's brightness range. Values in
+	// between points are interpolated
+	Table [][2]float64 `json:"table,omitempty"`
+	// MinimumOn is the lowest percentage of the device's brightness range
+	// at which the light still produces light. The curve is spread between
+	// it and 100 so the bottom of the Hue range isn't all the same level
+	MinimumOn float64 `json:"minimum,omitempty"`
+	// XYOffset is added to xy coordinates sent to the device
+	XYOffset []float64 `json:"xy_offset,omitempty"`
+	// CTOffset is added, in mireds, to colour temperatures sent to the device
+	CTOffset int `json:"ct_offset,omitempty"`
+}
+
+func (c *calibration) validate() error {
+	if c.Gamma < 0 {
+		return fmt.Errorf("gamma must be positive, got %f", c.Gamma)
+	}
+	if c.Gamma != 0 && len(c.Table) > 0 {
+		return fmt.Errorf("gamma and table can't be combined")
+	}
+	if len(c.Table) > 0 {
+		if len(c.Table) < 2 {
+			return fmt.Errorf("table must have at least 2 points")
+		}
+		if c.Table[0][0] != 1 || c.Table[len(c.Table)-1][0] != 254 {
+			return fmt.Errorf("table must start at bri 1 and end at bri 254")
+		}
+		for i, pt := range c.Table {
+			if pt[1] < 0 || pt[1] > 100 {
+				return fmt.Errorf("table level must be between 0 and 100, got %f", pt[1])
+			}
+			if i > 0 && (pt[0] <= c.Table[i-1][0] || pt[1] <= c.Table[i-1][1]) {
+				return fmt.Errorf("table must be strictly increasing")
+			}
+		}
+	}
+	if c.MinimumOn < 0 || c.MinimumOn > 100 {
+		return fmt.Errorf("minimum must be between 0 and 100, got %f", c.MinimumOn)
+	}
+	if c.XYOffset != nil && len(c.XYOffset) != 2 {
+		return fmt.Errorf("xy_offset must have 2 elements, got %d", len(c.XYOffset))
+	}
+	return nil
+}
+
+// interpolate returns the y for x along a piecewise linear curve through the
+// points, which must be sorted on x
+func interpolate(pts [][2]float64, x float64) float64 {
+	if x <= pts[0][0] {
+		return pts[0][1]
+	}
+	for i := 1; i < len(pts); i++ {
+		if x <= pts[i][0] {
+			x0, y0, x1, y1 := pts[i-1][0], pts[i-1][1], pts[i][0], pts[i][1]
+			return y0 + (x-x0)*(y1-y0)/(x1-x0)
+		}
+	}
+	return pts[len(pts)-1][1]
+}
+
+// curve maps a perceptual brightness between 0-1 to a device level
+// between 0-1
+func (c *calibration) curve(p float64) float64 {
+	switch {
+	case len(c.Table) > 0:
+		return interpolate(c.Table, 1+p*253) / 100
+	case c.Gamma > 0:
+		return math.Pow(p, c.Gamma)
+	}
+	return p
+}
+
+// inverseCurve maps a device level between 0-1 back to a perceptual
+// brightness between 0-1
+func (c *calibration) inverseCurve(level float64) float64 {
+	switch {
+	case len(c.Table) > 0:
+		inv := make([][2]float64, len(c.Table))
+		for i, pt := range c.Table {
+			inv[i] = [2]float64{pt[1], pt[0]}
+		}
+		return (interpolate(inv, level*100) - 1) / 253
+	case c.Gamma > 0:
+		return math.Pow(level, 1/c.Gamma)
+	}
+	return level
+}
+
+// hemtjanstBrightness converts a Philips Hue brightness to a Hemtjanst
+// brightness within the range
+func (c *calibration) hemtjanstBrightness(bri int, r valueRange) int {
+	if c == nil {
+		return brightnessToHemtjanst(bri, r)
+	}
+	p := float64(philipsBrightnessRange.snap(bri)-1) / 253
+	min := c.MinimumOn / 100
+	level := min + (1-min)*c.curve(p)
+	return r.snap(r.Min + int(math.Round(level*float64(r.Max-r.Min))))
+}
+
+// philipsBrightness converts a Hemtjanst brightness within the range to a
+// Philips Hue brightness, between 1-254
+func (c *calibration) philipsBrightness(v int, r valueRange) int {
+	if c == nil {
+		return brightnessToPhilips(v, r)
+	}
+	level := math.Min(math.Max(float64(v-r.Min)/float64(r.Max-r.Min), 0), 1)
+	min := c.MinimumOn / 100
+	if min >= 1 {
+		return philipsBrightnessRange.Max
+	}
+	// Anything at or below the minimum is the bottom of the curve
+	level = math.Max((level-min)/(1-min), 0)
+	p := math.Min(math.Max(c.inverseCurve(level), 0), 1)
+	return philipsBrightnessRange.snap(1 + int(math.Round(p*253)))
+}
+
+// hemtjanstCT converts mireds to a colour temperature for the device
+func (c *calibration) hemtjanstCT(m int, r ctRange) int {
+	if c == nil {
+		return r.toHemtjanst(m)
+	}
+	return r.toHemtjanst(m + c.CTOffset)
+}
+
+// philipsCT converts a colour temperature reported by the device to mireds
+func (c *calibration) philipsCT(v int, r ctRange) int {
+	if c == nil {
+		return r.toPhilips(v)
+	}
+	return r.toPhilips(v) - c.CTOffset
+}
+
+// hemtjanstHS converts CIE xy to hue/saturation for the device
+func (c *calibration) hemtjanstHS(x, y float64) (int, int) {
+	if c == nil || c.XYOffset == nil {
+		return CIExyToHemtjanstHS(x, y)
+	}
+	return CIExyToHemtjanstHS(x+c.XYOffset[0], y+c.XYOffset[1])
+}
+
+// philipsXY converts hue/saturation reported by the device to CIE xy
+func (c *calibration) philipsXY(h, s int) []float64 {
+	xy := HemtjanstHStoCIExy(h, s)
+	if c == nil || c.XYOffset == nil {
+		return xy
+	}
+	return []float64{xy[0] - c.XYOffset[0], xy[1] - c.XYOffset[1]}
+}
+
+// calibrationForLight returns the calibration for the light with the given
+// topic, or nil if it hasn't been calibrated
+func (s *Server) calibrationForLight(topic string) *calibration {
+	s.config.RLock()
+	defer s.config.RUnlock()
+	return s.config.calibrations[topic]
+}
+
+func (s *Server) loadCalibrationFromFile() (map[string]*calibration, error) {
+	path := s.config.calibrationPath
+	if path == "" {
+		return map[string]*calibration{}, nil
+	}
+	if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
+		s.logger.Info(fmt.Sprintf("light calibration does not exist at %s", path))
+		return map[string]*calibration{}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contents of %s: %v", path, err)
+	}
+	var cals map[string]*calibration
+	err = json.Unmarshal(data, &cals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s as JSON: %v", path, err)
+	}
+	topics := make([]string, 0, len(cals))
+	for topic := range cals {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		if cals[topic] == nil {
+			delete(cals, topic)
+			continue
+		}
+		if err := cals[topic].validate(); err != nil {
+			return nil, fmt.Errorf("invalid calibration for light %s in %s: %v", topic, path, err)
+		}
+	}
+	s.logger.Info(fmt.Sprintf("light calibration loaded from: %s", path))
+	return cals, nil
+}
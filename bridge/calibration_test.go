@@ -0,0 +1,165 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalibrationValidate(t *testing.T) {
+	cases := map[string]struct {
+		cal   calibration
+		valid bool
+	}{
+		"empty":          {calibration{}, true},
+		"gamma":          {calibration{Gamma: 2.2}, true},
+		"negative gamma": {calibration{Gamma: -1}, false},
+		"table": {calibration{Table: [][2]float64{
+			{1, 0.5}, {127, 20}, {254, 100},
+		}}, true},
+		"gamma and table": {calibration{Gamma: 2.2, Table: [][2]float64{
+			{1, 0}, {254, 100},
+		}}, false},
+		"short table":       {calibration{Table: [][2]float64{{1, 0}}}, false},
+		"partial table":     {calibration{Table: [][2]float64{{1, 0}, {200, 100}}}, false},
+		"decreasing table":  {calibration{Table: [][2]float64{{1, 50}, {127, 20}, {254, 100}}}, false},
+		"table level > 100": {calibration{Table: [][2]float64{{1, 0}, {254, 110}}}, false},
+		"minimum":           {calibration{MinimumOn: 5}, true},
+		"minimum > 100":     {calibration{MinimumOn: 101}, false},
+		"xy offset":         {calibration{XYOffset: []float64{0.01, -0.01}}, true},
+		"invalid xy offset": {calibration{XYOffset: []float64{0.01}}, false},
+		"ct offset":         {calibration{CTOffset: -20}, true},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := c.cal.validate()
+			if c.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCalibrationBrightness(t *testing.T) {
+	r := valueRange{Min: 0, Max: 100, Step: 1}
+	t.Run("nil", func(t *testing.T) {
+		var c *calibration
+		assert.Equal(t, ToHemtjanstBrightness(127), c.hemtjanstBrightness(127, r))
+		assert.Equal(t, ToPhilipsBrightness(50), c.philipsBrightness(50, r))
+	})
+	t.Run("gamma", func(t *testing.T) {
+		c := &calibration{Gamma: 2}
+		assert.Equal(t, 0, c.hemtjanstBrightness(1, r))
+		assert.Equal(t, 25, c.hemtjanstBrightness(128, r))
+		assert.Equal(t, 100, c.hemtjanstBrightness(254, r))
+		assert.Equal(t, 128, c.philipsBrightness(25, r))
+	})
+	t.Run("table", func(t *testing.T) {
+		c := &calibration{Table: [][2]float64{{1, 0}, {127, 10}, {254, 100}}}
+		assert.Equal(t, 10, c.hemtjanstBrightness(127, r))
+		assert.Equal(t, 55, c.hemtjanstBrightness(190, r))
+		assert.Equal(t, 127, c.philipsBrightness(10, r))
+	})
+	t.Run("minimum", func(t *testing.T) {
+		c := &calibration{Gamma: 2, MinimumOn: 5}
+		assert.Equal(t, 5, c.hemtjanstBrightness(1, r))
+		assert.Equal(t, 5, c.hemtjanstBrightness(10, r))
+		assert.Equal(t, 1, c.philipsBrightness(5, r))
+		assert.Equal(t, 1, c.philipsBrightness(2, r), "below the minimum is the bottom of the range")
+		assert.Equal(t, 254, (&calibration{MinimumOn: 100}).philipsBrightness(100, r))
+	})
+	t.Run("round trip", func(t *testing.T) {
+		cals := []*calibration{
+			{},
+			{Gamma: 2.2},
+			{Gamma: 2.2, MinimumOn: 3},
+			{Table: [][2]float64{{1, 1}, {64, 5}, {127, 20}, {254, 100}}},
+		}
+		for _, c := range cals {
+			for bri := 1; bri <= 254; bri++ {
+				v := c.hemtjanstBrightness(bri, r)
+				assert.Equal(t, v, c.hemtjanstBrightness(c.philipsBrightness(v, r), r))
+			}
+		}
+	})
+	t.Run("round trip from bri", func(t *testing.T) {
+		// With 16 bits of resolution every bri gets a level of its own,
+		// including at the bottom where the curve is flattest
+		r16 := valueRange{Min: 0, Max: 65535, Step: 1}
+		cals := []*calibration{
+			{},
+			{Gamma: 2.2},
+			{Gamma: 2.2, MinimumOn: 3},
+			{Table: [][2]float64{{1, 1}, {64, 5}, {127, 20}, {254, 100}}},
+		}
+		for _, c := range cals {
+			assert.Equal(t, 1, c.philipsBrightness(c.hemtjanstBrightness(1, r), r))
+			for bri := 1; bri <= 254; bri++ {
+				assert.InDelta(t, bri, c.philipsBrightness(c.hemtjanstBrightness(bri, r16), r16), 1,
+					"bri %d with %+v", bri, *c)
+			}
+		}
+	})
+}
+
+func TestCalibrationColor(t *testing.T) {
+	r := ctRange{valueRange: valueRange{Min: 153, Max: 454, Step: 1}}
+	t.Run("ct", func(t *testing.T) {
+		c := &calibration{CTOffset: 20}
+		assert.Equal(t, 320, c.hemtjanstCT(300, r))
+		assert.Equal(t, 300, c.philipsCT(320, r))
+		assert.Equal(t, 454, c.hemtjanstCT(450, r))
+	})
+	t.Run("xy", func(t *testing.T) {
+		c := &calibration{XYOffset: []float64{0.01, -0.02}}
+		var nilc *calibration
+		xy := nilc.philipsXY(120, 100)
+		cxy := c.philipsXY(120, 100)
+		assert.InDelta(t, xy[0]-0.01, cxy[0], 0.00001)
+		assert.InDelta(t, xy[1]+0.02, cxy[1], 0.00001)
+
+		h, s := nilc.hemtjanstHS(0.31, 0.31)
+		ch, cs := c.hemtjanstHS(0.30, 0.33)
+		assert.Equal(t, h, ch)
+		assert.Equal(t, s, cs)
+	})
+}
+
+func TestLoadCalibration(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestServer(t)
+
+	t.Run("no path", func(t *testing.T) {
+		cals, err := s.loadCalibrationFromFile()
+		assert.NoError(t, err)
+		assert.Len(t, cals, 0)
+	})
+	t.Run("valid", func(t *testing.T) {
+		path := filepath.Join(dir, "valid.json")
+		assert.NoError(t, ioutil.WriteFile(path,
+			[]byte(`{"test/light1": {"gamma": 2.2, "minimum": 2}, "test/light2": {"ct_offset": 10}}`), 0600))
+		s.config.calibrationPath = path
+		cals, err := s.loadCalibrationFromFile()
+		assert.NoError(t, err)
+		assert.Len(t, cals, 2)
+		assert.Equal(t, 2.2, cals["test/light1"].Gamma)
+		assert.Equal(t, 10, cals["test/light2"].CTOffset)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.json")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(`{"test/light1": {"gamma": -1}}`), 0600))
+		s.config.calibrationPath = path
+		_, err := s.loadCalibrationFromFile()
+		assert.Error(t, err)
+	})
+}
@@ -4,12 +4,43 @@ import (
 	"net/http"
 )
 
+// The limits of a Hue bridge. Creating a resource that would go over them
+// fails like it would on a real bridge
+const (
+	maxLights            = 63
+	maxSensors           = 250
+	maxCLIPSensors       = 250
+	maxZLLSensors        = 64
+	maxZGPSensors        = 64
+	maxGroups            = 64
+	maxScenes            = 200
+	maxSceneLightStates  = 12600
+	maxRules             = 250
+	maxRuleConditions    = 1500
+	maxRuleActions       = 1000
+	maxSchedules         = 100
+	maxResourceLinks     = 64
+	maxWhitelist         = 1000
+	maxStreams           = 1
+	maxStreamingChannels = 10
+)
+
 type capacity struct {
 	Available int  `json:"available"`
 	Total     int  `json:"total"`
 	Channels  *int `json:"channels,omitempty"`
 }
 
+// newCapacity returns the capacity of a resource limited to total of which
+// used are in use
+func newCapacity(used, total int) capacity {
+	available := total - used
+	if available < 0 {
+		available = 0
+	}
+	return capacity{Available: available, Total: total}
+}
+
 type sensorsCapacity struct {
 	capacity
 	Clip capacity `json:"clip"`
@@ -24,7 +55,8 @@ type scenesCapacity struct {
 
 type rulesCapacity struct {
 	capacity
-	Actions capacity `json:"actions"`
+	Conditions capacity `json:"conditions"`
+	Actions    capacity `json:"actions"`
 }
 
 type capabilities struct {
@@ -32,7 +64,7 @@ type capabilities struct {
 	Sensors       sensorsCapacity     `json:"sensors"`
 	Groups        capacity            `json:"groups"`
 	Scenes        scenesCapacity      `json:"scenes"`
-	Rules         capacity            `json:"rules"`
+	Rules         rulesCapacity       `json:"rules"`
 	Schedules     capacity            `json:"schedules"`
 	ResourceLinks capacity            `json:"resourcelinks"`
 	Whitelists    capacity            `json:"whitelists"`
@@ -44,26 +76,59 @@ func (capabilities) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func (s *Server) getCapabilities(w http.ResponseWriter, r *http.Request) {
-	c := capabilities{
-		Lights: capacity{
-			Available: 0,
-			Total:     s.config.lights,
-		},
-		Groups: capacity{
-			Available: 0,
-			Total:     s.config.groups,
+// createCapabilities returns what's in use of everything the bridge limits
+func (s *Server) createCapabilities() capabilities {
+	lights := s.getAllLights()
+	groups := s.createGroups()
+	sensors := s.createSensors()
+	dummies := s.createDummies()
+
+	s.config.RLock()
+	whitelisted := len(*s.config.Whitelist)
+	streamingEnabled := s.config.streamingAddress != ""
+	s.config.RUnlock()
+
+	// Without the streaming server the bridge has no streaming capacity
+	streaming := newCapacity(0, 0)
+	streaming.Channels = IntPtr(0)
+	if streamingEnabled {
+		s.entertainment.Lock()
+		id, _ := s.entertainment.streaming()
+		s.entertainment.Unlock()
+		active := 0
+		if id != "" {
+			active = 1
+		}
+		streaming = newCapacity(active, maxStreams)
+		streaming.Channels = IntPtr(maxStreamingChannels)
+	}
+
+	return capabilities{
+		Lights: newCapacity(len(lights), maxLights),
+		Sensors: sensorsCapacity{
+			capacity: newCapacity(len(sensors), maxSensors),
+			Clip:     newCapacity(0, maxCLIPSensors),
+			ZLL:      newCapacity(0, maxZLLSensors),
+			ZGP:      newCapacity(0, maxZGPSensors),
 		},
-		Whitelists: capacity{
-			Available: 1000,
-			Total:     len(*s.config.Whitelist),
+		Groups: newCapacity(len(groups), maxGroups),
+		Scenes: scenesCapacity{
+			capacity:    newCapacity(len(dummies), maxScenes),
+			LightStates: newCapacity(0, maxSceneLightStates),
 		},
-		Timezones: map[string][]string{"values": []string{"UTC"}},
-		Streaming: capacity{
-			Available: 0,
-			Total:     0,
-			Channels:  IntPtr(0),
+		Rules: rulesCapacity{
+			capacity:   newCapacity(len(dummies), maxRules),
+			Conditions: newCapacity(0, maxRuleConditions),
+			Actions:    newCapacity(0, maxRuleActions),
 		},
+		Schedules:     newCapacity(len(dummies), maxSchedules),
+		ResourceLinks: newCapacity(len(dummies), maxResourceLinks),
+		Whitelists:    newCapacity(whitelisted, maxWhitelist),
+		Timezones:     map[string][]string{"values": timezones()},
+		Streaming:     streaming,
 	}
-	renderOK(w, r, c)
+}
+
+func (s *Server) getCapabilities(w http.ResponseWriter, r *http.Request) {
+	renderOK(w, r, s.createCapabilities())
 }
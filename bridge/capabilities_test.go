@@ -0,0 +1,50 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"lib.hemtjan.st/testutils"
+)
+
+func TestNewCapacity(t *testing.T) {
+	assert.Equal(t, capacity{Available: 62, Total: 63}, newCapacity(1, 63))
+	assert.Equal(t, capacity{Available: 0, Total: 63}, newCapacity(64, 63))
+}
+
+func TestGetCapabilities(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	b, shutdown := NewTestingBridge(t, nil)
+	defer cancel()
+	defer shutdown(ctx)
+
+	clf, m := NewTestingTransport(t, nil)
+	defer clf()
+	cleanup, err := testutils.DevicesFromJSON("./testing_data/light-dim.json", m)
+	assert.NoError(t, err)
+	defer cleanup()
+
+	b.mqtt.WaitForDevice(ctx, "test/light1")
+
+	username := registerTestingUser(t, b)
+
+	st, body := tReq(t, b, http.MethodGet, fmt.Sprintf("/api/%s/capabilities", username), nil)
+	assert.Equal(t, http.StatusOK, st)
+
+	dec := capabilities{}
+	err = json.Unmarshal(body, &dec)
+	assert.NoError(t, err)
+	assert.Equal(t, capacity{Available: maxLights - 1, Total: maxLights}, dec.Lights)
+	assert.Equal(t, capacity{Available: maxGroups - 1, Total: maxGroups}, dec.Groups)
+	assert.Equal(t, capacity{Available: maxSensors - 1, Total: maxSensors}, dec.Sensors.capacity)
+	assert.Equal(t, capacity{Available: maxScenes, Total: maxScenes}, dec.Scenes.capacity)
+	assert.Equal(t, capacity{Available: maxRules, Total: maxRules}, dec.Rules.capacity)
+	assert.Equal(t, capacity{Available: maxSchedules, Total: maxSchedules}, dec.Schedules)
+	assert.Equal(t, maxWhitelist-1, dec.Whitelists.Available)
+	assert.Contains(t, dec.Timezones["values"], "UTC")
+}
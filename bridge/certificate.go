@@ -0,0 +1,238 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// bridgeIDPattern matches the CN of certificates for a Hue bridge
+var bridgeIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{6}[fF]{3}[eE][0-9a-fA-F]{6}$`)
+
+// Validity of the certificates we generate, the same as a real bridge
+var (
+	certNotBefore = time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	certNotAfter  = time.Date(2038, time.January, 19, 3, 14, 7, 0, time.UTC)
+)
+
+// newCertificate returns a self-signed certificate and key like a Hue bridge
+// has: ECDSA P-256 with the bridge ID as CN and its decimal value as serial
+func newCertificate(bridgeID string) (certPEM, keyPEM []byte, err error) {
+	serial, ok := new(big.Int).SetString(bridgeID, 16)
+	if !ok {
+		return nil, nil, fmt.Errorf("bridge ID %s is not hexadecimal", bridgeID)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Country:      []string{"NL"},
+			Organization: []string{"Philips Hue"},
+			CommonName:   bridgeID,
+		},
+		NotBefore:             certNotBefore,
+		NotAfter:              certNotAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// loadCertificate reads the TLS certificate and key from the store
+func loadCertificate(c *Config) (*tls.Certificate, error) {
+	cr := newCertReloader(c, zap.NewNop())
+	if _, err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr.cert, nil
+}
+
+// ensureCertificate generates the TLS certificate if there's none yet. A
+// certificate of a bridge with another ID, because the MAC changed, is
+// replaced. Certificates that aren't for a bridge at all are left alone
+func (s *Server) ensureCertificate() error {
+	s.config.RLock()
+	c := s.config
+	pub, priv, bridgeID, st := c.tlsPubKey, c.tlsPrivKey, c.BridgeID, c.store
+	s.config.RUnlock()
+	if pub == "" || priv == "" {
+		return nil
+	}
+
+	_, errPub := st.Read(pub)
+	_, errPriv := st.Read(priv)
+	switch {
+	case errPub == errNotStored || errPriv == errNotStored:
+		s.logger.Info(fmt.Sprintf("generating TLS certificate for bridge %s", bridgeID))
+	case errPub != nil:
+		return fmt.Errorf("failed to read TLS certificate from %s: %v", pub, errPub)
+	case errPriv != nil:
+		return fmt.Errorf("failed to read TLS key from %s: %v", priv, errPriv)
+	default:
+		cert, err := loadCertificate(c)
+		if err != nil {
+			return err
+		}
+		cn := cert.Leaf.Subject.CommonName
+		if strings.EqualFold(cn, bridgeID) {
+			return nil
+		}
+		if !bridgeIDPattern.MatchString(cn) {
+			s.logger.Warn(fmt.Sprintf(
+				"TLS certificate is for %s instead of bridge %s, Hue apps may refuse it", cn, bridgeID))
+			return nil
+		}
+		s.logger.Warn(fmt.Sprintf(
+			"TLS certificate is for bridge %s but this is bridge %s, probably because the MAC changed, generating a new one",
+			cn, bridgeID))
+	}
+
+	certPEM, keyPEM, err := newCertificate(bridgeID)
+	if err != nil {
+		return fmt.Errorf("failed to generate TLS certificate: %v", err)
+	}
+	// Write the key first, a certificate without its key is useless
+	if err := st.Write(priv, keyPEM); err != nil {
+		return fmt.Errorf("failed to write TLS key to %s: %v", priv, err)
+	}
+	if err := st.Write(pub, certPEM); err != nil {
+		return fmt.Errorf("failed to write TLS certificate to %s: %v", pub, err)
+	}
+	s.logger.Info(fmt.Sprintf("wrote TLS certificate to %s and key to %s", pub, priv))
+	return nil
+}
+
+// certReloadInterval is how often the TLS certificate is checked for
+// changes
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves the TLS certificate and swaps it when it changes in
+// the store, so it can be rotated without restarting the bridge
+type certReloader struct {
+	config  *Config
+	logger  *zap.Logger
+	cert    *tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+	// failed is the certificate and key that last failed to load, so a
+	// broken rotation is only reported once
+	failed [2][]byte
+	sync.RWMutex
+}
+
+func newCertReloader(c *Config, l *zap.Logger) *certReloader {
+	return &certReloader{config: c, logger: l}
+}
+
+// GetCertificate returns the current certificate, it's meant for
+// tls.Config
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+	if cr.cert == nil {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	return cr.cert, nil
+}
+
+// load reads the certificate and key and swaps them in if they changed. It
+// returns whether they did. On error the current certificate is kept
+func (cr *certReloader) load() (bool, error) {
+	cr.config.RLock()
+	st, pub, priv := cr.config.store, cr.config.tlsPubKey, cr.config.tlsPrivKey
+	cr.config.RUnlock()
+
+	certPEM, err := st.Read(pub)
+	if err != nil {
+		return false, fmt.Errorf("failed to read TLS certificate from %s: %v", pub, err)
+	}
+	keyPEM, err := st.Read(priv)
+	if err != nil {
+		return false, fmt.Errorf("failed to read TLS key from %s: %v", priv, err)
+	}
+
+	cr.Lock()
+	defer cr.Unlock()
+	if bytes.Equal(certPEM, cr.certPEM) && bytes.Equal(keyPEM, cr.keyPEM) {
+		return false, nil
+	}
+	if bytes.Equal(certPEM, cr.failed[0]) && bytes.Equal(keyPEM, cr.failed[1]) {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if err != nil {
+		cr.failed = [2][]byte{certPEM, keyPEM}
+		return false, fmt.Errorf("failed to load TLS key/cert: %v", err)
+	}
+
+	cr.cert, cr.certPEM, cr.keyPEM = &cert, certPEM, keyPEM
+	cr.failed = [2][]byte{}
+	return true, nil
+}
+
+// reload loads the certificate if it changed and logs the outcome, a
+// certificate that fails to load is logged and the current one kept
+func (cr *certReloader) reload() {
+	changed, err := cr.load()
+	if err != nil {
+		cr.logger.Error(fmt.Sprintf("keeping the current TLS certificate: %v", err))
+		return
+	}
+	if changed {
+		cr.logger.Info("reloaded TLS certificate")
+	}
+}
+
+// watch reloads the certificate every certReloadInterval until quit
+func (cr *certReloader) watch(quit chan bool) {
+	tick := time.NewTicker(certReloadInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			cr.reload()
+		case <-quit:
+			cr.logger.Info("stopped TLS certificate reloader")
+			return
+		}
+	}
+}
+
+// ReloadCertificate loads the TLS certificate again if it changed, like
+// after it was rotated. If the new one can't be loaded the current one is
+// kept
+func (s *Server) ReloadCertificate() {
+	s.certs.reload()
+}
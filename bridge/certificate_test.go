@@ -0,0 +1,138 @@
+package bridge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestEnsureCertificate(t *testing.T) {
+	st := NewMemoryStore()
+	newServer := func(t *testing.T, mac string) *Server {
+		return newTestServer(t, MAC(mac), Storage(st),
+			TLSPublicKeyPath("public.crt"), TLSPrivateKeyPath("private.key"))
+	}
+
+	t.Run("generate", func(t *testing.T) {
+		s := newServer(t, "00:17:88:a1:b2:c3")
+		assert.NoError(t, s.ensureCertificate())
+		cert, err := loadCertificate(s.config)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, "001788FFFEA1B2C3", cert.Leaf.Subject.CommonName)
+		assert.Equal(t, "6624557534393027", cert.Leaf.SerialNumber.String())
+		assert.Equal(t, x509.ECDSA, cert.Leaf.PublicKeyAlgorithm)
+		assert.Equal(t, elliptic.P256(), cert.Leaf.PublicKey.(*ecdsa.PublicKey).Curve)
+
+		before, _ := st.Read("public.crt")
+		assert.NoError(t, s.ensureCertificate())
+		after, _ := st.Read("public.crt")
+		assert.Equal(t, before, after, "certificate should be kept")
+	})
+	t.Run("MAC changed", func(t *testing.T) {
+		s := newServer(t, "00:17:88:00:00:01")
+		assert.NoError(t, s.ensureCertificate())
+		cert, err := loadCertificate(s.config)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "001788FFFE000001", cert.Leaf.Subject.CommonName)
+		}
+	})
+	t.Run("not a bridge certificate", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "bridge.example.com"},
+			NotBefore:    certNotBefore,
+			NotAfter:     certNotAfter,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		assert.NoError(t, st.Write("public.crt", certPEM))
+		assert.NoError(t, st.Write("private.key",
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+
+		s := newServer(t, "00:17:88:00:00:01")
+		assert.NoError(t, s.ensureCertificate())
+		after, _ := st.Read("public.crt")
+		assert.Equal(t, certPEM, after)
+	})
+}
+
+func TestCertReloader(t *testing.T) {
+	st := NewMemoryStore()
+	c, err := NewConfig(Name(t.Name()), Storage(st),
+		TLSPublicKeyPath("public.crt"), TLSPrivateKeyPath("private.key"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	write := func(t *testing.T, bridgeID string) {
+		certPEM, keyPEM, err := newCertificate(bridgeID)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assert.NoError(t, st.Write("public.crt", certPEM))
+		assert.NoError(t, st.Write("private.key", keyPEM))
+	}
+	cn := func(t *testing.T, cr *certReloader) string {
+		cert, err := cr.GetCertificate(nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return cert.Leaf.Subject.CommonName
+	}
+
+	cr := newCertReloader(c, zap.NewNop())
+	_, err = cr.GetCertificate(nil)
+	assert.Error(t, err)
+	_, err = cr.load()
+	assert.Error(t, err, "nothing to load yet")
+
+	write(t, "001788FFFE000001")
+	changed, err := cr.load()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "001788FFFE000001", cn(t, cr))
+
+	changed, err = cr.load()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	t.Run("rotated", func(t *testing.T) {
+		write(t, "001788FFFE000002")
+		changed, err := cr.load()
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, "001788FFFE000002", cn(t, cr))
+	})
+	t.Run("broken", func(t *testing.T) {
+		_, otherKey, _ := newCertificate("001788FFFE000003")
+		assert.NoError(t, st.Write("private.key", otherKey))
+		_, err := cr.load()
+		assert.Error(t, err)
+		assert.Equal(t, "001788FFFE000002", cn(t, cr), "current certificate should be kept")
+
+		_, err = cr.load()
+		assert.NoError(t, err, "a broken certificate should only be reported once")
+
+		assert.NoError(t, st.Write("public.crt", []byte("nope")))
+		_, err = cr.load()
+		assert.Error(t, err)
+		assert.Equal(t, "001788FFFE000002", cn(t, cr))
+	})
+}
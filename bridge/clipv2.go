@@ -0,0 +1,686 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+// clipKeyHeader carries the username of the whitelisted user in the CLIP v2
+// API, which doesn't have it in the path
+const clipKeyHeader = "hue-application-key"
+
+// The resource types of the CLIP v2 API
+const (
+	clipDevice       = "device"
+	clipLight        = "light"
+	clipRoom         = "room"
+	clipZone         = "zone"
+	clipGroupedLight = "grouped_light"
+	clipBridge       = "bridge"
+	clipBridgeHome   = "bridge_home"
+	clipMotion       = "motion"
+	clipTemperature  = "temperature"
+	clipButton       = "button"
+)
+
+var clipTypes = []string{
+	clipDevice, clipLight, clipRoom, clipZone, clipGroupedLight, clipBridge,
+	clipBridgeHome, clipMotion, clipTemperature, clipButton,
+}
+
+// clipSensorTypes maps v1 sensor types to the v2 resource that represents
+// them
+var clipSensorTypes = map[string]string{
+	"ZLLPresence":    clipMotion,
+	"ZLLTemperature": clipTemperature,
+	"ZLLSwitch":      clipButton,
+}
+
+type clipRef struct {
+	RID   string `json:"rid"`
+	RType string `json:"rtype"`
+}
+
+type clipMetadata struct {
+	Name      string `json:"name"`
+	Archetype string `json:"archetype,omitempty"`
+}
+
+type clipProductData struct {
+	ModelID          string `json:"model_id"`
+	ManufacturerName string `json:"manufacturer_name"`
+	ProductName      string `json:"product_name"`
+	ProductArchetype string `json:"product_archetype"`
+	Certified        bool   `json:"certified"`
+	SoftwareVersion  string `json:"software_version"`
+}
+
+type clipOn struct {
+	On bool `json:"on"`
+}
+
+type clipDimming struct {
+	Brightness  float64  `json:"brightness"`
+	MinDimLevel *float64 `json:"min_dim_level,omitempty"`
+}
+
+type clipXY struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type clipGamut struct {
+	Red   clipXY `json:"red"`
+	Green clipXY `json:"green"`
+	Blue  clipXY `json:"blue"`
+}
+
+type clipColor struct {
+	XY        clipXY     `json:"xy"`
+	GamutType string     `json:"gamut_type,omitempty"`
+	Gamut     *clipGamut `json:"gamut,omitempty"`
+}
+
+type clipMirekSchema struct {
+	Minimum int `json:"mirek_minimum"`
+	Maximum int `json:"mirek_maximum"`
+}
+
+type clipColorTemperature struct {
+	Mirek       *int            `json:"mirek"`
+	MirekValid  bool            `json:"mirek_valid"`
+	MirekSchema clipMirekSchema `json:"mirek_schema"`
+}
+
+type clipTimeZone struct {
+	TimeZone string `json:"time_zone"`
+}
+
+type clipMotionValue struct {
+	Motion      bool `json:"motion"`
+	MotionValid bool `json:"motion_valid"`
+}
+
+type clipTemperatureValue struct {
+	Temperature      float64 `json:"temperature"`
+	TemperatureValid bool    `json:"temperature_valid"`
+}
+
+type clipButtonValue struct {
+	LastEvent string `json:"last_event"`
+}
+
+// clipResource is a resource of any type in the CLIP v2 API, only the
+// fields of its type are set
+type clipResource struct {
+	ID               string                `json:"id"`
+	IDv1             string                `json:"id_v1,omitempty"`
+	Type             string                `json:"type"`
+	Owner            *clipRef              `json:"owner,omitempty"`
+	Metadata         *clipMetadata         `json:"metadata,omitempty"`
+	ProductData      *clipProductData      `json:"product_data,omitempty"`
+	Children         []clipRef             `json:"children,omitempty"`
+	Services         []clipRef             `json:"services,omitempty"`
+	On               *clipOn               `json:"on,omitempty"`
+	Dimming          *clipDimming          `json:"dimming,omitempty"`
+	Color            *clipColor            `json:"color,omitempty"`
+	ColorTemperature *clipColorTemperature `json:"color_temperature,omitempty"`
+	Mode             string                `json:"mode,omitempty"`
+	BridgeID         string                `json:"bridge_id,omitempty"`
+	TimeZone         *clipTimeZone         `json:"time_zone,omitempty"`
+	Enabled          *bool                 `json:"enabled,omitempty"`
+	Motion           *clipMotionValue      `json:"motion,omitempty"`
+	Temperature      *clipTemperatureValue `json:"temperature,omitempty"`
+	Button           *clipButtonValue      `json:"button,omitempty"`
+}
+
+func (r *clipResource) ref() clipRef {
+	return clipRef{RID: r.ID, RType: r.Type}
+}
+
+type clipError struct {
+	Description string `json:"description"`
+}
+
+type clipResponse struct {
+	Errors []clipError `json:"errors"`
+	Data   interface{} `json:"data"`
+}
+
+// renderClip responds in the format of the CLIP v2 API, data must be a
+// slice
+func renderClip(w http.ResponseWriter, r *http.Request, status int, data interface{}, errs ...string) {
+	resp := clipResponse{Errors: []clipError{}, Data: data}
+	for _, e := range errs {
+		resp.Errors = append(resp.Errors, clipError{Description: e})
+	}
+	render.Status(r, status)
+	render.JSON(w, r, resp)
+}
+
+// clipID returns the UUID of a resource. It's derived from the UUID of the
+// bridge and the v1 resource it represents, so it's stable across restarts
+func clipID(bridge uuid.UUID, rtype, v1 string) string {
+	return uuid.NewSHA1(bridge, []byte(fmt.Sprintf("%s%s", rtype, v1))).String()
+}
+
+// clipBrightness converts a Philips Hue brightness, 1-254, to a percentage
+func clipBrightness(bri int) float64 {
+	return math.Round(float64(philipsBrightnessRange.snap(bri)-1)*10000/253) / 100
+}
+
+// philipsBrightnessFromClip converts a percentage to a Philips Hue
+// brightness
+func philipsBrightnessFromClip(pct float64) int {
+	return 1 + int(math.Round(pct*253/100))
+}
+
+// clipArchetype turns a room class into a v2 archetype, like living_room
+func clipArchetype(c roomClass) string {
+	return strings.Replace(strings.ToLower(string(c)), " ", "_", -1)
+}
+
+// clipResources returns every resource of the bridge in the CLIP v2 API.
+// They're built from the same lights, groups and sensors as the v1 API
+func (s *Server) clipResources() []*clipResource {
+	s.config.RLock()
+	bridgeUUID := uuid.MustParse(s.config.uuid)
+	bridgeID := strings.ToLower(s.config.BridgeID)
+	name := s.config.Name
+	tz := s.config.timezone.String()
+	model := s.config.ModelID
+	swVersion := s.config.SWVersion
+	s.config.RUnlock()
+	id := func(rtype, v1 string) string {
+		return clipID(bridgeUUID, rtype, v1)
+	}
+
+	res := []*clipResource{}
+	bridgeDevice := &clipResource{
+		ID:   id(clipDevice, "/config"),
+		Type: clipDevice,
+		ProductData: &clipProductData{
+			ModelID:          model,
+			ManufacturerName: "Signify Netherlands B.V.",
+			ProductName:      "Philips hue",
+			ProductArchetype: "bridge_v2",
+			Certified:        true,
+			SoftwareVersion:  swVersion,
+		},
+		Metadata: &clipMetadata{Name: name, Archetype: "bridge_v2"},
+	}
+	br := &clipResource{
+		ID:       id(clipBridge, "/config"),
+		Type:     clipBridge,
+		Owner:    &clipRef{RID: bridgeDevice.ID, RType: clipDevice},
+		BridgeID: bridgeID,
+		TimeZone: &clipTimeZone{TimeZone: tz},
+	}
+	bridgeDevice.Services = []clipRef{br.ref()}
+	res = append(res, bridgeDevice, br)
+
+	ls := s.getAllLights()
+	lightIDs := make([]string, 0, len(ls))
+	for lid := range ls {
+		lightIDs = append(lightIDs, lid)
+	}
+	sort.Strings(lightIDs)
+	devices := map[string]clipRef{}
+	anyOn := false
+	for _, lid := range lightIDs {
+		l := ls[lid]
+		v1 := fmt.Sprintf("/lights/%s", lid)
+		archetype := "classicbulb"
+		if l.Config != nil && l.Config.Archetype != "" {
+			archetype = l.Config.Archetype
+		}
+		dev := &clipResource{
+			ID:   id(clipDevice, v1),
+			IDv1: v1,
+			Type: clipDevice,
+			ProductData: &clipProductData{
+				ModelID:          string(l.Model),
+				ManufacturerName: l.ManufacturerName,
+				ProductName:      string(l.ProductName),
+				ProductArchetype: archetype,
+				Certified:        true,
+				SoftwareVersion:  l.SWVersion,
+			},
+			Metadata: &clipMetadata{Name: l.Name, Archetype: archetype},
+		}
+		cl := clipLightResource(l, id(clipLight, v1), v1, dev.ref())
+		dev.Services = []clipRef{cl.ref()}
+		devices[lid] = dev.ref()
+		anyOn = anyOn || l.State.On
+		res = append(res, dev, cl)
+	}
+
+	grps := s.createGroups()
+	groupIDs := make([]string, 0, len(grps))
+	for gid := range grps {
+		groupIDs = append(groupIDs, gid)
+	}
+	sort.Strings(groupIDs)
+	rooms := []clipRef{}
+	for _, gid := range groupIDs {
+		g := grps[gid]
+		rtype := ""
+		switch g.Type {
+		case roomGroup:
+			rtype = clipRoom
+		case lightGroup:
+			rtype = clipZone
+		default:
+			continue
+		}
+		v1 := fmt.Sprintf("/groups/%s", gid)
+		grp := &clipResource{
+			ID:       id(rtype, v1),
+			IDv1:     v1,
+			Type:     rtype,
+			Metadata: &clipMetadata{Name: g.Name, Archetype: clipArchetype(g.Class)},
+			Children: []clipRef{},
+		}
+		for _, lid := range g.Lights {
+			// Rooms hold devices, zones hold lights
+			if rtype == clipRoom {
+				grp.Children = append(grp.Children, devices[lid])
+			} else {
+				grp.Children = append(grp.Children, clipRef{RID: id(clipLight, fmt.Sprintf("/lights/%s", lid)), RType: clipLight})
+			}
+		}
+		gl := &clipResource{
+			ID:      id(clipGroupedLight, v1),
+			IDv1:    v1,
+			Type:    clipGroupedLight,
+			Owner:   &clipRef{RID: grp.ID, RType: rtype},
+			On:      &clipOn{On: g.State.AnyOn},
+			Dimming: &clipDimming{Brightness: clipBrightness(g.Action.Brightness)},
+		}
+		grp.Services = []clipRef{gl.ref()}
+		if rtype == clipRoom {
+			rooms = append(rooms, grp.ref())
+		}
+		res = append(res, grp, gl)
+	}
+
+	home := &clipResource{
+		ID:       id(clipBridgeHome, "/groups/0"),
+		IDv1:     "/groups/0",
+		Type:     clipBridgeHome,
+		Children: rooms,
+	}
+	homeLight := &clipResource{
+		ID:    id(clipGroupedLight, "/groups/0"),
+		IDv1:  "/groups/0",
+		Type:  clipGroupedLight,
+		Owner: &clipRef{RID: home.ID, RType: clipBridgeHome},
+		On:    &clipOn{On: anyOn},
+	}
+	home.Services = []clipRef{homeLight.ref()}
+	res = append(res, home, homeLight)
+
+	sens := s.createSensors()
+	sensorIDs := make([]string, 0, len(sens))
+	for sid := range sens {
+		sensorIDs = append(sensorIDs, sid)
+	}
+	sort.Strings(sensorIDs)
+	for _, sid := range sensorIDs {
+		sen := sens[sid]
+		rtype, ok := clipSensorTypes[sen.Type]
+		if !ok {
+			continue
+		}
+		v1 := fmt.Sprintf("/sensors/%s", sid)
+		dev := &clipResource{
+			ID:   id(clipDevice, v1),
+			IDv1: v1,
+			Type: clipDevice,
+			ProductData: &clipProductData{
+				ModelID:          sen.ModelID,
+				ManufacturerName: sen.ManufacturerName,
+				ProductName:      sen.Name,
+				ProductArchetype: "unknown_archetype",
+				Certified:        true,
+			},
+			Metadata: &clipMetadata{Name: sen.Name, Archetype: "unknown_archetype"},
+		}
+		if sen.SWVersion != nil {
+			dev.ProductData.SoftwareVersion = *sen.SWVersion
+		}
+		cs := &clipResource{
+			ID:      id(rtype, v1),
+			IDv1:    v1,
+			Type:    rtype,
+			Owner:   &clipRef{RID: dev.ID, RType: clipDevice},
+			Enabled: BoolPtr(sen.Config.On),
+		}
+		switch rtype {
+		case clipMotion:
+			cs.Motion = &clipMotionValue{MotionValid: sen.State.Presence != nil}
+			if sen.State.Presence != nil {
+				cs.Motion.Motion = *sen.State.Presence
+			}
+		case clipTemperature:
+			cs.Temperature = &clipTemperatureValue{TemperatureValid: sen.State.Temperature != nil}
+			if sen.State.Temperature != nil {
+				cs.Temperature.Temperature = float64(*sen.State.Temperature) / 100
+			}
+		case clipButton:
+			cs.Button = &clipButtonValue{LastEvent: clipButtonEvent(sen.State.ButtonEvent)}
+		}
+		dev.Services = []clipRef{cs.ref()}
+		res = append(res, dev, cs)
+	}
+	return res
+}
+
+// clipLightResource returns the light as a v2 light owned by the device
+func clipLightResource(l *light, id, v1 string, owner clipRef) *clipResource {
+	cl := &clipResource{
+		ID:       id,
+		IDv1:     v1,
+		Type:     clipLight,
+		Owner:    &owner,
+		Metadata: &clipMetadata{Name: l.Name},
+		On:       &clipOn{On: l.State.On},
+		Dimming:  &clipDimming{Brightness: clipBrightness(l.State.Brightness)},
+		Mode:     "normal",
+	}
+	if l.Config != nil {
+		cl.Metadata.Archetype = l.Config.Archetype
+	}
+	if l.Capabilities == nil || l.Capabilities.Control == nil {
+		return cl
+	}
+	ctrl := l.Capabilities.Control
+	minDim := float64(ctrl.MinDimLevel) / 100
+	cl.Dimming.MinDimLevel = &minDim
+	if l.Type == rgbType {
+		cl.Color = &clipColor{GamutType: string(ctrl.ColorGamutType)}
+		if len(l.State.XY) == 2 {
+			cl.Color.XY = clipXY{X: l.State.XY[0], Y: l.State.XY[1]}
+		}
+		if len(ctrl.ColorGamut) == 3 {
+			cl.Color.Gamut = &clipGamut{
+				Red:   clipXY{X: ctrl.ColorGamut[0][0], Y: ctrl.ColorGamut[0][1]},
+				Green: clipXY{X: ctrl.ColorGamut[1][0], Y: ctrl.ColorGamut[1][1]},
+				Blue:  clipXY{X: ctrl.ColorGamut[2][0], Y: ctrl.ColorGamut[2][1]},
+			}
+		}
+	}
+	if ctrl.MiredColorTemp != nil {
+		cl.ColorTemperature = &clipColorTemperature{
+			MirekSchema: clipMirekSchema{
+				Minimum: ctrl.MiredColorTemp.Min,
+				Maximum: ctrl.MiredColorTemp.Max,
+			},
+		}
+		if l.State.MiredColorTemp != 0 {
+			cl.ColorTemperature.Mirek = IntPtr(l.State.MiredColorTemp)
+			cl.ColorTemperature.MirekValid = true
+		}
+	}
+	return cl
+}
+
+// clipButtonEvent turns a v1 button event, like 1002, into a v2 event
+func clipButtonEvent(ev *int) string {
+	if ev == nil {
+		return ""
+	}
+	switch *ev % 1000 {
+	case 0:
+		return "initial_press"
+	case 1:
+		return "repeat"
+	case 2:
+		return "short_release"
+	case 3:
+		return "long_release"
+	}
+	return ""
+}
+
+// visibleClipResource returns whether the scope allows the user to see the
+// resource, which depends on the v1 light or group it represents. The home
+// and its grouped light cover every light so limited users never see them
+func visibleClipResource(sc *scope, res *clipResource) bool {
+	if res.IDv1 == "/groups/0" {
+		return !sc.limited()
+	}
+	parts := strings.Split(strings.TrimPrefix(res.IDv1, "/"), "/")
+	if len(parts) != 2 {
+		return true
+	}
+	switch parts[0] {
+	case "lights":
+		return sc.allowsLight(parts[1])
+	case "groups":
+		return sc.allowsGroup(parts[1])
+	}
+	return true
+}
+
+// AuthenticateClip is Authenticate for the CLIP v2 API, which has the
+// username in the hue-application-key header
+func (s *Server) AuthenticateClip(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		userID := r.Header.Get(clipKeyHeader)
+
+		s.config.RLock()
+		auth := s.config.authDisabled
+		wt := *s.config.Whitelist
+		entry, known := wt[userID]
+		s.config.RUnlock()
+		if known && userID != "" {
+			auth = true
+			s.usage.touch(userID, now())
+		}
+
+		ctx = context.WithValue(ctx, AuthenticatedCtxKey, auth)
+		ctx = context.WithValue(ctx, ScopeCtxKey, entry.Scope)
+		r = r.WithContext(ctx)
+
+		if !auth {
+			renderClip(w, r, http.StatusForbidden, []interface{}{}, "unauthorized user")
+			return
+		}
+		// Limited scopes are enforced by only finding the resources the
+		// user can see
+		if entry.Scope.readOnly() && r.Method != http.MethodGet {
+			renderClip(w, r, http.StatusForbidden, []interface{}{},
+				fmt.Sprintf("method, %s, not allowed", r.Method))
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// clipRoutes mounts the CLIP v2 API
+func (s *Server) clipRoutes(r chi.Router) {
+	r.Use(s.AuthenticateClip)
+	r.Get("/resource", s.getClipResources)
+	r.Get("/resource/{rtype}", s.getClipResources)
+	r.Get("/resource/{rtype}/{rid}", s.getClipResource)
+	r.Put("/resource/light/{rid}", s.updateClipLight)
+	r.Put("/resource/{rtype}/{rid}", s.clipMethodNotAllowed)
+}
+
+// filteredClipResources returns the resources of the type the user can
+// see, or every type if rtype is empty
+func (s *Server) filteredClipResources(r *http.Request, rtype string) []*clipResource {
+	sc := scopeFromRequest(r)
+	res := []*clipResource{}
+	for _, cr := range s.clipResources() {
+		if rtype != "" && cr.Type != rtype {
+			continue
+		}
+		if visibleClipResource(sc, cr) {
+			res = append(res, cr)
+		}
+	}
+	return res
+}
+
+func (s *Server) getClipResources(w http.ResponseWriter, r *http.Request) {
+	rtype := chi.RouteContext(r.Context()).URLParam("rtype")
+	if rtype != "" && !contains(clipTypes, rtype) {
+		renderClip(w, r, http.StatusNotFound, []interface{}{},
+			fmt.Sprintf("Not Found: resource type %s", rtype))
+		return
+	}
+	renderClip(w, r, http.StatusOK, s.filteredClipResources(r, rtype))
+}
+
+// clipResource returns the resource of the type with the ID, if the user
+// can see it
+func (s *Server) clipResource(r *http.Request, rtype, rid string) *clipResource {
+	for _, cr := range s.filteredClipResources(r, rtype) {
+		if cr.ID == rid {
+			return cr
+		}
+	}
+	return nil
+}
+
+func (s *Server) getClipResource(w http.ResponseWriter, r *http.Request) {
+	rtype := chi.RouteContext(r.Context()).URLParam("rtype")
+	rid := chi.RouteContext(r.Context()).URLParam("rid")
+	cr := s.clipResource(r, rtype, rid)
+	if cr == nil {
+		renderClip(w, r, http.StatusNotFound, []interface{}{},
+			"Not Found: resource not found")
+		return
+	}
+	renderClip(w, r, http.StatusOK, []*clipResource{cr})
+}
+
+func (s *Server) clipMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	renderClip(w, r, http.StatusMethodNotAllowed, []interface{}{},
+		fmt.Sprintf("method, %s, not allowed for resource", r.Method))
+}
+
+type clipLightUpdate struct {
+	On *struct {
+		On *bool `json:"on"`
+	} `json:"on"`
+	Dimming *struct {
+		Brightness *float64 `json:"brightness"`
+	} `json:"dimming"`
+	Color *struct {
+		XY *clipXY `json:"xy"`
+	} `json:"color"`
+	ColorTemperature *struct {
+		Mirek *int `json:"mirek"`
+	} `json:"color_temperature"`
+}
+
+// clipParams maps v1 light state parameters to their v2 property
+var clipParams = map[string]string{
+	"on":  "on",
+	"bri": "dimming",
+	"xy":  "color",
+	"ct":  "color_temperature",
+}
+
+// lightStateUpdate converts the update to a v1 light state update, or
+// returns a description of the first invalid value
+func (upd *clipLightUpdate) lightStateUpdate() (*lightStateUpdate, string) {
+	state := &lightStateUpdate{}
+	if upd.On != nil && upd.On.On != nil {
+		state.On = upd.On.On
+	}
+	if upd.Dimming != nil && upd.Dimming.Brightness != nil {
+		b := *upd.Dimming.Brightness
+		if b < 0 || b > 100 {
+			return nil, "dimming.brightness must be between 0 and 100"
+		}
+		state.Brightness = IntPtr(philipsBrightnessFromClip(b))
+	}
+	if upd.Color != nil && upd.Color.XY != nil {
+		xy := *upd.Color.XY
+		if xy.X < 0 || xy.X > 1 || xy.Y < 0 || xy.Y > 1 {
+			return nil, "color.xy must be between 0 and 1"
+		}
+		state.XY = FloatPtr([]float64{xy.X, xy.Y})
+	}
+	if upd.ColorTemperature != nil && upd.ColorTemperature.Mirek != nil {
+		m := *upd.ColorTemperature.Mirek
+		if m < 153 || m > 500 {
+			return nil, "color_temperature.mirek must be between 153 and 500"
+		}
+		state.ColorTemperature = IntPtr(m)
+	}
+	return state, ""
+}
+
+func (s *Server) updateClipLight(w http.ResponseWriter, r *http.Request) {
+	rid := chi.RouteContext(r.Context()).URLParam("rid")
+	cr := s.clipResource(r, clipLight, rid)
+	if cr == nil {
+		renderClip(w, r, http.StatusNotFound, []interface{}{},
+			"Not Found: resource not found")
+		return
+	}
+	lightID := strings.TrimPrefix(cr.IDv1, "/lights/")
+	l := s.getLight(lightID)
+	if l == nil {
+		renderClip(w, r, http.StatusNotFound, []interface{}{},
+			"Not Found: resource not found")
+		return
+	}
+
+	upd := &clipLightUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(upd); err != nil {
+		renderClip(w, r, http.StatusBadRequest, []interface{}{},
+			"Bad Request: invalid JSON")
+		return
+	}
+	state, invalid := upd.lightStateUpdate()
+	if invalid != "" {
+		renderClip(w, r, http.StatusBadRequest, []interface{}{}, invalid)
+		return
+	}
+
+	if errs := clipUpdateErrors(s.updateLightState(l, state)); len(errs) > 0 {
+		renderClip(w, r, http.StatusBadRequest, []interface{}{}, errs...)
+		return
+	}
+	renderClip(w, r, http.StatusOK, []clipRef{cr.ref()})
+}
+
+// clipUpdateErrors describes what went wrong when updating the state of a
+// light, in terms of the v2 properties
+func clipUpdateErrors(res *lightUpdateStateResult) []string {
+	errs := []string{}
+	for _, p := range res.InvalidParameter {
+		errs = append(errs, fmt.Sprintf("device (light) does not support %s", clipParams[p]))
+	}
+	for _, p := range res.DeviceUnreachable {
+		errs = append(errs, fmt.Sprintf("device (light) is unreachable, can't set %s", clipParams[p]))
+	}
+	for _, p := range res.DeviceIsOff {
+		errs = append(errs, fmt.Sprintf("device (light) is off, can't set %s", clipParams[p]))
+	}
+	for p, v := range res.InvalidValue {
+		errs = append(errs, fmt.Sprintf("invalid value, %v, for %s", v, clipParams[p]))
+	}
+	if res.InternalError {
+		errs = append(errs, "Internal server error")
+	}
+	sort.Strings(errs)
+	return errs
+}
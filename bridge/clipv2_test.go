@@ -0,0 +1,190 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"lib.hemtjan.st/testutils"
+)
+
+type clipTestResponse struct {
+	Errors []clipError     `json:"errors"`
+	Data   []*clipResource `json:"data"`
+}
+
+// clipReq makes a request to the CLIP v2 API of the bridge as the user
+func clipReq(t *testing.T, s *Server, user, method, endpoint string, body []byte) (int, *clipTestResponse) {
+	t.Helper()
+	hc := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	req, err := http.NewRequest(method,
+		fmt.Sprintf("https://%s:%d/clip/v2%s", testingHost, s.config.tlsPort, endpoint),
+		bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	req.Header.Set(clipKeyHeader, user)
+	resp, err := hc.Do(req)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	dec := &clipTestResponse{}
+	if err := json.Unmarshal(b, dec); err != nil {
+		t.Fatalf("%s: %s", err, b)
+	}
+	return resp.StatusCode, dec
+}
+
+func TestClipLight(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	b, shutdown := NewTestingBridge(t, nil)
+	defer cancel()
+	defer shutdown(ctx)
+
+	clf, m := NewTestingTransport(t, nil)
+	defer clf()
+	cleanup, err := testutils.DevicesFromJSON("./testing_data/light-rgb.json", m)
+	assert.NoError(t, err)
+	defer cleanup()
+	b.mqtt.WaitForDevice(ctx, "test/light3")
+
+	username := registerTestingUser(t, b)
+	lightID := TopicToStrInt("test/light3")
+	rid := clipID(uuid.MustParse(b.config.uuid), clipLight, "/lights/"+lightID)
+
+	t.Run("unauthorized", func(t *testing.T) {
+		st, resp := clipReq(t, b, "nope", http.MethodGet, "/resource", nil)
+		assert.Equal(t, http.StatusForbidden, st)
+		assert.Len(t, resp.Errors, 1)
+	})
+	t.Run("get", func(t *testing.T) {
+		st, resp := clipReq(t, b, username, http.MethodGet, "/resource/light/"+rid, nil)
+		assert.Equal(t, http.StatusOK, st)
+		if assert.Len(t, resp.Data, 1) {
+			l := resp.Data[0]
+			assert.Equal(t, "/lights/"+lightID, l.IDv1)
+			assert.NotNil(t, l.Color)
+			assert.Nil(t, l.ColorTemperature)
+			if assert.NotNil(t, l.Owner) {
+				assert.Equal(t, clipDevice, l.Owner.RType)
+			}
+		}
+
+		st, _ = clipReq(t, b, username, http.MethodGet, "/resource/scene", nil)
+		assert.Equal(t, http.StatusNotFound, st)
+	})
+	t.Run("put", func(t *testing.T) {
+		st, resp := clipReq(t, b, username, http.MethodPut, "/resource/light/"+rid,
+			[]byte(`{"on": {"on": true}, "dimming": {"brightness": 100}}`))
+		assert.Equal(t, http.StatusOK, st)
+		assert.Empty(t, resp.Errors)
+		if assert.Len(t, resp.Data, 1) {
+			assert.Equal(t, rid, resp.Data[0].ID)
+		}
+
+		st, resp = clipReq(t, b, username, http.MethodPut, "/resource/light/"+rid,
+			[]byte(`{"color_temperature": {"mirek": 300}}`))
+		assert.Equal(t, http.StatusBadRequest, st)
+		assert.Equal(t, []clipError{{"device (light) does not support color_temperature"}}, resp.Errors)
+	})
+}
+
+func TestClipID(t *testing.T) {
+	bridge := uuid.MustParse("2f402f80-da50-11e1-9b23-001788102201")
+	id := clipID(bridge, clipLight, "/lights/1")
+	assert.Equal(t, id, clipID(bridge, clipLight, "/lights/1"))
+	assert.NotEqual(t, id, clipID(bridge, clipDevice, "/lights/1"))
+	assert.NotEqual(t, id, clipID(bridge, clipLight, "/lights/2"))
+	assert.NotEqual(t, id, clipID(uuid.New(), clipLight, "/lights/1"))
+}
+
+func TestClipLightUpdate(t *testing.T) {
+	upd := &clipLightUpdate{}
+	assert.NoError(t, json.Unmarshal([]byte(
+		`{"on": {"on": false}, "dimming": {"brightness": 50}, "color": {"xy": {"x": 0.3, "y": 0.4}}}`), upd))
+	state, invalid := upd.lightStateUpdate()
+	assert.Empty(t, invalid)
+	assert.Equal(t, BoolPtr(false), state.On)
+	assert.Equal(t, IntPtr(128), state.Brightness)
+	assert.Equal(t, FloatPtr([]float64{0.3, 0.4}), state.XY)
+	assert.Nil(t, state.ColorTemperature)
+	assert.Equal(t, 50.2, clipBrightness(128))
+
+	for _, body := range []string{
+		`{"dimming": {"brightness": 101}}`,
+		`{"color": {"xy": {"x": 1.2, "y": 0}}}`,
+		`{"color_temperature": {"mirek": 100}}`,
+	} {
+		upd := &clipLightUpdate{}
+		assert.NoError(t, json.Unmarshal([]byte(body), upd))
+		_, invalid := upd.lightStateUpdate()
+		assert.NotEmpty(t, invalid, body)
+	}
+}
+
+func TestVisibleClipResource(t *testing.T) {
+	home := &clipResource{Type: clipBridgeHome, IDv1: "/groups/0"}
+	homeLight := &clipResource{Type: clipGroupedLight, IDv1: "/groups/0"}
+	room := &clipResource{Type: clipRoom, IDv1: "/groups/1"}
+	light := &clipResource{Type: clipLight, IDv1: "/lights/1"}
+	sensor := &clipResource{Type: clipMotion, IDv1: "/sensors/2"}
+
+	for _, sc := range []*scope{nil, {Access: AccessReadOnly}} {
+		for _, res := range []*clipResource{home, homeLight, room, light, sensor} {
+			assert.True(t, visibleClipResource(sc, res), res.Type)
+		}
+	}
+
+	limited := &scope{Lights: []string{"1"}, Groups: []string{"0", "1"}}
+	assert.False(t, visibleClipResource(limited, home), "the home covers every light")
+	assert.False(t, visibleClipResource(limited, homeLight))
+	assert.True(t, visibleClipResource(limited, room))
+	assert.True(t, visibleClipResource(limited, light))
+	assert.False(t, visibleClipResource(limited, &clipResource{Type: clipLight, IDv1: "/lights/2"}))
+	assert.True(t, visibleClipResource(limited, sensor))
+}
+
+func TestAuthenticateClip(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Whitelist = &map[string]whitelist{
+		"full":     {Name: "full"},
+		"readonly": {Name: "readonly", Scope: &scope{Access: AccessReadOnly}},
+	}
+	r := chi.NewRouter()
+	r.With(s.AuthenticateClip).HandleFunc("/clip/v2/resource", func(w http.ResponseWriter, r *http.Request) {
+		renderClip(w, r, http.StatusOK, []interface{}{})
+	})
+	code := func(method, user string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/clip/v2/resource", nil)
+		req.Header.Set(clipKeyHeader, user)
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, code(http.MethodPut, "full"))
+	assert.Equal(t, http.StatusOK, code(http.MethodGet, "readonly"))
+	assert.Equal(t, http.StatusForbidden, code(http.MethodPut, "readonly"))
+	assert.Equal(t, http.StatusForbidden, code(http.MethodGet, "nope"))
+	assert.Equal(t, http.StatusForbidden, code(http.MethodGet, ""))
+}
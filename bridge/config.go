@@ -20,6 +20,20 @@ const uuidPrefix = "2f402f80-da50-11e1-9b23"
 
 var now = time.Now
 
+// HTTPAPIMode determines how much of the Hue REST API is served over
+// plain HTTP
+type HTTPAPIMode string
+
+const (
+	// HTTPAPIFull serves the full API over plain HTTP
+	HTTPAPIFull HTTPAPIMode = "full"
+	// HTTPAPIReadOnly serves the API over plain HTTP but only allows
+	// requests that don't change anything, and registration
+	HTTPAPIReadOnly HTTPAPIMode = "read-only"
+	// HTTPAPIOff only serves what's needed for discovery over plain HTTP
+	HTTPAPIOff HTTPAPIMode = "off"
+)
+
 // Config represent bridge configuration
 type Config struct {
 	Name             string                `json:"name"`
@@ -35,19 +49,46 @@ type Config struct {
 	advertiseIP net.IP
 	uuid        string
 	strippedMAC string
+	// adoptedMAC is the MAC taken over from a backup of another bridge,
+	// it's persisted with the settings and replaces the configured MAC
+	adoptedMAC MACAddr
 
 	address             string
 	authDisabled        bool
+	alexa               bool
+	idMapPath           string
+	adminAddress        string
+	deconzAddress       string
+	deconzPort          uint16
+	lifxAddress         string
+	upstreamAddress     string
+	upstreamUsername    string
+	linkButtonDevice    string
+	linkButtonUntil     time.Time
+	reportDeviceInfo    bool
 	port                uint16
 	tlsAddress          string
+	httpAPIMode         HTTPAPIMode
+	httpAPIRoutes       []string
 	tlsPort             uint16
 	tlsPubKey           string
 	tlsPrivKey          string
+	streamingAddress    string
+	streamingRate       int
 	timezone            *time.Location
 	whitelistConfigPath string
+	settingsPath        string
+	entertainmentPath   string
+	whitelistExpiry     time.Duration
+	store               Store
+	lightProfilesPath   string
+	calibrationPath     string
 
-	lights int
-	groups int
+	lightProfiles map[string]lightBulbModel
+	calibrations  map[string]*calibration
+
+	gracePeriod          time.Duration
+	upstreamPollInterval time.Duration
 
 	latitude  float64
 	longitude float64
@@ -122,6 +163,120 @@ func DisableAuthentication(b bool) ConfigOption {
 	}
 }
 
+// CalibrationPath sets the path from where the per-light brightness curves
+// and colour offsets will be loaded
+func CalibrationPath(a string) ConfigOption {
+	return func(args *Config) error {
+		args.calibrationPath = a
+		return nil
+	}
+}
+
+// ReportDeviceInfo reports the manufacturer, model and serial number
+// devices announced on Hemtjänst instead of impersonating Philips hardware.
+// Lights will also get a Hue-format unique ID instead of their topic.
+func ReportDeviceInfo(b bool) ConfigOption {
+	return func(args *Config) error {
+		args.reportDeviceInfo = b
+		return nil
+	}
+}
+
+// GracePeriod sets how long a light that left or can no longer be read is
+// reported as unreachable before it's removed from the bridge
+func GracePeriod(d time.Duration) ConfigOption {
+	return func(args *Config) error {
+		if d < 0 {
+			return fmt.Errorf("grace period can't be negative, got %s", d)
+		}
+		args.gracePeriod = d
+		return nil
+	}
+}
+
+// AdminAddress sets the address:port the admin API will listen on. The
+// admin API isn't authenticated so it should only be reachable from the
+// host the bridge runs on. It's disabled if empty
+func AdminAddress(a string) ConfigOption {
+	return func(args *Config) error {
+		args.adminAddress = a
+		return nil
+	}
+}
+
+// DeconzAddress sets the address:port the deCONZ compatible REST API and
+// websocket listen on. It's disabled if empty
+func DeconzAddress(a string) ConfigOption {
+	return func(args *Config) error {
+		args.deconzAddress = a
+		return nil
+	}
+}
+
+// LIFXAddress sets the address:port the LIFX LAN server listens on. LIFX
+// clients only look for devices on port 56700. It's disabled if empty
+func LIFXAddress(a string) ConfigOption {
+	return func(args *Config) error {
+		args.lifxAddress = a
+		return nil
+	}
+}
+
+// UpstreamBridge sets the address of a real Hue bridge, and the username
+// registered on it, whose lights and sensors are imported. It's disabled
+// if the address is empty
+func UpstreamBridge(address, username string) ConfigOption {
+	return func(args *Config) error {
+		if address != "" && username == "" {
+			return fmt.Errorf("must give a username for the upstream bridge at %s", address)
+		}
+		args.upstreamAddress = address
+		args.upstreamUsername = username
+		return nil
+	}
+}
+
+// UpstreamPollInterval sets how often the upstream bridge is polled for
+// changes
+func UpstreamPollInterval(d time.Duration) ConfigOption {
+	return func(args *Config) error {
+		if d <= 0 {
+			return fmt.Errorf("upstream poll interval must be positive, got %s", d)
+		}
+		args.upstreamPollInterval = d
+		return nil
+	}
+}
+
+// LinkButtonDevice sets the topic of a Hemtjänst button that presses the
+// link button when it's pushed
+func LinkButtonDevice(topic string) ConfigOption {
+	return func(args *Config) error {
+		args.linkButtonDevice = topic
+		return nil
+	}
+}
+
+// AlexaCompatibility makes the bridge usable by the Amazon Echo. SSDP
+// searches are answered with the headers the Echo looks for, lights get
+// small sequential IDs, Hue-format unique IDs and names the Alexa app
+// accepts, and voice commands over plain HTTP are handled leniently.
+func AlexaCompatibility(b bool) ConfigOption {
+	return func(args *Config) error {
+		args.alexa = b
+		return nil
+	}
+}
+
+// IDMapPath sets the path from where the sequential light IDs used in
+// Alexa compatibility mode will be loaded and saved to
+func IDMapPath(a string) ConfigOption {
+	return func(args *Config) error {
+		args.idMapPath = a
+		return nil
+	}
+}
+
 // MAC configures the MAC address of the bridge
 func MAC(m string) ConfigOption {
 	return func(args *Config) error {
@@ -168,6 +323,40 @@ func Timezone(t string) ConfigOption {
 	}
 }
 
+// HTTPAPI sets how much of the API is served over plain HTTP
+func HTTPAPI(m string) ConfigOption {
+	return func(args *Config) error {
+		switch mode := HTTPAPIMode(m); mode {
+		case HTTPAPIFull, HTTPAPIReadOnly, HTTPAPIOff:
+			args.httpAPIMode = mode
+		default:
+			return fmt.Errorf("unknown HTTP API mode %s, must be one of %s, %s or %s",
+				m, HTTPAPIFull, HTTPAPIReadOnly, HTTPAPIOff)
+		}
+		return nil
+	}
+}
+
+// HTTPAPIRoutes restricts the API served over plain HTTP to the resources
+// starting with one of the routes, like /lights or /groups. Registration and
+// the bridge configuration are always available
+func HTTPAPIRoutes(routes ...string) ConfigOption {
+	return func(args *Config) error {
+		args.httpAPIRoutes = nil
+		for _, r := range routes {
+			r = strings.TrimSpace(r)
+			if r == "" {
+				continue
+			}
+			if !strings.HasPrefix(r, "/") {
+				r = "/" + r
+			}
+			args.httpAPIRoutes = append(args.httpAPIRoutes, r)
+		}
+		return nil
+	}
+}
+
 // TLSAddress sets the host:port to bind on for tls/https
 func TLSAddress(a string) ConfigOption {
 	return func(args *Config) error {
@@ -176,6 +365,27 @@ func TLSAddress(a string) ConfigOption {
 	}
 }
 
+// StreamingAddress sets the host:port the Entertainment API streaming
+// server listens on for DTLS. Streaming is disabled if it's empty
+func StreamingAddress(a string) ConfigOption {
+	return func(args *Config) error {
+		args.streamingAddress = a
+		return nil
+	}
+}
+
+// StreamingRate sets how many times a second streamed colours are forwarded
+// to the lights
+func StreamingRate(hz int) ConfigOption {
+	return func(args *Config) error {
+		if hz < 1 || hz > maxStreamingRate {
+			return fmt.Errorf("streaming rate must be between 1 and %d, got %d", maxStreamingRate, hz)
+		}
+		args.streamingRate = hz
+		return nil
+	}
+}
+
 // TLSPublicKeyPath sets the path to the TLS public key
 func TLSPublicKeyPath(a string) ConfigOption {
 	return func(args *Config) error {
@@ -201,6 +411,54 @@ func WhitelistConfigPath(a string) ConfigOption {
 	}
 }
 
+// EntertainmentPath sets the path the entertainment groups are stored at
+func EntertainmentPath(a string) ConfigOption {
+	return func(args *Config) error {
+		args.entertainmentPath = a
+		return nil
+	}
+}
+
+// SettingsPath sets the path the settings changed through the API, like the
+// name and timezone, will be loaded from and saved to. Stored settings take
+// precedence over the options
+func SettingsPath(a string) ConfigOption {
+	return func(args *Config) error {
+		args.settingsPath = a
+		return nil
+	}
+}
+
+// Storage sets the Store the bridge persists its objects, like the
+// whitelist, in. It defaults to files relative to the working directory
+func Storage(st Store) ConfigOption {
+	return func(args *Config) error {
+		args.store = st
+		return nil
+	}
+}
+
+// WhitelistExpiry removes whitelist entries that haven't been used for
+// longer than d. Entries never expire if d is 0
+func WhitelistExpiry(d time.Duration) ConfigOption {
+	return func(args *Config) error {
+		if d < 0 {
+			return fmt.Errorf("whitelist expiry can't be negative, got %s", d)
+		}
+		args.whitelistExpiry = d
+		return nil
+	}
+}
+
+// LightProfilesPath sets the path from where the mapping of light topics
+// to the light profile they should impersonate will be loaded
+func LightProfilesPath(a string) ConfigOption {
+	return func(args *Config) error {
+		args.lightProfilesPath = a
+		return nil
+	}
+}
+
 // Latitude configures the latitude of the bridge's location
 // This value is used for the Daylight sensor
 func Latitude(lat float64) ConfigOption {
@@ -231,12 +489,24 @@ func bridgeIDfromMAC(m MACAddr) string {
 	return fmt.Sprintf("%XFFFE%X", []byte(m[:3]), []byte(m[3:]))
 }
 
+// setMAC changes the MAC of the bridge and the IDs derived from it, the
+// caller must hold the lock
+func (c *Config) setMAC(m MACAddr) {
+	_ = MAC(net.HardwareAddr(m).String())(c)
+	c.BridgeID = bridgeIDfromMAC(c.MACAddress)
+}
+
 // NewConfig returns a new bridge configuration with
 // the specified options
 func NewConfig(setters ...ConfigOption) (*Config, error) {
 	c := &Config{
-		ModelID:   bridgeModel,
-		Whitelist: &map[string]whitelist{},
+		ModelID:              bridgeModel,
+		Whitelist:            &map[string]whitelist{},
+		lightProfiles:        map[string]lightBulbModel{},
+		calibrations:         map[string]*calibration{},
+		gracePeriod:          DefaultGracePeriod,
+		streamingRate:        DefaultStreamingRate,
+		upstreamPollInterval: DefaultUpstreamPollInterval,
 	}
 
 	for _, setter := range setters {
@@ -278,6 +548,26 @@ func NewConfig(setters ...ConfigOption) (*Config, error) {
 		_ = TLSAddress("0.0.0.0:0")(c)
 	}
 
+	if strings.HasPrefix(c.streamingAddress, ":") && !strings.HasPrefix(c.streamingAddress, ":::") {
+		_ = StreamingAddress(fmt.Sprintf("0.0.0.0%s", c.streamingAddress))(c)
+	}
+
+	if c.httpAPIMode == "" {
+		_ = HTTPAPI(string(HTTPAPIFull))(c)
+	}
+
+	if c.alexa && c.httpAPIMode == HTTPAPIOff {
+		return nil, fmt.Errorf("Alexa compatibility requires the HTTP API")
+	}
+
+	if c.deconzAddress != "" && c.httpAPIMode == HTTPAPIOff {
+		return nil, fmt.Errorf("the deCONZ API is served over plain HTTP and requires the HTTP API")
+	}
+
+	if c.store == nil {
+		_ = Storage(NewFileStore(""))(c)
+	}
+
 	if c.advertiseIP == nil {
 		_ = AdvertiseIP("127.0.0.1")(c)
 	}
@@ -300,6 +590,30 @@ type whitelist struct {
 	CreatedAt  string `json:"create date"`
 	LastUsedAt string `json:"last use date"`
 	Name       string `json:"name"`
+	// ClientKey is the pre-shared key used for streaming, it's only
+	// persisted and never shown through the API
+	ClientKey string `json:"clientkey,omitempty"`
+	// Scope restricts what the user can do, nil gives full control
+	Scope *scope `json:"scope,omitempty"`
+}
+
+// publicWhitelist returns a copy of the whitelist that's safe to show
+// through the API to the user. The usernames are the API keys, so a user
+// whose scope is restricted only gets to see its own entry
+func publicWhitelist(wt *map[string]whitelist, username string, sc *scope) *map[string]whitelist {
+	if wt == nil {
+		return nil
+	}
+	res := make(map[string]whitelist, len(*wt))
+	for id, entry := range *wt {
+		if (sc.readOnly() || sc.limited()) && id != username {
+			continue
+		}
+		entry.ClientKey = ""
+		entry.Scope = nil
+		res[id] = entry
+	}
+	return &res
 }
 
 type unauthenticatedConfig struct {
@@ -413,7 +727,9 @@ func (*authenticatedConfig) Render(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
-func createAuthenticatedConfig(c *Config) *authenticatedConfig {
+// createAuthenticatedConfig returns the configuration as shown to the
+// user, whose scope limits what's shown of the whitelist
+func createAuthenticatedConfig(c *Config, username string, sc *scope) *authenticatedConfig {
 	t := now()
 	resp := &authenticatedConfig{}
 
@@ -439,7 +755,7 @@ func createAuthenticatedConfig(c *Config) *authenticatedConfig {
 		SWUpdate:     "disconnected",
 	}
 	resp.IPAddress = c.advertiseIP.String()
-	resp.LinkButtonPressed = true
+	resp.LinkButtonPressed = c.linkButtonPressed(t)
 	resp.LocalTime = DateTimeToISO8600(t.In(c.timezone))
 	resp.Netmask = "255.255.255.0"
 	resp.PortalConnection = "disconnected"
@@ -479,7 +795,7 @@ func createAuthenticatedConfig(c *Config) *authenticatedConfig {
 	}
 	resp.Timezone = c.timezone.String()
 	resp.UTC = DateTimeToISO8600(t.UTC())
-	resp.Whitelist = c.Whitelist
+	resp.Whitelist = publicWhitelist(c.Whitelist, username, sc)
 	resp.ZigbeeChannel = 15
 	return resp
 }
@@ -489,5 +805,8 @@ func (s *Server) getAuthenticatedConfig(w http.ResponseWriter, r *http.Request)
 		renderOK(w, r, createUnauthenticatedConfig(s.config))
 		return
 	}
-	renderOK(w, r, createAuthenticatedConfig(s.config))
+	s.config.RLock()
+	config := createAuthenticatedConfig(s.config, infoFromRequest(r).uid, scopeFromRequest(r))
+	s.config.RUnlock()
+	renderOK(w, r, config)
 }
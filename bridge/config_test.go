@@ -41,11 +41,21 @@ func TestNewConfig(t *testing.T) {
 		assert.Equal(t, uint16(0), c.port)
 		assert.Equal(t, "0.0.0.0:0", c.tlsAddress)
 		assert.Equal(t, uint16(0), c.tlsPort)
+		assert.Equal(t, HTTPAPIFull, c.httpAPIMode)
+		assert.Len(t, c.httpAPIRoutes, 0)
 		assert.Equal(t, "", c.tlsPrivKey)
 		assert.Equal(t, "", c.tlsPubKey)
 		assert.Equal(t, "UTC", c.timezone.String())
 		assert.False(t, c.authDisabled)
+		assert.False(t, c.reportDeviceInfo)
+		assert.False(t, c.alexa)
+		assert.Equal(t, "", c.idMapPath)
+		assert.Equal(t, DefaultGracePeriod, c.gracePeriod)
+		assert.Equal(t, "", c.upstreamAddress)
+		assert.Equal(t, DefaultUpstreamPollInterval, c.upstreamPollInterval)
 		assert.Equal(t, "", c.whitelistConfigPath)
+		assert.Equal(t, "", c.lightProfilesPath)
+		assert.Equal(t, "", c.calibrationPath)
 		assert.Equal(t, 0.0, c.latitude)
 		assert.Equal(t, 0.0, c.longitude)
 	})
@@ -127,6 +137,100 @@ func TestNewConfig(t *testing.T) {
 			assert.Equal(t, "0.0.0.0:8080", c.address)
 		})
 	})
+	t.Run("HTTPAPI", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()), HTTPAPI("read-only"))
+			if !assert.Nil(t, err) {
+				t.FailNow()
+			}
+			assert.Equal(t, HTTPAPIReadOnly, c.httpAPIMode)
+		})
+		t.Run("invalid", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()), HTTPAPI("some"))
+			assert.NotNil(t, err)
+			assert.Nil(t, c)
+		})
+		t.Run("routes", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()), HTTPAPIRoutes("lights", "", "/groups"))
+			if !assert.Nil(t, err) {
+				t.FailNow()
+			}
+			assert.Equal(t, []string{"/lights", "/groups"}, c.httpAPIRoutes)
+		})
+	})
+	t.Run("AlexaCompatibility", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()), AlexaCompatibility(true), IDMapPath("idmap.json"))
+			if !assert.Nil(t, err) {
+				t.FailNow()
+			}
+			assert.True(t, c.alexa)
+			assert.Equal(t, "idmap.json", c.idMapPath)
+		})
+		t.Run("without HTTP API", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()), AlexaCompatibility(true), HTTPAPI("off"))
+			assert.NotNil(t, err)
+			assert.Nil(t, c)
+		})
+	})
+	t.Run("DeconzAddress", func(t *testing.T) {
+		c, err := NewConfig(Name(t.Name()), DeconzAddress("127.0.0.1:8088"), HTTPAPI("read-only"))
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, "127.0.0.1:8088", c.deconzAddress)
+
+		c, err = NewConfig(Name(t.Name()), DeconzAddress("127.0.0.1:8088"), HTTPAPI("off"))
+		assert.NotNil(t, err)
+		assert.Nil(t, c)
+	})
+	t.Run("WhitelistExpiry", func(t *testing.T) {
+		c, err := NewConfig(Name(t.Name()), WhitelistExpiry(time.Hour))
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, time.Hour, c.whitelistExpiry)
+
+		c, err = NewConfig(Name(t.Name()), WhitelistExpiry(-time.Hour))
+		assert.NotNil(t, err)
+		assert.Nil(t, c)
+	})
+	t.Run("GracePeriod", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()), GracePeriod(time.Minute))
+			if !assert.Nil(t, err) {
+				t.FailNow()
+			}
+			assert.Equal(t, time.Minute, c.gracePeriod)
+		})
+		t.Run("negative", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()), GracePeriod(-time.Minute))
+			assert.NotNil(t, err)
+			assert.Nil(t, c)
+		})
+	})
+	t.Run("UpstreamBridge", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()),
+				UpstreamBridge("192.168.1.2", "abc"), UpstreamPollInterval(time.Minute))
+			if !assert.Nil(t, err) {
+				t.FailNow()
+			}
+			assert.Equal(t, "192.168.1.2", c.upstreamAddress)
+			assert.Equal(t, "abc", c.upstreamUsername)
+			assert.Equal(t, time.Minute, c.upstreamPollInterval)
+		})
+		t.Run("no username", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()), UpstreamBridge("192.168.1.2", ""))
+			assert.NotNil(t, err)
+			assert.Nil(t, c)
+		})
+		t.Run("no interval", func(t *testing.T) {
+			c, err := NewConfig(Name(t.Name()), UpstreamPollInterval(0))
+			assert.NotNil(t, err)
+			assert.Nil(t, c)
+		})
+	})
 	t.Run("Timezone", func(t *testing.T) {
 		t.Run("Europe/Amsterdam", func(t *testing.T) {
 			c, err := NewConfig(Name(t.Name()), Timezone("Europe/Amsterdam"))
@@ -355,7 +459,7 @@ func TestAuthenticatedConfig(t *testing.T) {
 			t.FailNow()
 		}
 
-		authed := createAuthenticatedConfig(c)
+		authed := createAuthenticatedConfig(c, "", nil)
 
 		assert.Equal(c.Name, authed.Name)
 		assert.Equal(c.APIVersion, authed.APIVersion)
@@ -379,7 +483,7 @@ func TestAuthenticatedConfig(t *testing.T) {
 			SWUpdate:     "disconnected",
 		}, authed.InternetServices)
 		assert.Equal(c.advertiseIP.String(), authed.IPAddress)
-		assert.True(authed.LinkButtonPressed)
+		assert.False(authed.LinkButtonPressed)
 		assert.Equal(DateTimeToISO8600(now().UTC()), authed.LocalTime)
 		assert.Equal("255.255.255.0", authed.Netmask)
 		assert.Equal("disconnected", authed.PortalConnection)
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/lucasb-eyer/go-colorful"
+	"lib.hemtjan.st/server"
 )
 
 // DateTimeToISO8600 formats a time.Time as ISO 8601:2004
@@ -24,6 +25,11 @@ func DateTimeToISO8600(t time.Time) string {
 	)
 }
 
+// ISO8600ToDateTime parses a time formatted by DateTimeToISO8600 as UTC
+func ISO8600ToDateTime(s string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02T15:04:05", s, time.UTC)
+}
+
 // Brightness ensures the value is always between 1-254
 func Brightness(bri uint8) uint8 {
 	return uint8(math.Min(math.Max(1, float64(bri)), 254))
@@ -73,16 +79,127 @@ func StringToUint16(s string) (uint16, error) {
 
 // ToPhilipsBrightness converts between a Hemtjanst Brightness and a Philips Hue brightness
 func ToPhilipsBrightness(i int) int {
-	i = (i * 254) / 100
-	if i == 0 {
-		return 1
-	}
-	return i
+	return brightnessToPhilips(i, defaultBrightnessRange)
 }
 
 // ToHemtjanstBrightness converts brightness to Hemtjanst brightness
 func ToHemtjanstBrightness(i int) int {
-	return (i * 100) / 254
+	return brightnessToHemtjanst(i, defaultBrightnessRange)
+}
+
+// valueRange is the range of values a Hemtjanst feature accepts
+type valueRange struct {
+	Min  int
+	Max  int
+	Step int
+}
+
+// defaultBrightnessRange is used for devices that don't announce the range
+// of their brightness feature
+var defaultBrightnessRange = valueRange{Min: 0, Max: 100, Step: 1}
+
+// philipsBrightnessRange is the range of brightness a Hue light can be set to
+var philipsBrightnessRange = valueRange{Min: 1, Max: 254, Step: 1}
+
+// kelvinThreshold is the value from which we assume a colour temperature
+// is expressed in Kelvin instead of mireds. Nothing emits light at 1000
+// mireds (1000K) so this can't be confused for a real mired value.
+const kelvinThreshold = 1000
+
+// featureRange returns the range announced by a feature, or def if the
+// feature didn't announce one
+func featureRange(ft server.Feature, def valueRange) valueRange {
+	r := valueRange{Min: ft.Min(), Max: ft.Max(), Step: ft.Step()}
+	if r.Max <= r.Min {
+		return def
+	}
+	if r.Step <= 0 {
+		r.Step = 1
+	}
+	return r
+}
+
+// snap rounds the value to the nearest step and clamps it to the range
+func (r valueRange) snap(v int) int {
+	if r.Step > 1 {
+		v = r.Min + ((v-r.Min+r.Step/2)/r.Step)*r.Step
+	}
+	return int(math.Min(math.Max(float64(v), float64(r.Min)), float64(r.Max)))
+}
+
+// contains returns whether the value falls within the range
+func (r valueRange) contains(v int) bool {
+	return v >= r.Min && v <= r.Max
+}
+
+// brightnessToPhilips converts a Hemtjanst brightness within the range to a
+// Philips Hue brightness, between 1-254
+func brightnessToPhilips(i int, r valueRange) int {
+	return philipsBrightnessRange.snap(((i - r.Min) * 254) / (r.Max - r.Min))
+}
+
+// brightnessToHemtjanst converts a Philips Hue brightness to a Hemtjanst
+// brightness within the range
+func brightnessToHemtjanst(i int, r valueRange) int {
+	return r.snap(r.Min + (i*(r.Max-r.Min))/254)
+}
+
+// ctRange is the range of colour temperatures a Hemtjanst device accepts and
+// the unit it expects them in
+type ctRange struct {
+	valueRange
+	kelvin bool
+}
+
+// colorTemperatureRange returns the colour temperature range announced by
+// the feature, or the mired range def if it didn't announce one
+func colorTemperatureRange(ft server.Feature, def *lightMiredColorTemperature) ctRange {
+	r := featureRange(ft, valueRange{Min: def.Min, Max: def.Max, Step: 1})
+	return ctRange{valueRange: r, kelvin: r.Min >= kelvinThreshold}
+}
+
+// mireds returns the range in mireds, as advertised to Hue clients
+func (r ctRange) mireds() *lightMiredColorTemperature {
+	if r.kelvin {
+		return &lightMiredColorTemperature{
+			Min: KelvinToMired(r.Max),
+			Max: KelvinToMired(r.Min),
+		}
+	}
+	return &lightMiredColorTemperature{Min: r.Min, Max: r.Max}
+}
+
+// toPhilips converts a Hemtjanst colour temperature to mireds
+func (r ctRange) toPhilips(v int) int {
+	if r.kelvin {
+		return KelvinToMired(v)
+	}
+	return v
+}
+
+// toHemtjanst converts mireds to a Hemtjanst colour temperature in the
+// device's unit, clamped to its range
+func (r ctRange) toHemtjanst(v int) int {
+	if r.kelvin {
+		return r.snap(MiredToKelvin(v))
+	}
+	return r.snap(v)
+}
+
+// KelvinToMired converts a colour temperature in Kelvin to mireds
+func KelvinToMired(k int) int {
+	if k <= 0 {
+		return 0
+	}
+	return int(math.Round(1000000 / float64(k)))
+}
+
+// MiredToKelvin converts a colour temperature in mireds to Kelvin
+func MiredToKelvin(m int) int {
+	if m <= 0 {
+		return 0
+	}
+	return int(math.Round(1000000 / float64(m)))
 }
 
 // HemtjanstHStoCIExy takes a hue/saturation and turns it into CIE xy coordinates
@@ -111,6 +228,14 @@ func TopicToStrInt(topic string) string {
 	)
 }
 
+// HueUniqueID turns an identifier into a stable Hue-format unique ID. Real
+// Hue lights use their Zigbee MAC followed by an endpoint, we use the Philips
+// OUI and derive the remainder from a hash of the identifier.
+func HueUniqueID(id string) string {
+	sum := sha1.Sum([]byte(id))
+	return fmt.Sprintf("00:17:88:01:%02x:%02x:%02x:%02x-0b", sum[0], sum[1], sum[2], sum[3])
+}
+
 // BoolToStr takes a boolean and returns on/off
 func BoolToStr(b bool) string {
 	if b {
@@ -0,0 +1,73 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrightnessConversion(t *testing.T) {
+	t.Run("default range", func(t *testing.T) {
+		assert.Equal(t, 1, ToPhilipsBrightness(0))
+		assert.Equal(t, 12, ToPhilipsBrightness(5))
+		assert.Equal(t, 254, ToPhilipsBrightness(100))
+		assert.Equal(t, 0, ToHemtjanstBrightness(1))
+		assert.Equal(t, 100, ToHemtjanstBrightness(254))
+	})
+	t.Run("announced range", func(t *testing.T) {
+		r := valueRange{Min: 0, Max: 255, Step: 1}
+		assert.Equal(t, 254, brightnessToPhilips(255, r))
+		assert.Equal(t, 127, brightnessToPhilips(128, r))
+		assert.Equal(t, 255, brightnessToHemtjanst(254, r))
+		assert.Equal(t, 127, brightnessToHemtjanst(127, r))
+	})
+	t.Run("stepped range", func(t *testing.T) {
+		r := valueRange{Min: 10, Max: 100, Step: 10}
+		assert.Equal(t, 10, brightnessToHemtjanst(1, r))
+		assert.Equal(t, 60, brightnessToHemtjanst(127, r))
+		assert.Equal(t, 100, brightnessToHemtjanst(254, r))
+		assert.Equal(t, 1, brightnessToPhilips(10, r))
+		assert.Equal(t, 254, brightnessToPhilips(100, r))
+	})
+}
+
+func TestColorTemperatureConversion(t *testing.T) {
+	t.Run("mireds", func(t *testing.T) {
+		r := ctRange{valueRange: valueRange{Min: 140, Max: 500, Step: 1}}
+		assert.Equal(t, &lightMiredColorTemperature{Min: 140, Max: 500}, r.mireds())
+		assert.Equal(t, 300, r.toPhilips(300))
+		assert.Equal(t, 300, r.toHemtjanst(300))
+		assert.Equal(t, 140, r.toHemtjanst(100))
+		assert.Equal(t, 500, r.toHemtjanst(600))
+	})
+	t.Run("kelvin", func(t *testing.T) {
+		r := ctRange{valueRange: valueRange{Min: 2200, Max: 6500, Step: 100}, kelvin: true}
+		assert.Equal(t, &lightMiredColorTemperature{Min: 154, Max: 455}, r.mireds())
+		assert.Equal(t, 370, r.toPhilips(2700))
+		assert.Equal(t, 2700, r.toHemtjanst(370))
+		assert.Equal(t, 2200, r.toHemtjanst(500))
+		assert.Equal(t, 6500, r.toHemtjanst(100))
+	})
+	t.Run("unit conversion", func(t *testing.T) {
+		assert.Equal(t, 250, KelvinToMired(4000))
+		assert.Equal(t, 4000, MiredToKelvin(250))
+		assert.Equal(t, 0, KelvinToMired(0))
+		assert.Equal(t, 0, MiredToKelvin(0))
+	})
+}
+
+func TestInvalidValues(t *testing.T) {
+	l := &light{
+		Capabilities: &lightCapabilities{
+			Control: &lightControl{
+				MiredColorTemp: &lightMiredColorTemperature{Min: 153, Max: 454},
+			},
+		},
+	}
+	assert.Len(t, l.invalidValues(&lightStateUpdate{Brightness: IntPtr(254)}), 0)
+	assert.Len(t, l.invalidValues(&lightStateUpdate{ColorTemperature: IntPtr(153)}), 0)
+	assert.Len(t, l.invalidValues(&lightStateUpdate{ColorTemperatureInc: IntPtr(-1000)}), 0)
+	assert.Equal(t,
+		map[string]interface{}{"bri": 255, "ct": 500},
+		l.invalidValues(&lightStateUpdate{Brightness: IntPtr(255), ColorTemperature: IntPtr(500)}))
+}
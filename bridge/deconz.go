@@ -0,0 +1,595 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// deconzModelID is what a deCONZ gateway reports as its model
+	deconzModelID = "deCONZ"
+	// deconzAPIVersion is the version of the deCONZ REST API that's
+	// imitated
+	deconzAPIVersion = "1.16.0"
+	// deconzBufferSize is how many events can be waiting for a websocket
+	// client before it's disconnected
+	deconzBufferSize = 64
+	// deconzWriteTimeout is how long writing an event to a websocket
+	// client may take
+	deconzWriteTimeout = 10 * time.Second
+)
+
+type deconzLightState struct {
+	On         bool      `json:"on"`
+	Brightness int       `json:"bri"`
+	XY         []float64 `json:"xy,omitempty"`
+	CT         *int      `json:"ct,omitempty"`
+	ColorMode  string    `json:"colormode,omitempty"`
+	Alert      string    `json:"alert"`
+	Effect     string    `json:"effect,omitempty"`
+	Reachable  bool      `json:"reachable"`
+}
+
+type deconzLight struct {
+	ETag             string           `json:"etag"`
+	HasColor         bool             `json:"hascolor"`
+	CTMin            int              `json:"ctmin,omitempty"`
+	CTMax            int              `json:"ctmax,omitempty"`
+	ManufacturerName string           `json:"manufacturername"`
+	ModelID          string           `json:"modelid"`
+	Name             string           `json:"name"`
+	State            deconzLightState `json:"state"`
+	SWVersion        string           `json:"swversion"`
+	Type             string           `json:"type"`
+	UniqueID         string           `json:"uniqueid"`
+}
+
+type deconzSensor struct {
+	Config           sensorConfig `json:"config"`
+	EP               int          `json:"ep"`
+	ETag             string       `json:"etag"`
+	ManufacturerName string       `json:"manufacturername"`
+	ModelID          string       `json:"modelid"`
+	Name             string       `json:"name"`
+	State            sensorState  `json:"state"`
+	SWVersion        string       `json:"swversion"`
+	Type             string       `json:"type"`
+	UniqueID         string       `json:"uniqueid"`
+}
+
+type deconzGroup struct {
+	Action           deconzLightState `json:"action"`
+	DeviceMembership []string         `json:"devicemembership"`
+	ETag             string           `json:"etag"`
+	Hidden           bool             `json:"hidden"`
+	ID               string           `json:"id"`
+	Lights           []string         `json:"lights"`
+	LightSequence    []string         `json:"lightsequence"`
+	MultiDeviceIDs   []string         `json:"multideviceids"`
+	Name             string           `json:"name"`
+	Scenes           []string         `json:"scenes"`
+	State            groupState       `json:"state"`
+	Type             string           `json:"type"`
+}
+
+type deconzConfig struct {
+	APIVersion         string                `json:"apiversion"`
+	BridgeID           string                `json:"bridgeid"`
+	DatastoreVersion   string                `json:"datastoreversion"`
+	DeviceName         string                `json:"devicename"`
+	IPAddress          string                `json:"ipaddress,omitempty"`
+	MACAddress         MACAddr               `json:"mac"`
+	ModelID            string                `json:"modelid"`
+	Name               string                `json:"name"`
+	SWVersion          string                `json:"swversion"`
+	Timezone           string                `json:"timezone,omitempty"`
+	UUID               string                `json:"uuid,omitempty"`
+	WebsocketNotifyAll bool                  `json:"websocketnotifyall"`
+	WebsocketPort      uint16                `json:"websocketport,omitempty"`
+	Whitelist          *map[string]whitelist `json:"whitelist,omitempty"`
+	ZigbeeChannel      int                   `json:"zigbeechannel,omitempty"`
+}
+
+// deconzEvent is an event sent to websocket clients
+type deconzEvent struct {
+	Type     string      `json:"t"`
+	Event    string      `json:"e"`
+	Resource string      `json:"r"`
+	ID       string      `json:"id"`
+	UniqueID string      `json:"uniqueid,omitempty"`
+	State    interface{} `json:"state"`
+}
+
+func (*deconzLight) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (*deconzSensor) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (*deconzGroup) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (*deconzConfig) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+type deconzMap map[string]interface{}
+
+func (deconzMap) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// deconzETag returns an etag for the value, which changes whenever it does
+func deconzETag(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", md5.Sum(b))
+}
+
+// deconzSensorUniqueID returns a unique ID for a sensor, deCONZ clients
+// expect every sensor to have one
+func deconzSensorUniqueID(id string) string {
+	return fmt.Sprintf("fargton-sensor-%s", id)
+}
+
+func toDeconzLightState(st lightState) deconzLightState {
+	res := deconzLightState{
+		On:         st.On,
+		Brightness: st.Brightness,
+		XY:         st.XY,
+		ColorMode:  st.ColorMode,
+		Alert:      st.Alert,
+		Effect:     st.Effect,
+		Reachable:  st.Reachable,
+	}
+	if st.MiredColorTemp != 0 {
+		res.CT = IntPtr(st.MiredColorTemp)
+	}
+	return res
+}
+
+func toDeconzLight(l *light) *deconzLight {
+	res := &deconzLight{
+		HasColor:         l.Type == rgbType,
+		ManufacturerName: l.ManufacturerName,
+		ModelID:          string(l.Model),
+		Name:             l.Name,
+		State:            toDeconzLightState(l.State),
+		SWVersion:        l.SWVersion,
+		Type:             string(l.Type),
+		UniqueID:         l.UUID,
+	}
+	if l.Capabilities != nil && l.Capabilities.Control != nil && l.Capabilities.Control.MiredColorTemp != nil {
+		res.CTMin = l.Capabilities.Control.MiredColorTemp.Min
+		res.CTMax = l.Capabilities.Control.MiredColorTemp.Max
+	}
+	res.ETag = deconzETag(res)
+	return res
+}
+
+func toDeconzSensor(id string, sen sensor) *deconzSensor {
+	res := &deconzSensor{
+		Config:           sen.Config,
+		ManufacturerName: sen.ManufacturerName,
+		ModelID:          sen.ModelID,
+		Name:             sen.Name,
+		State:            sen.State,
+		Type:             sen.Type,
+		UniqueID:         deconzSensorUniqueID(id),
+	}
+	if sen.SWVersion != nil {
+		res.SWVersion = *sen.SWVersion
+	}
+	res.ETag = deconzETag(res)
+	return res
+}
+
+func toDeconzGroup(id string, g *group) *deconzGroup {
+	res := &deconzGroup{
+		Action:           toDeconzLightState(g.Action),
+		DeviceMembership: []string{},
+		ID:               id,
+		Lights:           g.Lights,
+		LightSequence:    []string{},
+		MultiDeviceIDs:   []string{},
+		Name:             g.Name,
+		Scenes:           []string{},
+		State:            g.State,
+		Type:             string(g.Type),
+	}
+	if res.Lights == nil {
+		res.Lights = []string{}
+	}
+	res.ETag = deconzETag(res)
+	return res
+}
+
+// createDeconzConfig returns the configuration as deCONZ reports it. Like
+// the Hue API only the username's own whitelist entry is included if its
+// scope is restricted
+func createDeconzConfig(c *Config, authenticated bool, username string, sc *scope) *deconzConfig {
+	resp := &deconzConfig{
+		APIVersion:         deconzAPIVersion,
+		BridgeID:           c.BridgeID,
+		DatastoreVersion:   c.DatastoreVersion,
+		DeviceName:         "Färgton",
+		MACAddress:         c.MACAddress,
+		ModelID:            deconzModelID,
+		Name:               c.Name,
+		SWVersion:          c.SWVersion,
+		WebsocketNotifyAll: true,
+	}
+	if !authenticated {
+		return resp
+	}
+	resp.IPAddress = c.advertiseIP.String()
+	resp.Timezone = c.timezone.String()
+	resp.UUID = c.uuid
+	resp.WebsocketPort = c.deconzPort
+	resp.Whitelist = publicWhitelist(c.Whitelist, username, sc)
+	resp.ZigbeeChannel = 15
+	return resp
+}
+
+// newDeconzRouter returns the router for the deCONZ REST API. It takes the
+// same users and the same requests to change the state of lights and groups
+// as the Hue API, but describes lights, sensors and groups the way deCONZ
+// does. Websocket clients connect to /. It's served over plain HTTP, so
+// the restrictions configured for the HTTP API apply
+func (s *Server) newDeconzRouter() *chi.Mux {
+	r := chi.NewRouter()
+	r.MethodNotAllowed(s.methodNotAllowed)
+	r.NotFound(s.resourceNotFound)
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RealIP)
+	r.Use(Logger(s.logger))
+	r.Use(middleware.Recoverer)
+	r.Get("/", s.deconzWebsocket)
+	r.Route("/api", func(r chi.Router) {
+		r.Use(render.SetContentType(render.ContentTypeJSON))
+		r.Post("/", s.registerUser)
+		r.Route("/{userID}", func(r chi.Router) {
+			r.Use(s.Authenticate)
+			r.Use(s.EnforceScope)
+			r.Use(s.RestrictHTTP)
+			r.Get("/config", s.getDeconzConfig)
+			r.Get("/lights", s.getDeconzLights)
+			r.Get("/lights/{lightID}", s.getDeconzLight)
+			r.Put("/lights/{lightID}/state", s.lightUpdateState)
+			r.Get("/sensors", s.getDeconzSensors)
+			r.Get("/sensors/{sensorID}", s.getDeconzSensor)
+			r.Get("/groups", s.getDeconzGroups)
+			r.Get("/groups/{groupID}", s.getDeconzGroup)
+			r.Put("/groups/{groupID}/action", s.groupUpdateState)
+		})
+	})
+	return r
+}
+
+func (s *Server) getDeconzConfig(w http.ResponseWriter, r *http.Request) {
+	authenticated := r.Context().Value(AuthenticatedCtxKey).(bool)
+	s.config.RLock()
+	config := createDeconzConfig(s.config, authenticated, infoFromRequest(r).uid, scopeFromRequest(r))
+	s.config.RUnlock()
+	renderOK(w, r, config)
+}
+
+func (s *Server) getDeconzLights(w http.ResponseWriter, r *http.Request) {
+	res := deconzMap{}
+	for id, l := range scopeFromRequest(r).filterLights(s.getAllLights()) {
+		res[id] = toDeconzLight(l)
+	}
+	renderOK(w, r, res)
+}
+
+func (s *Server) getDeconzLight(w http.ResponseWriter, r *http.Request) {
+	lightID := chi.RouteContext(r.Context()).URLParam("lightID")
+	l := s.getLight(lightID)
+	if l == nil {
+		renderListOK(w, r, errInvalidResource(r))
+		return
+	}
+	renderOK(w, r, toDeconzLight(l))
+}
+
+func (s *Server) getDeconzSensors(w http.ResponseWriter, r *http.Request) {
+	res := deconzMap{}
+	for id, sen := range s.createSensors() {
+		res[id] = toDeconzSensor(id, sen)
+	}
+	renderOK(w, r, res)
+}
+
+func (s *Server) getDeconzSensor(w http.ResponseWriter, r *http.Request) {
+	sensorID := chi.RouteContext(r.Context()).URLParam("sensorID")
+	sen, ok := s.createSensors()[sensorID]
+	if !ok {
+		renderListOK(w, r, errInvalidResource(r))
+		return
+	}
+	renderOK(w, r, toDeconzSensor(sensorID, sen))
+}
+
+func (s *Server) getDeconzGroups(w http.ResponseWriter, r *http.Request) {
+	res := deconzMap{}
+	for id, g := range scopeFromRequest(r).filterGroups(s.createGroups()) {
+		res[id] = toDeconzGroup(id, g)
+	}
+	renderOK(w, r, res)
+}
+
+func (s *Server) getDeconzGroup(w http.ResponseWriter, r *http.Request) {
+	groupID := chi.RouteContext(r.Context()).URLParam("groupID")
+	g := s.getGroup(groupID)
+	if g == nil {
+		renderListOK(w, r, errInvalidResource(r))
+		return
+	}
+	renderOK(w, r, toDeconzGroup(groupID, g))
+}
+
+// deconzHub keeps track of the state of lights, groups and sensors as it
+// was last sent, and the websocket clients to send changes to with their
+// user
+type deconzHub struct {
+	clients map[chan []byte]string
+	last    map[string][]byte
+	sync.Mutex
+}
+
+func newDeconzHub() *deconzHub {
+	return &deconzHub{
+		clients: map[chan []byte]string{},
+		last:    map[string][]byte{},
+	}
+}
+
+func (h *deconzHub) subscribe(username string) chan []byte {
+	ch := make(chan []byte, deconzBufferSize)
+	h.Lock()
+	h.clients[ch] = username
+	h.Unlock()
+	return ch
+}
+
+// unsubscribe removes the client and closes its channel, if that hasn't
+// already happened
+func (h *deconzHub) unsubscribe(ch chan []byte) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.clients[ch]; ok {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// close disconnects every client
+func (h *deconzHub) close() {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.clients {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// changed compares the states to how they were last time and returns a
+// changed event for every state that's different. New resources don't get
+// an event
+func (h *deconzHub) changed(events []*deconzEvent) []*deconzEvent {
+	h.Lock()
+	defer h.Unlock()
+
+	res := []*deconzEvent{}
+	current := map[string][]byte{}
+	for _, ev := range events {
+		b, err := json.Marshal(ev.State)
+		if err != nil {
+			continue
+		}
+		key := fmt.Sprintf("/%s/%s", ev.Resource, ev.ID)
+		current[key] = b
+		if prev, ok := h.last[key]; ok && !bytes.Equal(prev, b) {
+			res = append(res, ev)
+		}
+	}
+	h.last = current
+	return res
+}
+
+// visibleDeconzEvent returns whether the scope allows the resource of the
+// event, sensors aren't restricted
+func visibleDeconzEvent(sc *scope, ev *deconzEvent) bool {
+	switch ev.Resource {
+	case "lights":
+		return sc.allowsLight(ev.ID)
+	case "groups":
+		return sc.allowsGroup(ev.ID)
+	}
+	return true
+}
+
+// publish sends the events to every client whose user's current scope
+// allows them. Clients whose user is no longer whitelisted, or whose buffer
+// is full, are disconnected. That's checked even if there are no events
+func (h *deconzHub) publish(events []*deconzEvent, scopes func(string) (*scope, bool)) {
+	h.Lock()
+	defer h.Unlock()
+	current := make(map[chan []byte]*scope, len(h.clients))
+	for ch, username := range h.clients {
+		sc, ok := scopes(username)
+		if !ok {
+			delete(h.clients, ch)
+			close(ch)
+			continue
+		}
+		current[ch] = sc
+	}
+	for _, ev := range events {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		for ch, sc := range current {
+			if _, ok := h.clients[ch]; !ok {
+				continue
+			}
+			if !visibleDeconzEvent(sc, ev) {
+				continue
+			}
+			select {
+			case ch <- b:
+			default:
+				delete(h.clients, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// deconzStates returns a changed event with the current state of every
+// light, group and sensor, in a stable order
+func (s *Server) deconzStates() []*deconzEvent {
+	events := []*deconzEvent{}
+	event := func(resource, id, uniqueID string, state interface{}) {
+		events = append(events, &deconzEvent{
+			Type:     "event",
+			Event:    "changed",
+			Resource: resource,
+			ID:       id,
+			UniqueID: uniqueID,
+			State:    state,
+		})
+	}
+
+	ls := s.getAllLights()
+	ids := make([]string, 0, len(ls))
+	for id := range ls {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		event("lights", id, ls[id].UUID, toDeconzLightState(ls[id].State))
+	}
+
+	grps := s.createGroups()
+	ids = make([]string, 0, len(grps))
+	for id := range grps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		event("groups", id, "", grps[id].State)
+	}
+
+	sens := s.createSensors()
+	ids = make([]string, 0, len(sens))
+	for id := range sens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		event("sensors", id, deconzSensorUniqueID(id), sens[id].State)
+	}
+	return events
+}
+
+var deconzUpgrader = websocket.Upgrader{
+	// deCONZ accepts websocket clients from anywhere
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// deconzWebsocket sends changed events to the client until it disconnects.
+// Unlike deCONZ it takes a whitelisted username, in the apikey query
+// parameter, and only sends events for what its scope allows
+func (s *Server) deconzWebsocket(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("apikey")
+	s.config.RLock()
+	auth := s.config.authDisabled
+	_, known := (*s.config.Whitelist)[userID]
+	s.config.RUnlock()
+	if known && userID != "" {
+		auth = true
+		s.usage.touch(userID, now())
+	}
+	if !auth {
+		renderListOK(w, r, errUnauthorized(r))
+		return
+	}
+
+	conn, err := deconzUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ch := s.deconz.subscribe(userID)
+	defer s.deconz.unsubscribe(ch)
+
+	// Nothing is expected from the client, but reading is what notices
+	// it going away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+					time.Now().Add(deconzWriteTimeout))
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(deconzWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// createDeconzListener listens for the deCONZ REST API and websocket, and
+// records the port so it can be reported as websocketport
+func (s *Server) createDeconzListener() (net.Listener, error) {
+	s.config.RLock()
+	address := s.config.deconzAddress
+	s.config.RUnlock()
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	ap := strings.Split(l.Addr().String(), ":")
+	port, _ := strconv.Atoi(ap[len(ap)-1])
+	s.config.Lock()
+	s.config.deconzPort = uint16(port)
+	s.config.Unlock()
+	return l, nil
+}
@@ -0,0 +1,191 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToDeconzLight(t *testing.T) {
+	l := &light{
+		Type:  temperatureType,
+		Name:  "Hallway",
+		Model: temperatureModel,
+		State: lightState{On: true, Brightness: 200, MiredColorTemp: 300, Reachable: true},
+		Capabilities: &lightCapabilities{Control: &lightControl{
+			MiredColorTemp: &lightMiredColorTemperature{Min: 153, Max: 454},
+		}},
+		UUID: "00:17:88:01:00:00:00:01-0b",
+	}
+	d := toDeconzLight(l)
+	assert.False(t, d.HasColor)
+	assert.Equal(t, 153, d.CTMin)
+	assert.Equal(t, 454, d.CTMax)
+	assert.Equal(t, IntPtr(300), d.State.CT)
+	assert.Len(t, d.ETag, 32)
+
+	l.State.Brightness = 100
+	assert.NotEqual(t, d.ETag, toDeconzLight(l).ETag, "the etag should change with the state")
+
+	g := toDeconzGroup("1", &group{Name: "Hallway", Type: roomGroup})
+	assert.Equal(t, []string{}, g.Lights)
+	assert.Equal(t, "1", g.ID)
+}
+
+func TestDeconzConfig(t *testing.T) {
+	c, err := NewConfig(Name(t.Name()))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	c.deconzPort = 8088
+	c.Whitelist = &map[string]whitelist{
+		"full":     {Name: "full"},
+		"readonly": {Name: "readonly", Scope: &scope{Access: AccessReadOnly}},
+	}
+
+	cfg := createDeconzConfig(c, true, "full", nil)
+	assert.Equal(t, deconzModelID, cfg.ModelID)
+	assert.Equal(t, uint16(8088), cfg.WebsocketPort)
+	if assert.NotNil(t, cfg.Whitelist) {
+		assert.Len(t, *cfg.Whitelist, 2)
+	}
+
+	cfg = createDeconzConfig(c, true, "readonly", (*c.Whitelist)["readonly"].Scope)
+	if assert.NotNil(t, cfg.Whitelist) {
+		assert.Len(t, *cfg.Whitelist, 1)
+		assert.Contains(t, *cfg.Whitelist, "readonly")
+	}
+
+	cfg = createDeconzConfig(c, false, "", nil)
+	assert.Equal(t, uint16(0), cfg.WebsocketPort)
+	assert.Nil(t, cfg.Whitelist)
+}
+
+func TestDeconzHubChanged(t *testing.T) {
+	h := newDeconzHub()
+	off := &deconzEvent{Resource: "lights", ID: "1", State: deconzLightState{}}
+	on := &deconzEvent{Resource: "lights", ID: "1", State: deconzLightState{On: true}}
+	group := &deconzEvent{Resource: "groups", ID: "1", State: groupState{}}
+
+	assert.Empty(t, h.changed([]*deconzEvent{off, group}), "there's nothing to compare to yet")
+	assert.Empty(t, h.changed([]*deconzEvent{off, group}))
+	assert.Equal(t, []*deconzEvent{on}, h.changed([]*deconzEvent{on, group}))
+}
+
+func TestDeconzWebsocket(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Whitelist = &map[string]whitelist{
+		"full":    {Name: "full"},
+		"limited": {Name: "limited", Scope: &scope{Lights: []string{"2"}}},
+	}
+	srv := httptest.NewServer(s.newDeconzRouter())
+	defer srv.Close()
+
+	dial := func(apikey string) (*websocket.Conn, error) {
+		conn, _, err := websocket.DefaultDialer.Dial(
+			"ws"+strings.TrimPrefix(srv.URL, "http")+"/?apikey="+apikey, nil)
+		return conn, err
+	}
+	_, err := dial("")
+	assert.Error(t, err, "the websocket requires a username")
+	_, err = dial("nobody")
+	assert.Error(t, err)
+
+	full, err := dial("full")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer full.Close()
+	limited, err := dial("limited")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer limited.Close()
+
+	for i := 0; i < 50; i++ {
+		s.deconz.Lock()
+		n := len(s.deconz.clients)
+		s.deconz.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	events := []*deconzEvent{{
+		Type: "event", Event: "changed", Resource: "lights", ID: "1",
+		State: deconzLightState{On: true, Brightness: 254},
+	}, {
+		Type: "event", Event: "changed", Resource: "lights", ID: "2",
+		State: deconzLightState{On: true, Brightness: 1},
+	}}
+	s.deconz.publish(events, s.userScope)
+
+	read := func(conn *websocket.Conn) map[string]interface{} {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := conn.ReadMessage()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		ev := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(msg, &ev))
+		return ev
+	}
+	ev := read(full)
+	assert.Equal(t, "event", ev["t"])
+	assert.Equal(t, "changed", ev["e"])
+	assert.Equal(t, "lights", ev["r"])
+	assert.Equal(t, "1", ev["id"])
+	assert.Equal(t, true, ev["state"].(map[string]interface{})["on"])
+	assert.Equal(t, "2", read(full)["id"])
+	assert.Equal(t, "2", read(limited)["id"], "light 1 isn't in the scope")
+
+	s.config.Lock()
+	s.config.Whitelist = &map[string]whitelist{
+		"full": {Name: "full", Scope: &scope{Lights: []string{"1"}}},
+	}
+	s.config.Unlock()
+	s.deconz.publish(events, s.userScope)
+	assert.Equal(t, "1", read(full)["id"], "the scope is looked up again")
+	_ = limited.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = limited.ReadMessage()
+	assert.Error(t, err, "a user that's no longer whitelisted should be disconnected")
+
+	s.deconz.close()
+	_, _, err = full.ReadMessage()
+	assert.Error(t, err, "closing the hub should disconnect the client")
+}
+
+func TestDeconzRestrictHTTP(t *testing.T) {
+	s := newTestServer(t, HTTPAPI("read-only"), HTTPAPIRoutes("/groups"))
+	s.config.Whitelist = &map[string]whitelist{"user": {Name: "user"}}
+	srv := httptest.NewServer(s.newDeconzRouter())
+	defer srv.Close()
+
+	req := func(method, path string) float64 {
+		t.Helper()
+		r, err := http.NewRequest(method, srv.URL+path, strings.NewReader(`{"on": true}`))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer resp.Body.Close()
+		dec := []map[string]map[string]interface{}{}
+		if err := json.NewDecoder(resp.Body).Decode(&dec); err != nil {
+			return 0
+		}
+		return dec[0]["error"]["type"].(float64)
+	}
+	assert.Equal(t, 0.0, req(http.MethodGet, "/api/user/config"))
+	assert.Equal(t, 0.0, req(http.MethodGet, "/api/user/groups"))
+	assert.Equal(t, 3.0, req(http.MethodGet, "/api/user/lights"), "only groups are allowed")
+	assert.Equal(t, 4.0, req(http.MethodPut, "/api/user/groups/1/action"), "the API is read-only")
+}
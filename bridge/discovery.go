@@ -1,9 +1,12 @@
 package bridge
 
 import (
+	"context"
 	"fmt"
+	"html"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/brutella/dnssd"
@@ -11,7 +14,41 @@ import (
 	"go.uber.org/zap"
 )
 
+// announcer tells the discovery responders to announce the bridge again,
+// like after it was renamed
+type announcer struct {
+	subs []chan struct{}
+	sync.Mutex
+}
+
+// subscribe returns a channel that receives when the bridge should be
+// announced again. Announcements are dropped while one is pending
+func (a *announcer) subscribe() <-chan struct{} {
+	a.Lock()
+	defer a.Unlock()
+	ch := make(chan struct{}, 1)
+	a.subs = append(a.subs, ch)
+	return ch
+}
+
+// announce notifies all subscribers, it's safe to call on a nil announcer
+func (a *announcer) announce() {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	for _, ch := range a.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (s *Server) descriptionXML(w http.ResponseWriter, r *http.Request) {
+	s.config.RLock()
+	defer s.config.RUnlock()
 	resp := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" ?>
 <root xmlns="urn:schemas-upnp-org:device-1-0">
 <specVersion>
@@ -21,7 +58,7 @@ func (s *Server) descriptionXML(w http.ResponseWriter, r *http.Request) {
 <URLBase>http://%s:%d/</URLBase>
 <device>
 <deviceType>urn:schemas-upnp-org:device:Basic:1</deviceType>
-<friendlyName>Philips hue (%s)</friendlyName>
+<friendlyName>%s (%s)</friendlyName>
 <manufacturer>Royal Philips Electronics</manufacturer>
 <manufacturerURL>http://www.philips.com</manufacturerURL>
 <modelDescription>Philips hue Personal Wireless Lighting</modelDescription>
@@ -50,7 +87,7 @@ func (s *Server) descriptionXML(w http.ResponseWriter, r *http.Request) {
 </device>
 </root>`,
 		s.config.advertiseIP, s.config.port,
-		s.config.advertiseIP,
+		html.EscapeString(s.config.Name), s.config.advertiseIP,
 		s.config.ModelID,
 		s.config.strippedMAC,
 		s.config.uuid)
@@ -81,28 +118,50 @@ func newMDNSService(c *Config) (dnssd.Service, error) {
 	return service, nil
 }
 
-func newMDNSResponder(c *Config) (dnssd.Responder, error) {
+func newMDNSResponder(c *Config) (dnssd.Responder, dnssd.ServiceHandle, error) {
 	rp, err := dnssd.NewResponder()
 	if err != nil {
-		return rp, err
+		return rp, nil, err
 	}
 	sv, err := newMDNSService(c)
 	if err != nil {
-		return rp, err
+		return rp, nil, err
 	}
 	hdl, err := rp.Add(sv)
 	if err != nil {
-		return rp, err
+		return rp, nil, err
 	}
-	hdl.UpdateText(map[string]string{
+	hdl.UpdateText(mdnsText(c), rp)
+
+	return rp, hdl, nil
+}
+
+func mdnsText(c *Config) map[string]string {
+	return map[string]string{
 		"bridgeid": c.BridgeID,
 		"modelid":  c.ModelID,
-	}, rp)
+	}
+}
 
-	return rp, nil
+// reannounceMDNS announces the service again whenever announce receives,
+// updating the TXT record makes the responder send it out
+func reannounceMDNS(ctx context.Context, c *Config, l *zap.Logger,
+	rp dnssd.Responder, hdl dnssd.ServiceHandle, announce <-chan struct{}) {
+	for {
+		select {
+		case <-announce:
+			c.RLock()
+			text := mdnsText(c)
+			c.RUnlock()
+			hdl.UpdateText(text, rp)
+			l.Info("re-announced mDNS service")
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func newSSDPResponder(c *Config, l *zap.Logger, quit chan bool) {
+func newSSDPResponder(c *Config, l *zap.Logger, quit chan bool, announce <-chan struct{}) {
 	ad1, err := ssdp.Advertise(
 		"upnp:rootdevice",
 		fmt.Sprintf("uuid:%s::upnp:rootdevice", c.uuid),
@@ -142,6 +201,16 @@ func newSSDPResponder(c *Config, l *zap.Logger, quit chan bool) {
 			ad1.Alive()
 			ad2.Alive()
 			ad3.Alive()
+		case <-announce:
+			// Say goodbye first so control points fetch the description
+			// again instead of using what they've cached
+			ad1.Bye()
+			ad2.Bye()
+			ad3.Bye()
+			ad1.Alive()
+			ad2.Alive()
+			ad3.Alive()
+			l.Info("re-announced SSDP/UPnP service")
 		case <-quit:
 			ad1.Bye()
 			ad2.Bye()
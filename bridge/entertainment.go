@@ -0,0 +1,650 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+const entertainmentGroup groupType = "Entertainment"
+
+// firstEntertainmentGroupID is the ID of the first entertainment group. The
+// rooms we create share their ID with their light, so entertainment groups
+// start well above the IDs of lights in Alexa compatibility mode, and skip
+// any ID a light has anyway
+const firstEntertainmentGroupID = 200
+
+// entertainmentClasses are the classes an entertainment group can have
+var entertainmentClasses = []roomClass{tvRoom, otherRoom}
+
+// groupStream is the stream of an entertainment group
+type groupStream struct {
+	ProxyMode string  `json:"proxymode"`
+	ProxyNode string  `json:"proxynode"`
+	Active    bool    `json:"active"`
+	Owner     *string `json:"owner"`
+}
+
+// entertainmentSchema is how entertainment groups are stored. There are no
+// groups from before they were versioned
+var entertainmentSchema = &schema{
+	Version: 1,
+	Migrations: []migration{
+		func(data json.RawMessage) (json.RawMessage, error) { return data, nil },
+	},
+}
+
+// lightLocation is where a light is relative to the screen, x from left to
+// right, y from the back to the front and z from the floor to the ceiling.
+// Every axis goes from -1 to 1
+type lightLocation [3]float64
+
+// entertainmentArea is a group of lights apps can stream to
+type entertainmentArea struct {
+	Name      string                   `json:"name"`
+	Class     roomClass                `json:"class"`
+	Lights    []string                 `json:"lights"`
+	Locations map[string]lightLocation `json:"locations"`
+
+	// owner is the user streaming to the group, it's empty when nobody is
+	owner string
+}
+
+// clone returns a copy of the area that can be changed without affecting
+// the area
+func (a *entertainmentArea) clone() *entertainmentArea {
+	c := *a
+	c.Lights = append([]string(nil), a.Lights...)
+	c.Locations = make(map[string]lightLocation, len(a.Locations))
+	for id, loc := range a.Locations {
+		c.Locations[id] = loc
+	}
+	return &c
+}
+
+// validate ensures the area could have been created through the API. The
+// lights aren't checked against the lights the bridge knows about, they
+// come and go
+func (a *entertainmentArea) validate() error {
+	if !validGroupName(a.Name) {
+		return fmt.Errorf("invalid name %q", a.Name)
+	}
+	if !validEntertainmentClass(a.Class) {
+		return fmt.Errorf("invalid class %q", a.Class)
+	}
+	if len(a.Lights) == 0 || len(a.Lights) > maxStreamingChannels {
+		return fmt.Errorf("must have between 1 and %d lights, got %d", maxStreamingChannels, len(a.Lights))
+	}
+	seen := map[string]bool{}
+	for _, id := range a.Lights {
+		if seen[id] {
+			return fmt.Errorf("light %s is in the area more than once", id)
+		}
+		seen[id] = true
+	}
+	for id, loc := range a.Locations {
+		if !seen[id] {
+			return fmt.Errorf("location for light %s which isn't in the area", id)
+		}
+		for _, c := range loc {
+			if c < -1 || c > 1 {
+				return fmt.Errorf("invalid location %v for light %s", loc, id)
+			}
+		}
+	}
+	return nil
+}
+
+// setLights replaces the lights of the area. New lights are put in the
+// middle of the room and the locations of removed lights are forgotten
+func (a *entertainmentArea) setLights(ids []string) {
+	a.Lights = append([]string(nil), ids...)
+	locs := make(map[string]lightLocation, len(ids))
+	for _, id := range ids {
+		locs[id] = a.Locations[id]
+	}
+	a.Locations = locs
+}
+
+// storedEntertainmentAreas is how the entertainment groups are persisted,
+// who's streaming isn't
+type storedEntertainmentAreas struct {
+	Areas map[string]*entertainmentArea `json:"areas"`
+	Next  int                           `json:"next"`
+}
+
+// entertainmentAreas are all the entertainment groups. Only one of them can
+// stream at a time
+type entertainmentAreas struct {
+	Areas map[string]*entertainmentArea
+	Next  int
+	sync.Mutex
+}
+
+func newEntertainmentAreas() *entertainmentAreas {
+	return &entertainmentAreas{
+		Areas: map[string]*entertainmentArea{},
+		Next:  firstEntertainmentGroupID,
+	}
+}
+
+// add stores the area under a new ID that isn't taken and returns it, the
+// caller must hold the lock
+func (ea *entertainmentAreas) add(a *entertainmentArea, taken func(id string) bool) string {
+	for taken(IntToStr(ea.Next)) {
+		ea.Next++
+	}
+	id := IntToStr(ea.Next)
+	ea.Next++
+	ea.Areas[id] = a
+	return id
+}
+
+// streaming returns the ID of the area that's streaming and its owner, the
+// caller must hold the lock
+func (ea *entertainmentAreas) streaming() (string, string) {
+	for id, a := range ea.Areas {
+		if a.owner != "" {
+			return id, a.owner
+		}
+	}
+	return "", ""
+}
+
+// loadEntertainment loads the stored entertainment groups
+func (s *Server) loadEntertainment() error {
+	s.config.RLock()
+	path, st := s.config.entertainmentPath, s.config.store
+	s.config.RUnlock()
+	if path == "" {
+		return nil
+	}
+	stored := storedEntertainmentAreas{}
+	err := loadObject(st, path, entertainmentSchema, &stored)
+	if err == errNotStored {
+		s.logger.Info(fmt.Sprintf("entertainment groups do not exist at %s", path))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load entertainment groups from %s: %v", path, err)
+	}
+
+	s.entertainment.Lock()
+	defer s.entertainment.Unlock()
+	s.entertainment.Areas = map[string]*entertainmentArea{}
+	for id, a := range stored.Areas {
+		if a.Locations == nil {
+			a.Locations = map[string]lightLocation{}
+		}
+		s.entertainment.Areas[id] = a
+	}
+	s.entertainment.Next = stored.Next
+	if s.entertainment.Next < firstEntertainmentGroupID {
+		s.entertainment.Next = firstEntertainmentGroupID
+	}
+	for id := range s.entertainment.Areas {
+		s.ids.reserveGroups(id)
+	}
+	s.logger.Info(fmt.Sprintf("entertainment groups loaded from: %s", path))
+	return nil
+}
+
+// saveEntertainment persists the entertainment groups, the caller must hold
+// the lock
+func (s *Server) saveEntertainment() error {
+	s.config.RLock()
+	path, st := s.config.entertainmentPath, s.config.store
+	s.config.RUnlock()
+	if path == "" {
+		s.logger.Debug("no entertainment groups path specified, not persisting to disk")
+		return nil
+	}
+	return writeEntertainment(st, path, s.entertainment)
+}
+
+// writeEntertainment writes the entertainment groups to path, the caller
+// must hold the lock of the groups
+func writeEntertainment(st Store, path string, ea *entertainmentAreas) error {
+	stored := storedEntertainmentAreas{Areas: ea.Areas, Next: ea.Next}
+	if err := saveObject(st, path, entertainmentSchema, stored); err != nil {
+		return fmt.Errorf("failed to write entertainment groups to %s: %v", path, err)
+	}
+	return nil
+}
+
+// group returns the area as a group, ls are the lights the bridge knows
+// about
+func (a *entertainmentArea) group(ls lights) *group {
+	g := &group{
+		Name:      a.Name,
+		Type:      entertainmentGroup,
+		Class:     a.Class,
+		Lights:    []string{},
+		Sensors:   []string{},
+		State:     groupState{AllOn: true},
+		Locations: map[string]lightLocation{},
+		Stream: &groupStream{
+			ProxyMode: "auto",
+			ProxyNode: "/bridge",
+			Active:    a.owner != "",
+		},
+	}
+	if a.owner != "" {
+		g.Stream.Owner = StrPtr(a.owner)
+	}
+	for _, id := range a.Lights {
+		l, ok := ls[id]
+		if !ok {
+			continue
+		}
+		g.Lights = append(g.Lights, id)
+		g.Locations[id] = a.Locations[id]
+		g.State.AnyOn = g.State.AnyOn || l.State.On
+		g.State.AllOn = g.State.AllOn && l.State.On
+		if len(g.Lights) == 1 {
+			g.Action = l.State
+		}
+	}
+	if len(g.Lights) == 0 {
+		g.State.AllOn = false
+	}
+	return g
+}
+
+// canStream returns whether the light can be part of an entertainment group
+func canStream(l *light) bool {
+	return l.Capabilities != nil && l.Capabilities.Streaming != nil && l.Capabilities.Streaming.Renderer
+}
+
+// lightStreamingFor returns the streaming capabilities of a light of the
+// type. Like on a real bridge only colour lights can join entertainment
+// groups
+func lightStreamingFor(t lightBulbType) *lightStreaming {
+	colour := t == rgbType
+	return &lightStreaming{Renderer: colour, Proxy: colour}
+}
+
+type createGroupReq struct {
+	Name      *string              `json:"name"`
+	Type      *string              `json:"type"`
+	Class     *string              `json:"class"`
+	Lights    []string             `json:"lights"`
+	Locations map[string][]float64 `json:"locations"`
+}
+
+func (req *createGroupReq) Bind(r *http.Request) error {
+	if req.Type == nil || req.Lights == nil {
+		return errParamMissing
+	}
+	return nil
+}
+
+type createGroupSuccess struct {
+	ID string `json:"id"`
+}
+
+type createGroupResp struct {
+	Success createGroupSuccess `json:"success"`
+}
+
+func (*createGroupResp) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// createGroup creates an entertainment group. Rooms are created for every
+// light so they can't be created through the API
+func (s *Server) createGroup(w http.ResponseWriter, r *http.Request) {
+	data := &createGroupReq{}
+	if err := render.Bind(r, data); err != nil {
+		if err == errParamMissing {
+			renderListOK(w, r, errMissingParameter(r))
+			return
+		}
+		renderListOK(w, r, errInvalidJSON())
+		return
+	}
+	if groupType(*data.Type) != entertainmentGroup {
+		renderListOK(w, r, errInvalidValueforParam("/groups", "type", *data.Type))
+		return
+	}
+	class := tvRoom
+	if data.Class != nil {
+		class = roomClass(*data.Class)
+		if !validEntertainmentClass(class) {
+			renderListOK(w, r, errInvalidValueforParam("/groups", "class", *data.Class))
+			return
+		}
+	}
+	if data.Name != nil && !validGroupName(*data.Name) {
+		renderListOK(w, r, errInvalidValueforParam("/groups", "name", *data.Name))
+		return
+	}
+	ls := s.getAllLightsFromMQTT()
+	if errs := validEntertainmentLights("/groups", data.Lights, ls); len(errs) > 0 {
+		renderListOK(w, r, errs...)
+		return
+	}
+	area := &entertainmentArea{Class: class, Locations: map[string]lightLocation{}}
+	area.setLights(data.Lights)
+	if errs := validLocations("/groups", data.Locations, area); len(errs) > 0 {
+		renderListOK(w, r, errs...)
+		return
+	}
+	for id, v := range data.Locations {
+		area.Locations[id] = toLightLocation(v)
+	}
+	grps := s.createGroups()
+	if len(grps) >= maxGroups {
+		renderListOK(w, r, errGroupTableFull(r))
+		return
+	}
+
+	s.entertainment.Lock()
+	defer s.entertainment.Unlock()
+	next := s.entertainment.Next
+	id := s.entertainment.add(area, func(id string) bool {
+		_, room := grps[id]
+		return room || s.ids.taken(id)
+	})
+	s.ids.reserveGroups(id)
+	area.Name = fmt.Sprintf("Entertainment area %s", id)
+	if data.Name != nil {
+		area.Name = *data.Name
+	}
+	if err := s.saveEntertainment(); err != nil {
+		s.logger.Error(err.Error())
+		delete(s.entertainment.Areas, id)
+		s.entertainment.Next = next
+		renderListOK(w, r, errInternalError(infoFromRequest(r).resource, "100"))
+		return
+	}
+	renderListOK(w, r, &createGroupResp{Success: createGroupSuccess{ID: id}})
+}
+
+func validEntertainmentClass(c roomClass) bool {
+	for _, ec := range entertainmentClasses {
+		if c == ec {
+			return true
+		}
+	}
+	return false
+}
+
+// validGroupName returns whether n can be used as the name of a group, the
+// Hue API allows 1 to 32 characters
+func validGroupName(n string) bool {
+	l := utf8.RuneCountInString(n)
+	return l >= 1 && l <= 32
+}
+
+// validEntertainmentLights returns what's wrong with the lights of an
+// entertainment group, a stream has maxStreamingChannels channels
+func validEntertainmentLights(resource string, ids []string, ls lights) []render.Renderer {
+	errs := []render.Renderer{}
+	if len(ids) == 0 || len(ids) > maxStreamingChannels {
+		return append(errs, errInvalidValueforParam(resource, "lights", fmt.Sprint(ids)))
+	}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		l, ok := ls[id]
+		if !ok || seen[id] || !canStream(l) {
+			errs = append(errs, errInvalidValueforParam(resource, "lights", id))
+		}
+		seen[id] = true
+	}
+	return errs
+}
+
+// validLocations returns what's wrong with the locations of lights of the
+// area. Locations are x, y and optionally z, each from -1 to 1
+func validLocations(resource string, locs map[string][]float64, a *entertainmentArea) []render.Renderer {
+	ids := make([]string, 0, len(locs))
+	for id := range locs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	errs := []render.Renderer{}
+	for _, id := range ids {
+		param := fmt.Sprintf("locations/%s", id)
+		if _, ok := a.Locations[id]; !ok {
+			errs = append(errs, errParameterUnavailable(resource, param))
+			continue
+		}
+		v := locs[id]
+		valid := len(v) == 2 || len(v) == 3
+		for _, c := range v {
+			valid = valid && c >= -1 && c <= 1
+		}
+		if !valid {
+			errs = append(errs, errInvalidValueforParam(resource, param, fmt.Sprint(v)))
+		}
+	}
+	return errs
+}
+
+// toLightLocation converts a validated location, z is 0 if it's missing
+func toLightLocation(v []float64) lightLocation {
+	loc := lightLocation{}
+	copy(loc[:], v)
+	return loc
+}
+
+// entertainmentGroups returns the entertainment groups, ls are the lights
+// the bridge knows about
+func (s *Server) entertainmentGroups(ls lights) groups {
+	s.entertainment.Lock()
+	defer s.entertainment.Unlock()
+	grps := groups{}
+	for id, a := range s.entertainment.Areas {
+		grps[id] = a.group(ls)
+	}
+	return grps
+}
+
+type groupStreamReq struct {
+	Active *bool `json:"active"`
+}
+
+type entertainmentUpdateReq struct {
+	Name      *string              `json:"name"`
+	Class     *string              `json:"class"`
+	Lights    []string             `json:"lights"`
+	Locations map[string][]float64 `json:"locations"`
+	Stream    *groupStreamReq      `json:"stream"`
+}
+
+func (req *entertainmentUpdateReq) Bind(r *http.Request) error {
+	return nil
+}
+
+// updateEntertainmentGroup changes the group and starts or stops streaming
+// to it. The group is only changed if everything in the request is valid
+func (s *Server) updateEntertainmentGroup(w http.ResponseWriter, r *http.Request, id string) {
+	data := &entertainmentUpdateReq{}
+	if err := render.Bind(r, data); err != nil {
+		renderListOK(w, r, errInvalidJSON())
+		return
+	}
+	resource := fmt.Sprintf("/groups/%s", id)
+
+	var ls lights
+	if data.Lights != nil {
+		ls = s.getAllLightsFromMQTT()
+	}
+
+	s.entertainment.Lock()
+	old, ok := s.entertainment.Areas[id]
+	if !ok {
+		s.entertainment.Unlock()
+		renderListOK(w, r, errInvalidResource(r))
+		return
+	}
+	area := old.clone()
+	errs := []render.Renderer{}
+	resp := []render.Renderer{}
+	success := func(param string, v interface{}) {
+		resp = append(resp, &successResp{Success: map[string]interface{}{
+			fmt.Sprintf("%s/%s", resource, param): v,
+		}})
+	}
+	if data.Name != nil {
+		if validGroupName(*data.Name) {
+			area.Name = *data.Name
+			success("name", *data.Name)
+		} else {
+			errs = append(errs, errInvalidValueforParam(resource, "name", *data.Name))
+		}
+	}
+	if data.Class != nil {
+		if validEntertainmentClass(roomClass(*data.Class)) {
+			area.Class = roomClass(*data.Class)
+			success("class", *data.Class)
+		} else {
+			errs = append(errs, errInvalidValueforParam(resource, "class", *data.Class))
+		}
+	}
+	if data.Lights != nil {
+		if lerrs := validEntertainmentLights(resource, data.Lights, ls); len(lerrs) > 0 {
+			errs = append(errs, lerrs...)
+		} else {
+			area.setLights(data.Lights)
+			success("lights", data.Lights)
+		}
+	}
+	if data.Locations != nil {
+		if lerrs := validLocations(resource, data.Locations, area); len(lerrs) > 0 {
+			errs = append(errs, lerrs...)
+		} else {
+			ids := make([]string, 0, len(data.Locations))
+			for lid := range data.Locations {
+				ids = append(ids, lid)
+			}
+			sort.Strings(ids)
+			for _, lid := range ids {
+				area.Locations[lid] = toLightLocation(data.Locations[lid])
+				success(fmt.Sprintf("locations/%s", lid), area.Locations[lid])
+			}
+		}
+	}
+	if len(errs) > 0 {
+		s.entertainment.Unlock()
+		renderListOK(w, r, errs...)
+		return
+	}
+	if len(resp) > 0 {
+		s.entertainment.Areas[id] = area
+		if err := s.saveEntertainment(); err != nil {
+			s.logger.Error(err.Error())
+			s.entertainment.Areas[id] = old
+			s.entertainment.Unlock()
+			renderListOK(w, r, errInternalError(infoFromRequest(r).resource, "100"))
+			return
+		}
+	}
+	s.entertainment.Unlock()
+
+	if data.Stream != nil && data.Stream.Active != nil {
+		resp = append(resp, s.setStreamActive(r, id, *data.Stream.Active))
+	}
+	renderListOK(w, r, resp...)
+}
+
+// deleteGroup deletes an entertainment group, stopping its stream. Rooms
+// exist for as long as their light does so they can't be deleted
+func (s *Server) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	groupID := chi.RouteContext(r.Context()).URLParam("groupID")
+	if s.getGroup(groupID) == nil {
+		renderListOK(w, r, errInvalidResource(r))
+		return
+	}
+
+	s.entertainment.Lock()
+	area, ok := s.entertainment.Areas[groupID]
+	if !ok {
+		s.entertainment.Unlock()
+		renderListOK(w, r, errMethod(r))
+		return
+	}
+	delete(s.entertainment.Areas, groupID)
+	if err := s.saveEntertainment(); err != nil {
+		s.logger.Error(err.Error())
+		s.entertainment.Areas[groupID] = area
+		s.entertainment.Unlock()
+		renderListOK(w, r, errInternalError(infoFromRequest(r).resource, "100"))
+		return
+	}
+	s.entertainment.Unlock()
+
+	if area.owner != "" {
+		s.stream.stop()
+	}
+	renderListOK(w, r, &deleteResp{Success: fmt.Sprintf("/groups/%s deleted.", groupID)})
+}
+
+// setStreamActive starts or stops the stream of the group for the user
+// making the request. Only one group can stream at a time
+func (s *Server) setStreamActive(r *http.Request, id string, active bool) render.Renderer {
+	user := infoFromRequest(r).uid
+	resource := fmt.Sprintf("/groups/%s/stream/active", id)
+
+	s.entertainment.Lock()
+	area, ok := s.entertainment.Areas[id]
+	if !ok {
+		s.entertainment.Unlock()
+		return errInvalidResource(r)
+	}
+	streamingID, owner := s.entertainment.streaming()
+	if active {
+		if streamingID != "" && (streamingID != id || owner != user) {
+			s.entertainment.Unlock()
+			return errStreamOwnership(resource)
+		}
+		area.owner = user
+	} else {
+		area.owner = ""
+	}
+	s.entertainment.Unlock()
+
+	if active {
+		s.logger.Info(fmt.Sprintf("streaming to group %s activated by %s", id, user))
+	} else if streamingID == id {
+		s.stream.stop()
+		s.logger.Info(fmt.Sprintf("streaming to group %s deactivated", id))
+	}
+	return &successResp{Success: map[string]interface{}{resource: active}}
+}
+
+// stopStream deactivates the stream of the group if user still owns it
+func (s *Server) stopStream(id, user string) {
+	s.entertainment.Lock()
+	defer s.entertainment.Unlock()
+	if a, ok := s.entertainment.Areas[id]; ok && a.owner == user {
+		a.owner = ""
+	}
+}
+
+// streamingLights returns the ID of the group that's streaming, its owner
+// and its lights in channel order
+func (s *Server) streamingLights() (string, string, []string) {
+	s.entertainment.Lock()
+	defer s.entertainment.Unlock()
+	id, owner := s.entertainment.streaming()
+	if id == "" {
+		return "", "", nil
+	}
+	return id, owner, append([]string(nil), s.entertainment.Areas[id].Lights...)
+}
+
+func (s *Server) groupIsEntertainment(id string) bool {
+	s.entertainment.Lock()
+	defer s.entertainment.Unlock()
+	_, ok := s.entertainment.Areas[id]
+	return ok
+}
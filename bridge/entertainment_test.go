@@ -0,0 +1,211 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"lib.hemtjan.st/testutils"
+)
+
+func TestEntertainmentGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	b, shutdown := NewTestingBridge(t, nil)
+	defer cancel()
+	defer shutdown(ctx)
+
+	clf, m := NewTestingTransport(t, nil)
+	defer clf()
+	cleanup, err := testutils.DevicesFromJSON("./testing_data/light-rgb.json", m)
+	assert.NoError(t, err)
+	defer cleanup()
+	b.mqtt.WaitForDevice(ctx, "test/light3")
+
+	light := TopicToStrInt("test/light3")
+	username := registerTestingUser(t, b)
+
+	t.Run("invalid", func(t *testing.T) {
+		tests := map[string]string{
+			"type":   `{"type": "LightGroup", "lights": ["%s"]}`,
+			"class":  `{"type": "Entertainment", "class": "Kitchen", "lights": ["%s"]}`,
+			"lights": `{"type": "Entertainment", "class": "TV", "lights": ["%s", "nope"]}`,
+		}
+		for name, body := range tests {
+			body := body
+			t.Run(name, func(t *testing.T) {
+				st, resp := tReq(t, b, http.MethodPost, fmt.Sprintf("/api/%s/groups", username),
+					[]byte(fmt.Sprintf(body, light)))
+				assert.Equal(t, http.StatusOK, st)
+				errDec := []*errorResp{}
+				assert.NoError(t, json.Unmarshal(resp, &errDec))
+				if assert.Len(t, errDec, 1) {
+					assert.Equal(t, 7, errDec[0].Error.Type)
+				}
+			})
+		}
+	})
+
+	st, resp := tReq(t, b, http.MethodPost, fmt.Sprintf("/api/%s/groups", username),
+		[]byte(fmt.Sprintf(`{"name": "TV", "type": "Entertainment", "class": "TV", "lights": ["%s"]}`, light)))
+	assert.Equal(t, http.StatusOK, st)
+	created := []createGroupResp{}
+	assert.NoError(t, json.Unmarshal(resp, &created))
+	if !assert.Len(t, created, 1) {
+		t.FailNow()
+	}
+	id := created[0].Success.ID
+
+	t.Run("get", func(t *testing.T) {
+		st, resp := tReq(t, b, http.MethodGet, fmt.Sprintf("/api/%s/groups/%s", username, id), nil)
+		assert.Equal(t, http.StatusOK, st)
+		g := group{}
+		assert.NoError(t, json.Unmarshal(resp, &g))
+		assert.Equal(t, entertainmentGroup, g.Type)
+		assert.Equal(t, tvRoom, g.Class)
+		assert.Equal(t, []string{light}, g.Lights)
+		if assert.NotNil(t, g.Stream) {
+			assert.False(t, g.Stream.Active)
+			assert.Nil(t, g.Stream.Owner)
+		}
+	})
+
+	t.Run("locations", func(t *testing.T) {
+		st, resp := tReq(t, b, http.MethodPut, fmt.Sprintf("/api/%s/groups/%s", username, id),
+			[]byte(fmt.Sprintf(`{"locations": {"%s": [-0.5, 1, 0.25]}}`, light)))
+		assert.Equal(t, http.StatusOK, st)
+		assert.JSONEq(t,
+			fmt.Sprintf(`[{"success": {"/groups/%s/locations/%s": [-0.5, 1, 0.25]}}]`, id, light),
+			string(resp))
+		assert.Equal(t, lightLocation{-0.5, 1, 0.25}, b.getGroup(id).Locations[light])
+
+		st, resp = tReq(t, b, http.MethodPut, fmt.Sprintf("/api/%s/groups/%s", username, id),
+			[]byte(fmt.Sprintf(`{"name": "Cinema", "locations": {"%s": [2, 0]}}`, light)))
+		assert.Equal(t, http.StatusOK, st)
+		errDec := []*errorResp{}
+		assert.NoError(t, json.Unmarshal(resp, &errDec))
+		if assert.Len(t, errDec, 1) {
+			assert.Equal(t, 7, errDec[0].Error.Type)
+		}
+		assert.Equal(t, "TV", b.getGroup(id).Name, "nothing should change if anything is invalid")
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		active := func(user string, on bool) []byte {
+			st, resp := tReq(t, b, http.MethodPut, fmt.Sprintf("/api/%s/groups/%s", user, id),
+				[]byte(fmt.Sprintf(`{"stream": {"active": %t}}`, on)))
+			assert.Equal(t, http.StatusOK, st)
+			return resp
+		}
+
+		assert.JSONEq(t,
+			fmt.Sprintf(`[{"success": {"/groups/%s/stream/active": true}}]`, id),
+			string(active(username, true)))
+		g := b.getGroup(id)
+		if assert.NotNil(t, g.Stream.Owner) {
+			assert.Equal(t, username, *g.Stream.Owner)
+		}
+
+		other := registerTestingUser(t, b)
+		errDec := []*errorResp{}
+		assert.NoError(t, json.Unmarshal(active(other, true), &errDec))
+		if assert.Len(t, errDec, 1) {
+			assert.Equal(t, 307, errDec[0].Error.Type)
+		}
+
+		assert.JSONEq(t,
+			fmt.Sprintf(`[{"success": {"/groups/%s/stream/active": false}}]`, id),
+			string(active(username, false)))
+		assert.False(t, b.getGroup(id).Stream.Active)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		st, resp := tReq(t, b, http.MethodDelete, fmt.Sprintf("/api/%s/groups/%s", username, id), nil)
+		assert.Equal(t, http.StatusOK, st)
+		assert.JSONEq(t, fmt.Sprintf(`[{"success": "/groups/%s deleted."}]`, id), string(resp))
+		assert.Nil(t, b.getGroup(id))
+
+		st, resp = tReq(t, b, http.MethodDelete, fmt.Sprintf("/api/%s/groups/%s", username, light), nil)
+		assert.Equal(t, http.StatusOK, st)
+		errDec := []*errorResp{}
+		assert.NoError(t, json.Unmarshal(resp, &errDec))
+		if assert.Len(t, errDec, 1) {
+			assert.Equal(t, 4, errDec[0].Error.Type, "rooms can't be deleted")
+		}
+	})
+}
+
+func TestValidLocations(t *testing.T) {
+	a := &entertainmentArea{}
+	a.setLights([]string{"1", "2"})
+	assert.Equal(t, map[string]lightLocation{"1": {}, "2": {}}, a.Locations)
+
+	assert.Empty(t, validLocations("/groups/200", map[string][]float64{
+		"1": {-1, 1},
+		"2": {0.5, -0.5, 1},
+	}, a))
+	errs := validLocations("/groups/200", map[string][]float64{
+		"1": {0, 0, 0, 0},
+		"2": {1.5, 0},
+		"3": {0, 0},
+	}, a)
+	if assert.Len(t, errs, 3) {
+		assert.Equal(t, 7, errs[0].(*errorResp).Error.Type)
+		assert.Equal(t, 7, errs[1].(*errorResp).Error.Type)
+		assert.Equal(t, 6, errs[2].(*errorResp).Error.Type, "light 3 isn't in the group")
+	}
+	assert.Equal(t, lightLocation{0.5, -0.5, 0}, toLightLocation([]float64{0.5, -0.5}))
+
+	a.Locations["1"] = lightLocation{1, 1, 1}
+	a.setLights([]string{"1", "3"})
+	assert.Equal(t, map[string]lightLocation{"1": {1, 1, 1}, "3": {}}, a.Locations)
+}
+
+func TestEntertainmentStore(t *testing.T) {
+	st := NewMemoryStore()
+	newServer := func() *Server {
+		return newTestServer(t, Storage(st), EntertainmentPath("entertainment.json"))
+	}
+
+	s := newServer()
+	assert.NoError(t, s.loadEntertainment(), "nothing stored yet")
+	a := &entertainmentArea{Name: "TV", Class: tvRoom}
+	a.setLights([]string{"1", "2"})
+	a.Locations["2"] = lightLocation{0.5, 0.5, 0}
+	a.owner = "someone"
+	s.entertainment.Lock()
+	id := s.entertainment.add(a, s.ids.taken)
+	assert.NoError(t, s.saveEntertainment())
+	s.entertainment.Unlock()
+
+	s = newServer()
+	assert.NoError(t, s.loadEntertainment())
+	if assert.Contains(t, s.entertainment.Areas, id) {
+		loaded := s.entertainment.Areas[id]
+		assert.Equal(t, "TV", loaded.Name)
+		assert.Equal(t, []string{"1", "2"}, loaded.Lights)
+		assert.Equal(t, lightLocation{0.5, 0.5, 0}, loaded.Locations["2"])
+		assert.Equal(t, "", loaded.owner, "streams shouldn't survive a restart")
+	}
+	assert.Equal(t, firstEntertainmentGroupID+1, s.entertainment.Next)
+}
+
+func TestEntertainmentGroupIDs(t *testing.T) {
+	s := newTestServer(t, AlexaCompatibility(true))
+	s.ids.Next = firstEntertainmentGroupID
+	light, _ := s.ids.get("lights/a")
+
+	s.entertainment.Lock()
+	id := s.entertainment.add(&entertainmentArea{Name: "TV", Class: tvRoom}, s.ids.taken)
+	s.entertainment.Unlock()
+	assert.NotEqual(t, light, id, "the group would replace the room of the light")
+	s.ids.reserveGroups(id)
+
+	next, _ := s.ids.get("lights/b")
+	assert.NotEqual(t, id, next, "the room of the light would replace the group")
+	assert.NotEqual(t, light, next)
+}
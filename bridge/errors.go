@@ -84,11 +84,11 @@ func errParameterUnavailable(resource, param string) *errorResp {
 	}
 }
 
-func errInvalidValueforParam(r *http.Request, param, value string) *errorResp {
+func errInvalidValueforParam(resource, param, value string) *errorResp {
 	return &errorResp{
 		Error: innerErrResp{
 			Type:        7,
-			Address:     infoFromRequest(r).resource,
+			Address:     resource,
 			Description: fmt.Sprintf("invalid value, %s, for parameter, %s", value, param),
 		},
 	}
@@ -104,6 +104,16 @@ func errParameterReadOnly(r *http.Request, param string) *errorResp {
 	}
 }
 
+func errLinkButtonNotPressed(r *http.Request) *errorResp {
+	return &errorResp{
+		Error: innerErrResp{
+			Type:        101,
+			Address:     infoFromRequest(r).resource,
+			Description: "link button not pressed",
+		},
+	}
+}
+
 func errDeviceIsOff(resource string, param string) *errorResp {
 	return &errorResp{
 		Error: innerErrResp{
@@ -114,6 +124,49 @@ func errDeviceIsOff(resource string, param string) *errorResp {
 	}
 }
 
+func errDeviceUnreachable(resource string, param string) *errorResp {
+	return &errorResp{
+		Error: innerErrResp{
+			Type:        201,
+			Address:     resource,
+			Description: fmt.Sprintf("parameter, %s, is not modifiable. Device is unreachable", param),
+		},
+	}
+}
+
+func errGroupTableFull(r *http.Request) *errorResp {
+	return &errorResp{
+		Error: innerErrResp{
+			Type:        301,
+			Address:     infoFromRequest(r).resource,
+			Description: "group could not be created. Group table is full",
+		},
+	}
+}
+
+// errWhitelistFull is returned when registering with a full whitelist. The
+// Hue API has no error of its own for that, so it's a table full error like
+// the one for groups
+func errWhitelistFull(r *http.Request) *errorResp {
+	return &errorResp{
+		Error: innerErrResp{
+			Type:        301,
+			Address:     infoFromRequest(r).resource,
+			Description: "user could not be created. Whitelist is full",
+		},
+	}
+}
+
+func errStreamOwnership(resource string) *errorResp {
+	return &errorResp{
+		Error: innerErrResp{
+			Type:        307,
+			Address:     resource,
+			Description: "Cannot claim stream ownership",
+		},
+	}
+}
+
 func errInternalError(resource, code string) *errorResp {
 	return &errorResp{
 		Error: innerErrResp{
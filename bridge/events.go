@@ -0,0 +1,308 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// eventBufferSize is how many messages can be waiting for a client of
+	// the event stream. Clients that fall further behind are disconnected
+	// and have to reconnect
+	eventBufferSize = 64
+	// eventKeepAlive is how often a comment is sent to idle clients, so
+	// the connection isn't closed
+	eventKeepAlive = 15 * time.Second
+	// eventResyncInterval is how often the resources are compared even if
+	// no features have been updated, which picks up lights being added or
+	// removed
+	eventResyncInterval = 5 * time.Second
+)
+
+// The types of events in the CLIP v2 event stream
+const (
+	eventUpdate = "update"
+	eventAdd    = "add"
+	eventDelete = "delete"
+)
+
+// watchedFeatures are the features of a lightbulb that change its state
+var watchedFeatures = []string{"on", "colorTemperature", "brightness", "hue", "saturation"}
+
+type clipEvent struct {
+	CreationTime string          `json:"creationtime"`
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Data         []*clipResource `json:"data"`
+}
+
+// eventClient is a client connected to the event stream
+type eventClient struct {
+	username string
+	msgs     chan []byte
+}
+
+// eventHub keeps track of the resources as they were last sent and the
+// clients to send changes to
+type eventHub struct {
+	clients map[*eventClient]bool
+	last    map[string][]byte
+	changed chan bool
+	sync.Mutex
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		clients: map[*eventClient]bool{},
+		last:    map[string][]byte{},
+		changed: make(chan bool, 1),
+	}
+}
+
+// subscribe adds a client of the user to the hub
+func (h *eventHub) subscribe(username string) *eventClient {
+	c := &eventClient{username: username, msgs: make(chan []byte, eventBufferSize)}
+	h.Lock()
+	h.clients[c] = true
+	h.Unlock()
+	return c
+}
+
+// unsubscribe removes the client from the hub and closes its channel, if
+// that hasn't already happened
+func (h *eventHub) unsubscribe(c *eventClient) {
+	h.Lock()
+	defer h.Unlock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.msgs)
+	}
+}
+
+// close disconnects every client
+func (h *eventHub) close() {
+	h.Lock()
+	defer h.Unlock()
+	for c := range h.clients {
+		delete(h.clients, c)
+		close(c.msgs)
+	}
+}
+
+// notify tells the hub the resources might have changed. It never blocks,
+// a burst of updates results in a single comparison
+func (h *eventHub) notify() {
+	select {
+	case h.changed <- true:
+	default:
+	}
+}
+
+// diff compares the resources to how they were last time and returns the
+// events that describe the changes
+func (h *eventHub) diff(res []*clipResource, t time.Time) []*clipEvent {
+	h.Lock()
+	defer h.Unlock()
+
+	events := []*clipEvent{}
+	event := func(typ string, r *clipResource) {
+		events = append(events, &clipEvent{
+			CreationTime: t.UTC().Format(time.RFC3339),
+			ID:           uuid.New().String(),
+			Type:         typ,
+			Data:         []*clipResource{r},
+		})
+	}
+
+	current := map[string][]byte{}
+	for _, r := range res {
+		b, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		current[r.ID] = b
+		prev, ok := h.last[r.ID]
+		switch {
+		case !ok:
+			event(eventAdd, r)
+		case !bytes.Equal(prev, b):
+			event(eventUpdate, r)
+		}
+	}
+
+	deleted := []*clipResource{}
+	for id, b := range h.last {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		r := &clipResource{}
+		if err := json.Unmarshal(b, r); err != nil {
+			continue
+		}
+		deleted = append(deleted, &clipResource{ID: r.ID, IDv1: r.IDv1, Type: r.Type})
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].ID < deleted[j].ID })
+	for _, r := range deleted {
+		event(eventDelete, r)
+	}
+
+	h.last = current
+	return events
+}
+
+// publish sends the events to every client, leaving out resources the
+// current scope of its user doesn't allow. Clients whose user is no longer
+// whitelisted, or whose buffer is full, are disconnected. That's checked
+// even if there are no events
+func (h *eventHub) publish(events []*clipEvent, t time.Time, scopes func(string) (*scope, bool)) {
+	h.Lock()
+	defer h.Unlock()
+	for c := range h.clients {
+		sc, ok := scopes(c.username)
+		if !ok {
+			delete(h.clients, c)
+			close(c.msgs)
+			continue
+		}
+		msg := eventMessage(visibleEvents(sc, events), t)
+		if msg == nil {
+			continue
+		}
+		select {
+		case c.msgs <- msg:
+		default:
+			delete(h.clients, c)
+			close(c.msgs)
+		}
+	}
+}
+
+// visibleEvents returns the events with only the resources the scope
+// allows
+func visibleEvents(sc *scope, events []*clipEvent) []*clipEvent {
+	res := []*clipEvent{}
+	for _, ev := range events {
+		data := []*clipResource{}
+		for _, r := range ev.Data {
+			if visibleClipResource(sc, r) {
+				data = append(data, r)
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+		cp := *ev
+		cp.Data = data
+		res = append(res, &cp)
+	}
+	return res
+}
+
+// eventMessage formats the events as a server-sent event, or returns nil
+// if there are none
+func eventMessage(events []*clipEvent, t time.Time) []byte {
+	if len(events) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		return nil
+	}
+	return []byte(fmt.Sprintf("id: %d:0\ndata: %s\n\n", t.Unix(), b))
+}
+
+// watchEvents compares the resources whenever a feature of a light is
+// updated, and every eventResyncInterval, and publishes what changed to the
+// CLIP v2 event stream and the deCONZ websocket
+func (s *Server) watchEvents(quit chan bool) {
+	ticker := time.NewTicker(eventResyncInterval)
+	defer ticker.Stop()
+	watched := map[string]bool{}
+
+	update := func() {
+		for _, d := range s.mqtt.DeviceByType("lightbulb") {
+			topic := d.Info().Topic
+			if watched[topic] {
+				continue
+			}
+			watched[topic] = true
+			for _, ft := range watchedFeatures {
+				if !d.Feature(ft).Exists() {
+					continue
+				}
+				err := d.Feature(ft).OnUpdateFunc(func(string) {
+					s.events.notify()
+				})
+				if err != nil {
+					s.logger.Error(err.Error())
+				}
+			}
+		}
+		t := now()
+		s.events.publish(s.events.diff(s.clipResources(), t), t, s.userScope)
+		s.deconz.publish(s.deconz.changed(s.deconzStates()), s.userScope)
+	}
+
+	update()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-s.events.changed:
+			update()
+		case <-ticker.C:
+			update()
+		}
+	}
+}
+
+// eventStream serves the CLIP v2 event stream, sending the changes to the
+// resources the user can see as server-sent events
+func (s *Server) eventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		renderClip(w, r, http.StatusInternalServerError, []interface{}{},
+			"Internal server error")
+		return
+	}
+
+	c := s.events.subscribe(r.Header.Get(clipKeyHeader))
+	defer s.events.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": hi\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-c.msgs:
+			if !ok {
+				// Too far behind, no longer whitelisted or shutting
+				// down, the client has to reconnect
+				return
+			}
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": hi\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
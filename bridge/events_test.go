@@ -0,0 +1,160 @@
+package bridge
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventHubDiff(t *testing.T) {
+	h := newEventHub()
+	ts := time.Unix(1554594787, 0)
+	light := &clipResource{ID: "a", IDv1: "/lights/1", Type: clipLight, On: &clipOn{On: false}}
+	room := &clipResource{ID: "b", IDv1: "/groups/1", Type: clipRoom}
+
+	events := h.diff([]*clipResource{light, room}, ts)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, eventAdd, events[0].Type)
+		assert.Equal(t, []*clipResource{light}, events[0].Data)
+		assert.Equal(t, "2019-04-06T23:53:07Z", events[0].CreationTime)
+	}
+	assert.Empty(t, h.diff([]*clipResource{light, room}, ts), "nothing changed")
+
+	on := &clipResource{ID: "a", IDv1: "/lights/1", Type: clipLight, On: &clipOn{On: true}}
+	events = h.diff([]*clipResource{on}, ts)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, eventUpdate, events[0].Type)
+		assert.Equal(t, []*clipResource{on}, events[0].Data)
+		assert.Equal(t, eventDelete, events[1].Type)
+		assert.Equal(t, []*clipResource{{ID: "b", IDv1: "/groups/1", Type: clipRoom}}, events[1].Data)
+	}
+}
+
+func TestEventHubPublish(t *testing.T) {
+	h := newEventHub()
+	ts := time.Unix(1554594787, 0)
+	events := []*clipEvent{
+		{ID: "1", Type: eventUpdate, Data: []*clipResource{{ID: "a", IDv1: "/lights/1", Type: clipLight}}},
+		{ID: "2", Type: eventUpdate, Data: []*clipResource{{ID: "b", IDv1: "/lights/2", Type: clipLight}}},
+	}
+
+	users := map[string]*scope{"full": nil, "limited": {Lights: []string{"2"}}}
+	scopes := func(username string) (*scope, bool) {
+		sc, ok := users[username]
+		return sc, ok
+	}
+	full := h.subscribe("full")
+	limited := h.subscribe("limited")
+	h.publish(events, ts, scopes)
+
+	msg := <-full.msgs
+	assert.True(t, strings.HasPrefix(string(msg), "id: 1554594787:0\ndata: "))
+	assert.True(t, strings.HasSuffix(string(msg), "\n\n"))
+	dec := []*clipEvent{}
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(strings.SplitN(string(msg), "data: ", 2)[1])), &dec))
+	assert.Len(t, dec, 2)
+
+	msg = <-limited.msgs
+	dec = []*clipEvent{}
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(strings.SplitN(string(msg), "data: ", 2)[1])), &dec))
+	if assert.Len(t, dec, 1) {
+		assert.Equal(t, "2", dec[0].ID)
+	}
+
+	t.Run("slow client", func(t *testing.T) {
+		for i := 0; i < eventBufferSize; i++ {
+			h.publish(events, ts, scopes)
+			<-limited.msgs
+		}
+		assert.Len(t, full.msgs, eventBufferSize)
+		h.publish(events, ts, scopes)
+		h.Lock()
+		assert.False(t, h.clients[full], "a full buffer should disconnect the client")
+		assert.True(t, h.clients[limited])
+		h.Unlock()
+		for range full.msgs {
+		}
+		h.unsubscribe(full)
+	})
+	t.Run("changed scope", func(t *testing.T) {
+		for len(limited.msgs) > 0 {
+			<-limited.msgs
+		}
+		users["limited"] = &scope{Lights: []string{"1"}}
+		h.publish(events, ts, scopes)
+		msg := <-limited.msgs
+		dec := []*clipEvent{}
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(strings.SplitN(string(msg), "data: ", 2)[1])), &dec))
+		if assert.Len(t, dec, 1) {
+			assert.Equal(t, "1", dec[0].ID)
+		}
+	})
+	t.Run("deleted user", func(t *testing.T) {
+		delete(users, "limited")
+		h.publish(nil, ts, scopes)
+		h.Lock()
+		assert.False(t, h.clients[limited], "a user that's no longer whitelisted should be disconnected")
+		h.Unlock()
+		for range limited.msgs {
+		}
+	})
+}
+
+func TestEventStream(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Whitelist = &map[string]whitelist{"user": {Name: "user"}}
+	srv := httptest.NewServer(http.HandlerFunc(s.eventStream))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connect := func() (*bufio.Reader, func() error) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		req.Header.Set(clipKeyHeader, "user")
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		rd := bufio.NewReader(resp.Body)
+		line, err := rd.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, ": hi\n", line, "a comment is sent straight away")
+		_, _ = rd.ReadString('\n')
+		return rd, resp.Body.Close
+	}
+
+	rd, closeBody := connect()
+	s.events.publish([]*clipEvent{{ID: "1", Type: eventAdd, Data: []*clipResource{{ID: "a", Type: clipBridge}}}},
+		time.Unix(1554594787, 0), s.userScope)
+	line, err := rd.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "id: 1554594787:0\n", line)
+	line, err = rd.ReadString('\n')
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "data: ["))
+	_, _ = rd.ReadString('\n')
+
+	s.config.Whitelist = &map[string]whitelist{}
+	s.events.publish(nil, time.Unix(1554594787, 0), s.userScope)
+	_, err = rd.ReadString('\n')
+	assert.Error(t, err, "deleting the user should end the stream")
+	_ = closeBody()
+
+	s.config.Whitelist = &map[string]whitelist{"user": {Name: "user"}}
+	rd, closeBody = connect()
+	defer closeBody()
+	s.events.close()
+	_, err = rd.ReadString('\n')
+	assert.Error(t, err, "closing the hub should end the stream")
+}
@@ -90,6 +90,9 @@ type group struct {
 	State   groupState `json:"state"`
 	Action  lightState `json:"action"`
 	Recycle bool       `json:"recycle"`
+	// Locations and Stream are only set for entertainment groups
+	Locations map[string]lightLocation `json:"locations,omitempty"`
+	Stream    *groupStream             `json:"stream,omitempty"`
 }
 
 func (*group) Render(w http.ResponseWriter, r *http.Request) error {
@@ -124,6 +127,11 @@ func (req *groupRenameReq) Bind(r *http.Request) error {
 }
 
 func (s *Server) groupRename(w http.ResponseWriter, r *http.Request) {
+	groupID := chi.RouteContext(r.Context()).URLParam("groupID")
+	if s.groupIsEntertainment(groupID) {
+		s.updateEntertainmentGroup(w, r, groupID)
+		return
+	}
 	data := &groupRenameReq{}
 	if err := render.Bind(r, data); err != nil {
 		renderListOK(w, r, errInvalidJSON())
@@ -138,7 +146,7 @@ func (s *Server) groupRename(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) createGroups() groups {
 	grps := map[string]*group{}
-	devs := s.getAllLightsFromMQTT()
+	devs := s.getAllLights()
 	for name, dev := range devs {
 		grps[name] = &group{
 			Name:    dev.Name,
@@ -153,15 +161,15 @@ func (s *Server) createGroups() groups {
 			Action: dev.State,
 		}
 	}
+	for id, g := range s.entertainmentGroups(devs) {
+		grps[id] = g
+	}
 	return grps
 }
 
 func (s *Server) getGroups(w http.ResponseWriter, r *http.Request) {
 	g := s.createGroups()
-	s.config.Lock()
-	s.config.groups = len(g)
-	s.config.Unlock()
-	renderOK(w, r, g)
+	renderOK(w, r, scopeFromRequest(r).filterGroups(g))
 }
 
 func (s *Server) getGroup(id string) *group {
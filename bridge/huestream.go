@@ -0,0 +1,122 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// hueStreamProtocol starts every message of the Entertainment API
+var hueStreamProtocol = []byte("HueStream")
+
+const (
+	// hueStreamHeaderSize is the size of the header both versions share
+	hueStreamHeaderSize = 16
+	// hueStreamV1ChannelSize is a device type, a light ID and a colour
+	hueStreamV1ChannelSize = 9
+	// hueStreamV2ConfigSize is the entertainment configuration UUID that
+	// follows the header in version 2
+	hueStreamV2ConfigSize = 36
+	// hueStreamV2ChannelSize is a channel ID and a colour
+	hueStreamV2ChannelSize = 7
+
+	hueStreamDeviceLight = 0x00
+)
+
+// colorSpace is how the colours in a HueStream message are encoded
+type colorSpace byte
+
+const (
+	colorSpaceRGB colorSpace = 0x00
+	colorSpaceXY  colorSpace = 0x01
+)
+
+// streamColor is the colour of one channel, either R, G, B or x, y and
+// brightness depending on the colour space. Every value is 0-65535
+type streamColor struct {
+	Space  colorSpace
+	Values [3]uint16
+}
+
+// streamChannel is the colour of one light in a message. Version 1 addresses
+// lights by their ID, version 2 by their channel in the entertainment
+// configuration
+type streamChannel struct {
+	Light   string
+	Channel int
+	Color   streamColor
+}
+
+// streamMessage is a decoded HueStream message
+type streamMessage struct {
+	Major    int
+	Minor    int
+	Sequence int
+	// Config is the entertainment configuration a version 2 message is for
+	Config   string
+	Channels []streamChannel
+}
+
+var errNotHueStream = errors.New("not a HueStream message")
+
+// parseHueStream decodes a HueStream version 1 or 2 message
+func parseHueStream(b []byte) (*streamMessage, error) {
+	if len(b) < hueStreamHeaderSize || !bytes.Equal(b[:len(hueStreamProtocol)], hueStreamProtocol) {
+		return nil, errNotHueStream
+	}
+	msg := &streamMessage{
+		Major:    int(b[9]),
+		Minor:    int(b[10]),
+		Sequence: int(b[11]),
+	}
+	space := colorSpace(b[14])
+	if space != colorSpaceRGB && space != colorSpaceXY {
+		return nil, fmt.Errorf("unknown colour space %d", space)
+	}
+	body := b[hueStreamHeaderSize:]
+	color := func(c []byte) streamColor {
+		return streamColor{Space: space, Values: [3]uint16{
+			binary.BigEndian.Uint16(c[0:2]),
+			binary.BigEndian.Uint16(c[2:4]),
+			binary.BigEndian.Uint16(c[4:6]),
+		}}
+	}
+
+	switch msg.Major {
+	case 1:
+		if len(body)%hueStreamV1ChannelSize != 0 {
+			return nil, fmt.Errorf("%d bytes of channels isn't a multiple of %d", len(body), hueStreamV1ChannelSize)
+		}
+		for i := 0; i < len(body); i += hueStreamV1ChannelSize {
+			ch := body[i : i+hueStreamV1ChannelSize]
+			if ch[0] != hueStreamDeviceLight {
+				continue
+			}
+			msg.Channels = append(msg.Channels, streamChannel{
+				Light:   IntToStr(int(binary.BigEndian.Uint16(ch[1:3]))),
+				Channel: -1,
+				Color:   color(ch[3:]),
+			})
+		}
+	case 2:
+		if len(body) < hueStreamV2ConfigSize {
+			return nil, errors.New("missing entertainment configuration")
+		}
+		msg.Config = string(body[:hueStreamV2ConfigSize])
+		body = body[hueStreamV2ConfigSize:]
+		if len(body)%hueStreamV2ChannelSize != 0 {
+			return nil, fmt.Errorf("%d bytes of channels isn't a multiple of %d", len(body), hueStreamV2ChannelSize)
+		}
+		for i := 0; i < len(body); i += hueStreamV2ChannelSize {
+			ch := body[i : i+hueStreamV2ChannelSize]
+			msg.Channels = append(msg.Channels, streamChannel{
+				Channel: int(ch[0]),
+				Color:   color(ch[1:]),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported HueStream version %d.%d", msg.Major, msg.Minor)
+	}
+	return msg, nil
+}
@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hueStreamHeader returns the header of a HueStream message
+func hueStreamHeader(major byte, space colorSpace) []byte {
+	return append([]byte("HueStream"), major, 0x00, 0x07, 0x00, 0x00, byte(space), 0x00)
+}
+
+func TestParseHueStream(t *testing.T) {
+	t.Run("version 1", func(t *testing.T) {
+		b := hueStreamHeader(1, colorSpaceRGB)
+		b = append(b,
+			0x00, 0x00, 0x01, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00,
+			0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x01, 0x00, 0x00, 0x00, 0x80, 0x00, 0xff, 0xff,
+		)
+		msg, err := parseHueStream(b)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, 1, msg.Major)
+		assert.Equal(t, 7, msg.Sequence)
+		assert.Equal(t, []streamChannel{
+			{Light: "1", Channel: -1, Color: streamColor{Space: colorSpaceRGB, Values: [3]uint16{0xffff, 0, 0}}},
+			{Light: "256", Channel: -1, Color: streamColor{Space: colorSpaceRGB, Values: [3]uint16{0, 0x8000, 0xffff}}},
+		}, msg.Channels, "devices that aren't lights should be skipped")
+	})
+	t.Run("version 2", func(t *testing.T) {
+		b := hueStreamHeader(2, colorSpaceXY)
+		b = append(b, []byte("1a8d99cc-967b-44f2-9202-43f976c0fa6b")...)
+		b = append(b,
+			0x00, 0x80, 0x00, 0x40, 0x00, 0xff, 0xff,
+			0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		)
+		msg, err := parseHueStream(b)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, 2, msg.Major)
+		assert.Equal(t, "1a8d99cc-967b-44f2-9202-43f976c0fa6b", msg.Config)
+		assert.Equal(t, []streamChannel{
+			{Channel: 0, Color: streamColor{Space: colorSpaceXY, Values: [3]uint16{0x8000, 0x4000, 0xffff}}},
+			{Channel: 3, Color: streamColor{Space: colorSpaceXY}},
+		}, msg.Channels)
+	})
+	t.Run("errors", func(t *testing.T) {
+		tests := map[string][]byte{
+			"not HueStream":     append([]byte("HueStreak"), make([]byte, 7)...),
+			"too short":         []byte("HueStream"),
+			"colour space":      hueStreamHeader(1, 0x02),
+			"version":           hueStreamHeader(3, colorSpaceRGB),
+			"v1 channel size":   append(hueStreamHeader(1, colorSpaceRGB), 0x00, 0x00, 0x01),
+			"v2 without config": append(hueStreamHeader(2, colorSpaceRGB), 0x00),
+			"v2 channel size":   append(append(hueStreamHeader(2, colorSpaceRGB), make([]byte, 36)...), 0x00),
+		}
+		for name, b := range tests {
+			b := b
+			t.Run(name, func(t *testing.T) {
+				_, err := parseHueStream(b)
+				assert.Error(t, err)
+			})
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// idMap hands out small, sequential light IDs and remembers them so they're
+// stable across restarts. Some clients, like the Amazon Echo, can't deal with
+// the large IDs TopicToStrInt generates
+type idMap struct {
+	IDs  map[string]string `json:"ids"`
+	Next int               `json:"next"`
+
+	// groups are the IDs of entertainment groups. The room of a light
+	// shares its ID, so lights aren't given these
+	groups map[string]bool
+	sync.Mutex
+}
+
+func newIDMap() *idMap {
+	return &idMap{
+		IDs:    map[string]string{},
+		Next:   1,
+		groups: map[string]bool{},
+	}
+}
+
+// get returns the ID for the topic, and whether a new one was assigned
+func (m *idMap) get(topic string) (string, bool) {
+	m.Lock()
+	defer m.Unlock()
+	if id, ok := m.IDs[topic]; ok {
+		return id, false
+	}
+	for m.groups[strconv.Itoa(m.Next)] {
+		m.Next++
+	}
+	id := strconv.Itoa(m.Next)
+	m.IDs[topic] = id
+	m.Next++
+	return id, true
+}
+
+// lookup returns the ID of the topic if it has been given one
+func (m *idMap) lookup(topic string) (string, bool) {
+	m.Lock()
+	defer m.Unlock()
+	id, ok := m.IDs[topic]
+	return id, ok
+}
+
+// taken returns whether a light has been given the ID
+func (m *idMap) taken(id string) bool {
+	m.Lock()
+	defer m.Unlock()
+	for _, v := range m.IDs {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveGroups keeps lights from being given the IDs of entertainment
+// groups. It's called with every group when they're replaced
+func (m *idMap) reserveGroups(ids ...string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.groups == nil {
+		m.groups = map[string]bool{}
+	}
+	for _, id := range ids {
+		m.groups[id] = true
+	}
+}
+
+// assignedLightID returns the ID of a light without giving it one if it
+// doesn't have one yet, like lightID would in Alexa mode
+func (s *Server) assignedLightID(topic string) (string, bool) {
+	s.config.RLock()
+	alexa := s.config.alexa
+	s.config.RUnlock()
+	if !alexa {
+		return TopicToStrInt(topic), true
+	}
+	return s.ids.lookup(topic)
+}
+
+// lightID returns the ID a light is known by through the API
+func (s *Server) lightID(topic string) string {
+	s.config.RLock()
+	alexa := s.config.alexa
+	s.config.RUnlock()
+	if !alexa {
+		return TopicToStrInt(topic)
+	}
+	id, assigned := s.ids.get(topic)
+	if assigned {
+		if err := s.saveIDMapToFile(); err != nil {
+			s.logger.Error(err.Error())
+		}
+	}
+	return id
+}
+
+// idMapSchema is how the ID map is stored. Version 0 is the bare ID map we
+// wrote before it was versioned
+var idMapSchema = &schema{
+	Version: 1,
+	Migrations: []migration{
+		func(data json.RawMessage) (json.RawMessage, error) { return data, nil },
+	},
+}
+
+func (s *Server) loadIDMapFromFile() (*idMap, error) {
+	path := s.config.idMapPath
+	if path == "" {
+		return newIDMap(), nil
+	}
+	m := newIDMap()
+	err := loadObject(s.config.store, path, idMapSchema, m)
+	if err == errNotStored {
+		s.logger.Info(fmt.Sprintf("ID map does not exist at %s", path))
+		return newIDMap(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ID map from %s: %v", path, err)
+	}
+	s.logger.Info(fmt.Sprintf("ID map loaded from: %s", path))
+	return m, nil
+}
+
+func (s *Server) saveIDMapToFile() error {
+	s.config.RLock()
+	defer s.config.RUnlock()
+	return s.saveIDMap()
+}
+
+// saveIDMap persists the ID map, the caller must hold the lock
+func (s *Server) saveIDMap() error {
+	path := s.config.idMapPath
+	if path == "" {
+		s.logger.Debug("no ID map path specified, not persisting to disk")
+		return nil
+	}
+	s.ids.Lock()
+	err := saveObject(s.config.store, path, idMapSchema, s.ids)
+	s.ids.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to write ID map to %s: %v", path, err)
+	}
+	return nil
+}
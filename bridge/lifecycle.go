@@ -0,0 +1,171 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultGracePeriod is how long an unreachable light is kept around before
+// it's removed from the bridge
+const DefaultGracePeriod = 24 * time.Hour
+
+// lightEntry is the last known state of a light
+type lightEntry struct {
+	light *light
+	// unreachableSince is when the light was first found unreachable, it's
+	// the zero time when the light is reachable
+	unreachableSince time.Time
+	// removed is set once the light has been unreachable for longer than
+	// the grace period. It stays hidden until it's reachable again
+	removed bool
+}
+
+// lightRegistry keeps track of every light we've seen, so lights that leave
+// or whose state we can no longer read are still reported as unreachable
+// with their last known state instead of vanishing
+type lightRegistry struct {
+	entries map[string]*lightEntry
+	// refused are the topics of the lights that didn't fit, so we only
+	// warn about them once
+	refused map[string]bool
+	sync.Mutex
+}
+
+func newLightRegistry() *lightRegistry {
+	return &lightRegistry{
+		entries: map[string]*lightEntry{},
+		refused: map[string]bool{},
+	}
+}
+
+// fits returns whether the light is shown already or there's room for it,
+// the bridge has room for maxLights lights. Removed lights don't take up
+// room
+func (r *lightRegistry) fits(id string) bool {
+	if e, ok := r.entries[id]; ok && !e.removed {
+		return true
+	}
+	n := 0
+	for _, e := range r.entries {
+		if !e.removed {
+			n++
+		}
+	}
+	return n < maxLights
+}
+
+// reachable records the current state of a reachable light
+func (r *lightRegistry) reachable(id string, l *light) {
+	r.entries[id] = &lightEntry{light: l}
+}
+
+// unreachable marks a light as unreachable from t, keeping its last known
+// state. If we don't know the light yet, l is used as its last known state
+func (r *lightRegistry) unreachable(id string, l *light, t time.Time) {
+	e, ok := r.entries[id]
+	if !ok {
+		if l == nil {
+			return
+		}
+		e = &lightEntry{light: l}
+		r.entries[id] = e
+	}
+	if e.unreachableSince.IsZero() {
+		e.unreachableSince = t
+	}
+	if e.light.State.Reachable {
+		cp := *e.light
+		cp.State.Reachable = false
+		e.light = &cp
+	}
+}
+
+// prune hides lights that have been unreachable for longer than the grace
+// period. Lights that are also no longer known to Hemtjanst are forgotten
+func (r *lightRegistry) prune(t time.Time, grace time.Duration, known map[string]bool, l *zap.Logger) {
+	for id, e := range r.entries {
+		if e.unreachableSince.IsZero() || t.Sub(e.unreachableSince) < grace {
+			continue
+		}
+		if !e.removed {
+			l.Info(fmt.Sprintf("removing light %s, unreachable since %s",
+				e.light.topic, DateTimeToISO8600(e.unreachableSince.UTC())))
+			e.removed = true
+		}
+		if !known[id] {
+			delete(r.entries, id)
+		}
+	}
+}
+
+// lights returns every light that hasn't been removed
+func (r *lightRegistry) lights() lights {
+	res := lights{}
+	for id, e := range r.entries {
+		if e.removed {
+			continue
+		}
+		res[id] = e.light
+	}
+	return res
+}
+
+// refreshLights updates the registry with the current state of every
+// lightbulb known to Hemtjanst and returns all the lights the bridge knows
+// about, reachable or not
+func (s *Server) refreshLights() lights {
+	devs := s.mqtt.DeviceByType("lightbulb")
+	t := now()
+
+	s.config.RLock()
+	grace := s.config.gracePeriod
+	s.config.RUnlock()
+
+	s.registry.Lock()
+	defer s.registry.Unlock()
+
+	known := map[string]bool{}
+	for _, d := range devs {
+		topic := d.Info().Topic
+		if strings.HasPrefix(topic, "rpi") {
+			continue
+		}
+		// A light that doesn't fit shouldn't use up an ID in Alexa mode
+		id, ok := s.assignedLightID(topic)
+		if !s.registry.fits(id) {
+			if !s.registry.refused[topic] {
+				s.logger.Warn(fmt.Sprintf(
+					"not adding light %s, a bridge can't have more than %d lights", topic, maxLights))
+				s.registry.refused[topic] = true
+			}
+			continue
+		}
+		delete(s.registry.refused, topic)
+		if !ok {
+			id = s.lightID(topic)
+		}
+		known[id] = true
+		l, err := s.newLight(d)
+		if err != nil {
+			s.logger.Error(err.Error(), zap.String("device", topic))
+			l = s.placeholderLight(d)
+		}
+		if l != nil && l.State.Reachable {
+			s.registry.reachable(id, l)
+			continue
+		}
+		s.registry.unreachable(id, l, t)
+	}
+	for id := range s.registry.entries {
+		if !known[id] {
+			s.registry.unreachable(id, nil, t)
+		}
+	}
+	s.registry.prune(t, grace, known, s.logger)
+
+	return s.registry.lights()
+}
@@ -0,0 +1,102 @@
+package bridge
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLightRegistry(t *testing.T) {
+	start := time.Unix(1554594787, 0)
+	grace := time.Hour
+	newTestLight := func(topic string, on bool) *light {
+		return &light{
+			topic: topic,
+			State: lightState{On: on, Reachable: true},
+		}
+	}
+
+	t.Run("reachable", func(t *testing.T) {
+		r := newLightRegistry()
+		r.reachable("1", newTestLight("test/light1", true))
+		r.prune(start, grace, map[string]bool{"1": true}, zap.NewNop())
+		ls := r.lights()
+		assert.Len(t, ls, 1)
+		assert.True(t, ls["1"].State.Reachable)
+	})
+	t.Run("unknown and unreadable", func(t *testing.T) {
+		r := newLightRegistry()
+		r.unreachable("1", nil, start)
+		assert.Len(t, r.lights(), 0)
+	})
+	t.Run("left", func(t *testing.T) {
+		r := newLightRegistry()
+		l := newTestLight("test/light1", true)
+		r.reachable("1", l)
+		r.unreachable("1", nil, start)
+		r.prune(start.Add(time.Minute), grace, map[string]bool{}, zap.NewNop())
+
+		ls := r.lights()
+		assert.Len(t, ls, 1)
+		assert.False(t, ls["1"].State.Reachable)
+		assert.True(t, ls["1"].State.On, "last known state should be kept")
+		assert.True(t, l.State.Reachable, "previously returned light should not be modified")
+
+		r.unreachable("1", nil, start.Add(30*time.Minute))
+		assert.Equal(t, start, r.entries["1"].unreachableSince)
+
+		r.prune(start.Add(grace), grace, map[string]bool{}, zap.NewNop())
+		assert.Len(t, r.lights(), 0)
+		assert.Len(t, r.entries, 0)
+	})
+	t.Run("unreachable but known", func(t *testing.T) {
+		r := newLightRegistry()
+		r.unreachable("1", newTestLight("test/light1", false), start)
+		assert.Len(t, r.lights(), 1)
+
+		r.prune(start.Add(2*grace), grace, map[string]bool{"1": true}, zap.NewNop())
+		assert.Len(t, r.lights(), 0)
+		assert.Len(t, r.entries, 1, "light should be remembered while Hemtjanst knows about it")
+
+		r.unreachable("1", newTestLight("test/light1", false), start.Add(3*grace))
+		assert.Len(t, r.lights(), 0, "light should stay removed while unreachable")
+
+		r.reachable("1", newTestLight("test/light1", false))
+		assert.Len(t, r.lights(), 1, "light should come back once reachable")
+	})
+	t.Run("no grace period", func(t *testing.T) {
+		r := newLightRegistry()
+		r.reachable("1", newTestLight("test/light1", true))
+		r.unreachable("1", nil, start)
+		r.prune(start, 0, map[string]bool{}, zap.NewNop())
+		assert.Len(t, r.lights(), 0)
+	})
+	t.Run("full", func(t *testing.T) {
+		r := newLightRegistry()
+		for i := 1; i <= maxLights; i++ {
+			id := strconv.Itoa(i)
+			assert.True(t, r.fits(id))
+			r.reachable(id, newTestLight("test/light"+id, true))
+		}
+		assert.True(t, r.fits("1"), "known lights should still fit")
+		assert.False(t, r.fits("64"))
+
+		r.entries["2"].removed = true
+		assert.True(t, r.fits("64"), "removed lights shouldn't take up room")
+		r.reachable("64", newTestLight("test/light64", true))
+		assert.False(t, r.fits("2"), "a removed light should need room to come back")
+	})
+}
+
+func TestLightStateUpdateParams(t *testing.T) {
+	upd := &lightStateUpdate{
+		On:               BoolPtr(true),
+		Brightness:       IntPtr(10),
+		ColorTemperature: IntPtr(200),
+	}
+	assert.Equal(t, []string{"on", "bri", "ct"}, upd.params())
+	assert.Len(t, (&lightStateUpdate{}).params(), 0)
+}
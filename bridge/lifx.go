@@ -0,0 +1,383 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+)
+
+const (
+	// lifxHeaderSize is the size of the header every LIFX LAN message
+	// starts with
+	lifxHeaderSize = 36
+	// lifxProtocol is the only protocol number LIFX devices speak
+	lifxProtocol = 1024
+	// lifxServiceUDP is the UDP service in StateService
+	lifxServiceUDP = 1
+	// lifxLabelSize is the size of the label in State and StateLabel
+	lifxLabelSize = 32
+	// lifxBufferSize is the largest message that's read
+	lifxBufferSize = 1024
+)
+
+// The types of LIFX LAN messages that are understood or sent
+const (
+	lifxGetService      uint16 = 2
+	lifxStateService    uint16 = 3
+	lifxGetPower        uint16 = 20
+	lifxSetPower        uint16 = 21
+	lifxStatePower      uint16 = 22
+	lifxGetLabel        uint16 = 23
+	lifxStateLabel      uint16 = 25
+	lifxAcknowledgement uint16 = 45
+	lifxGet             uint16 = 101
+	lifxSetColor        uint16 = 102
+	lifxSetWaveform     uint16 = 103
+	lifxState           uint16 = 107
+	lifxGetLightPower   uint16 = 116
+	lifxSetLightPower   uint16 = 117
+	lifxStateLightPower uint16 = 118
+)
+
+var errNotLIFX = errors.New("not a LIFX LAN message")
+
+// lifxTarget is the MAC-like address of a LIFX device, padded to 8 bytes
+type lifxTarget [8]byte
+
+// lifxTargetForTopic derives a target from the topic of a light. It's a
+// locally administered unicast MAC so it can't clash with real hardware
+func lifxTargetForTopic(topic string) lifxTarget {
+	sum := sha1.Sum([]byte(topic))
+	t := lifxTarget{}
+	copy(t[0:6], sum[0:6])
+	t[0] = (t[0] | 0x02) &^ 0x01
+	return t
+}
+
+type lifxHeader struct {
+	Size        uint16
+	Tagged      bool
+	Source      uint32
+	Target      lifxTarget
+	AckRequired bool
+	ResRequired bool
+	Sequence    uint8
+	Type        uint16
+}
+
+type lifxMessage struct {
+	lifxHeader
+	Payload []byte
+}
+
+// lifxHSBK is a colour as LIFX devices describe it, all values are 0-65535
+// except for the colour temperature in Kelvin
+type lifxHSBK struct {
+	Hue        uint16
+	Saturation uint16
+	Brightness uint16
+	Kelvin     uint16
+}
+
+// parseLIFX parses a LIFX LAN message
+func parseLIFX(b []byte) (*lifxMessage, error) {
+	if len(b) < lifxHeaderSize {
+		return nil, errNotLIFX
+	}
+	le := binary.LittleEndian
+	size := le.Uint16(b[0:2])
+	flags := le.Uint16(b[2:4])
+	if flags&0x0fff != lifxProtocol || int(size) != len(b) {
+		return nil, errNotLIFX
+	}
+	msg := &lifxMessage{
+		lifxHeader: lifxHeader{
+			Size:        size,
+			Tagged:      flags&0x2000 != 0,
+			Source:      le.Uint32(b[4:8]),
+			AckRequired: b[22]&0x02 != 0,
+			ResRequired: b[22]&0x01 != 0,
+			Sequence:    b[23],
+			Type:        le.Uint16(b[32:34]),
+		},
+		Payload: b[lifxHeaderSize:],
+	}
+	copy(msg.Target[:], b[8:16])
+	return msg, nil
+}
+
+// reply returns a message of the type with the payload, sent from the
+// target in reply to the request
+func (h lifxHeader) reply(target lifxTarget, typ uint16, payload []byte) []byte {
+	le := binary.LittleEndian
+	b := make([]byte, lifxHeaderSize+len(payload))
+	le.PutUint16(b[0:2], uint16(len(b)))
+	le.PutUint16(b[2:4], lifxProtocol|0x1000)
+	le.PutUint32(b[4:8], h.Source)
+	copy(b[8:16], target[:])
+	b[23] = h.Sequence
+	le.PutUint16(b[32:34], typ)
+	copy(b[lifxHeaderSize:], payload)
+	return b
+}
+
+func parseHSBK(b []byte) lifxHSBK {
+	le := binary.LittleEndian
+	return lifxHSBK{
+		Hue:        le.Uint16(b[0:2]),
+		Saturation: le.Uint16(b[2:4]),
+		Brightness: le.Uint16(b[4:6]),
+		Kelvin:     le.Uint16(b[6:8]),
+	}
+}
+
+func (c lifxHSBK) bytes() []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 8)
+	le.PutUint16(b[0:2], c.Hue)
+	le.PutUint16(b[2:4], c.Saturation)
+	le.PutUint16(b[4:6], c.Brightness)
+	le.PutUint16(b[6:8], c.Kelvin)
+	return b
+}
+
+// lifxColor returns the colour of the light as HSBK
+func lifxColor(l *light) lifxHSBK {
+	c := lifxHSBK{
+		Brightness: uint16(math.Round(float64(philipsBrightnessRange.snap(l.State.Brightness)-1) * 65535 / 253)),
+		Kelvin:     uint16(MiredToKelvin(l.State.MiredColorTemp)),
+	}
+	if c.Kelvin == 0 {
+		c.Kelvin = 2700
+	}
+	if l.Type == rgbType && len(l.State.XY) == 2 {
+		h, s := CIExyToHemtjanstHS(l.State.XY[0], l.State.XY[1])
+		c.Hue = uint16(math.Round(float64(h) * 65536 / 360))
+		c.Saturation = uint16(math.Round(float64(s) * 65535 / 100))
+	}
+	return c
+}
+
+// lifxStateUpdate returns the update that gives the light the colour, as
+// far as the light can show it
+func lifxStateUpdate(l *light, c lifxHSBK) *lightStateUpdate {
+	upd := &lightStateUpdate{
+		Brightness: IntPtr(1 + int(math.Round(float64(c.Brightness)*253/65535))),
+	}
+	switch l.Type {
+	case rgbType:
+		upd.XY = FloatPtr(HemtjanstHStoCIExy(
+			int(math.Round(float64(c.Hue)*360/65536)),
+			int(math.Round(float64(c.Saturation)*100/65535)),
+		))
+	case temperatureType:
+		if c.Kelvin == 0 {
+			break
+		}
+		ct := KelvinToMired(int(c.Kelvin))
+		if l.Capabilities != nil && l.Capabilities.Control != nil && l.Capabilities.Control.MiredColorTemp != nil {
+			r := l.Capabilities.Control.MiredColorTemp
+			ct = int(math.Max(float64(r.Min), math.Min(float64(r.Max), float64(ct))))
+		}
+		upd.ColorTemperature = IntPtr(ct)
+	}
+	return upd
+}
+
+func lifxLabel(name string) []byte {
+	b := make([]byte, lifxLabelSize)
+	copy(b, name)
+	return b
+}
+
+func lifxPower(on bool) []byte {
+	b := make([]byte, 2)
+	if on {
+		binary.LittleEndian.PutUint16(b, 0xffff)
+	}
+	return b
+}
+
+// lifxServer answers LIFX LAN messages for the lights of the bridge, every
+// light is a LIFX device of its own
+type lifxServer struct {
+	*Server
+	port uint32
+	// pending holds colours set while a light was off, they're applied
+	// when it's turned on
+	pending map[string]lifxHSBK
+	sync.Mutex
+}
+
+// createLIFXListener listens for LIFX LAN messages
+func (s *Server) createLIFXListener() (net.PacketConn, error) {
+	s.config.RLock()
+	address := s.config.lifxAddress
+	s.config.RUnlock()
+	conn, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info(fmt.Sprintf("LIFX LAN server listening on: %s", conn.LocalAddr().String()))
+	return conn, nil
+}
+
+// serveLIFX answers messages until the connection is closed
+func (s *Server) serveLIFX(conn net.PacketConn, quit chan bool) {
+	ls := &lifxServer{
+		Server:  s,
+		port:    uint32(conn.LocalAddr().(*net.UDPAddr).Port),
+		pending: map[string]lifxHSBK{},
+	}
+	buf := make([]byte, lifxBufferSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			s.logger.Warn(fmt.Sprintf("failed to read LIFX LAN message: %v", err))
+			continue
+		}
+		msg, err := parseLIFX(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, reply := range ls.handle(msg, s.getAllLightsFromMQTT()) {
+			if _, err := conn.WriteTo(reply, addr); err != nil {
+				s.logger.Warn(fmt.Sprintf("failed to reply to %s: %v", addr, err))
+			}
+		}
+	}
+}
+
+// handle returns the replies to the message from every light it's for
+func (ls *lifxServer) handle(msg *lifxMessage, lights lights) [][]byte {
+	replies := [][]byte{}
+	for _, l := range lights {
+		if !l.State.Reachable {
+			continue
+		}
+		target := lifxTargetForTopic(l.topic)
+		if !msg.Tagged && msg.Target != (lifxTarget{}) && msg.Target != target {
+			continue
+		}
+		replies = append(replies, ls.handleLight(msg, l, target)...)
+	}
+	return replies
+}
+
+func (ls *lifxServer) handleLight(msg *lifxMessage, l *light, target lifxTarget) [][]byte {
+	replies := [][]byte{}
+	var state []byte
+	var stateType uint16
+	p := msg.Payload
+
+	switch msg.Type {
+	case lifxGetService:
+		b := make([]byte, 5)
+		b[0] = lifxServiceUDP
+		binary.LittleEndian.PutUint32(b[1:5], ls.port)
+		return [][]byte{msg.reply(target, lifxStateService, b)}
+	case lifxGetLabel:
+		return [][]byte{msg.reply(target, lifxStateLabel, lifxLabel(l.Name))}
+	case lifxGetPower, lifxGetLightPower:
+		typ := lifxStatePower
+		if msg.Type == lifxGetLightPower {
+			typ = lifxStateLightPower
+		}
+		return [][]byte{msg.reply(target, typ, lifxPower(l.State.On))}
+	case lifxGet:
+		return [][]byte{msg.reply(target, lifxState, ls.state(l))}
+
+	case lifxSetPower, lifxSetLightPower:
+		if len(p) < 2 {
+			return nil
+		}
+		stateType = lifxStatePower
+		if msg.Type == lifxSetLightPower {
+			stateType = lifxStateLightPower
+		}
+		state = lifxPower(l.State.On)
+		ls.setPower(l, binary.LittleEndian.Uint16(p[0:2]) != 0)
+	case lifxSetColor:
+		if len(p) < 13 {
+			return nil
+		}
+		stateType, state = lifxState, ls.state(l)
+		ls.setColor(l, parseHSBK(p[1:9]))
+	case lifxSetWaveform:
+		if len(p) < 21 {
+			return nil
+		}
+		stateType, state = lifxState, ls.state(l)
+		// Waveforms can't be shown, but a light that isn't transient ends
+		// up with the colour when it's done
+		if p[1] == 0 {
+			ls.setColor(l, parseHSBK(p[2:10]))
+		}
+	default:
+		return nil
+	}
+
+	// Like real devices, the state in the response is from before the
+	// change
+	if msg.AckRequired {
+		replies = append(replies, msg.reply(target, lifxAcknowledgement, nil))
+	}
+	if msg.ResRequired {
+		replies = append(replies, msg.reply(target, stateType, state))
+	}
+	return replies
+}
+
+// state returns the payload of a State message for the light
+func (ls *lifxServer) state(l *light) []byte {
+	b := bytes.NewBuffer(lifxColor(l).bytes())
+	b.Write([]byte{0, 0})
+	b.Write(lifxPower(l.State.On))
+	b.Write(lifxLabel(l.Name))
+	b.Write(make([]byte, 8))
+	return b.Bytes()
+}
+
+// setColor sets the colour of the light, or keeps it until the light is
+// turned on if it's off
+func (ls *lifxServer) setColor(l *light, c lifxHSBK) {
+	if !l.State.On {
+		ls.Lock()
+		ls.pending[l.topic] = c
+		ls.Unlock()
+		return
+	}
+	ls.update(l, lifxStateUpdate(l, c))
+}
+
+// setPower turns the light on or off, applying any colour set while it
+// was off
+func (ls *lifxServer) setPower(l *light, on bool) {
+	upd := &lightStateUpdate{}
+	ls.Lock()
+	if c, ok := ls.pending[l.topic]; ok && on {
+		upd = lifxStateUpdate(l, c)
+		delete(ls.pending, l.topic)
+	}
+	ls.Unlock()
+	upd.On = BoolPtr(on)
+	ls.update(l, upd)
+}
+
+func (ls *lifxServer) update(l *light, upd *lightStateUpdate) {
+	res := ls.updateLightState(l, upd)
+	if len(res.InvalidParameter) > 0 || len(res.InvalidValue) > 0 ||
+		len(res.DeviceUnreachable) > 0 || len(res.DeviceIsOff) > 0 || res.InternalError {
+		ls.logger.Warn(fmt.Sprintf("failed to update %s from LIFX LAN: %+v", l.topic, res))
+	}
+}
@@ -0,0 +1,160 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lifxRequest returns a LIFX LAN message of the type to the target, with
+// both an acknowledgement and a response required
+func lifxRequest(target lifxTarget, typ uint16, payload []byte) []byte {
+	b := lifxHeader{Source: 42, Sequence: 7}.reply(target, typ, payload)
+	if target == (lifxTarget{}) {
+		binary.LittleEndian.PutUint16(b[2:4], lifxProtocol|0x1000|0x2000)
+	}
+	b[22] = 0x03
+	return b
+}
+
+func TestParseLIFX(t *testing.T) {
+	target := lifxTargetForTopic("test/light1")
+	assert.Equal(t, target, lifxTargetForTopic("test/light1"))
+	assert.NotEqual(t, target, lifxTargetForTopic("test/light2"))
+	assert.Equal(t, byte(0x02), target[0]&0x03, "targets should be locally administered unicast addresses")
+	assert.Equal(t, []byte{0, 0}, target[6:8])
+
+	msg, err := parseLIFX(lifxRequest(target, lifxSetColor, make([]byte, 13)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, target, msg.Target)
+	assert.Equal(t, uint32(42), msg.Source)
+	assert.Equal(t, uint8(7), msg.Sequence)
+	assert.Equal(t, lifxSetColor, msg.Type)
+	assert.True(t, msg.AckRequired)
+	assert.True(t, msg.ResRequired)
+	assert.False(t, msg.Tagged)
+	assert.Len(t, msg.Payload, 13)
+
+	msg, err = parseLIFX(lifxRequest(lifxTarget{}, lifxGetService, nil))
+	assert.NoError(t, err)
+	assert.True(t, msg.Tagged)
+
+	_, err = parseLIFX(make([]byte, 20))
+	assert.Error(t, err)
+	b := lifxRequest(target, lifxGet, nil)
+	_, err = parseLIFX(append(b, 0))
+	assert.Error(t, err, "the size has to match")
+}
+
+func TestLIFXColor(t *testing.T) {
+	rgb := &light{Type: rgbType, State: lightState{On: true, Brightness: 254, XY: HemtjanstHStoCIExy(120, 100)}}
+	c := lifxColor(rgb)
+	assert.Equal(t, uint16(65535), c.Brightness)
+	assert.InDelta(t, 21845, int(c.Hue), 200)
+	assert.InDelta(t, 65535, int(c.Saturation), 700)
+
+	upd := lifxStateUpdate(rgb, c)
+	assert.Equal(t, IntPtr(254), upd.Brightness)
+	if assert.NotNil(t, upd.XY) {
+		assert.InDelta(t, rgb.State.XY[0], (*upd.XY)[0], 0.01)
+		assert.InDelta(t, rgb.State.XY[1], (*upd.XY)[1], 0.01)
+	}
+	assert.Nil(t, upd.ColorTemperature)
+
+	ct := &light{Type: temperatureType, State: lightState{Brightness: 1, MiredColorTemp: 250},
+		Capabilities: &lightCapabilities{Control: &lightControl{
+			MiredColorTemp: &lightMiredColorTemperature{Min: 153, Max: 454},
+		}}}
+	c = lifxColor(ct)
+	assert.Equal(t, uint16(0), c.Brightness)
+	assert.Equal(t, uint16(4000), c.Kelvin)
+	upd = lifxStateUpdate(ct, lifxHSBK{Brightness: 0, Kelvin: 1500})
+	assert.Equal(t, IntPtr(1), upd.Brightness)
+	assert.Equal(t, IntPtr(454), upd.ColorTemperature, "colour temperatures should be clamped")
+	assert.Nil(t, upd.XY)
+
+	white := &light{Type: whiteType}
+	upd = lifxStateUpdate(white, lifxHSBK{Hue: 100, Saturation: 100, Brightness: 32768, Kelvin: 3000})
+	assert.Equal(t, IntPtr(128), upd.Brightness)
+	assert.Nil(t, upd.XY)
+	assert.Nil(t, upd.ColorTemperature)
+}
+
+func TestLIFXHandle(t *testing.T) {
+	ls := &lifxServer{
+		Server:  newTestServer(t),
+		port:    56700,
+		pending: map[string]lifxHSBK{},
+	}
+	bulbs := lights{
+		"1": &light{Type: rgbType, Name: "Desk", topic: "test/light1",
+			State: lightState{Reachable: true, Brightness: 254}},
+		"2": &light{Type: whiteType, Name: "Hallway", topic: "test/light2",
+			State: lightState{Reachable: true, On: true, Brightness: 1}},
+		"3": &light{Type: whiteType, Name: "Gone", topic: "test/light3"},
+	}
+	handle := func(target lifxTarget, typ uint16, payload []byte) []*lifxMessage {
+		msg, err := parseLIFX(lifxRequest(target, typ, payload))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		res := []*lifxMessage{}
+		for _, b := range ls.handle(msg, bulbs) {
+			reply, err := parseLIFX(b)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			assert.Equal(t, uint32(42), reply.Source)
+			assert.Equal(t, uint8(7), reply.Sequence)
+			res = append(res, reply)
+		}
+		return res
+	}
+
+	t.Run("discovery", func(t *testing.T) {
+		replies := handle(lifxTarget{}, lifxGetService, nil)
+		assert.Len(t, replies, 2, "unreachable lights shouldn't be found")
+		for _, r := range replies {
+			assert.Equal(t, lifxStateService, r.Type)
+			assert.Equal(t, []byte{lifxServiceUDP, 0x7c, 0xdd, 0x00, 0x00}, r.Payload)
+		}
+	})
+	t.Run("get", func(t *testing.T) {
+		target := lifxTargetForTopic("test/light2")
+		replies := handle(target, lifxGet, nil)
+		if assert.Len(t, replies, 1) {
+			r := replies[0]
+			assert.Equal(t, lifxState, r.Type)
+			assert.Equal(t, target, r.Target)
+			assert.Len(t, r.Payload, 52)
+			assert.Equal(t, []byte{0xff, 0xff}, r.Payload[10:12], "the light is on")
+			assert.Equal(t, "Hallway", string(r.Payload[12:19]))
+		}
+		replies = handle(target, lifxGetLabel, nil)
+		if assert.Len(t, replies, 1) {
+			assert.Equal(t, lifxStateLabel, replies[0].Type)
+		}
+	})
+	t.Run("set colour while off", func(t *testing.T) {
+		target := lifxTargetForTopic("test/light1")
+		c := lifxHSBK{Hue: 1000, Saturation: 65535, Brightness: 65535, Kelvin: 3500}
+		payload := append(append([]byte{0}, c.bytes()...), 0, 0, 0, 0)
+		replies := handle(target, lifxSetColor, payload)
+		if assert.Len(t, replies, 2) {
+			assert.Equal(t, lifxAcknowledgement, replies[0].Type)
+			assert.Empty(t, replies[0].Payload)
+			assert.Equal(t, lifxState, replies[1].Type)
+		}
+		assert.Equal(t, map[string]lifxHSBK{"test/light1": c}, ls.pending,
+			"the colour should be kept until the light is turned on")
+
+		waveform := append([]byte{0, 1}, c.bytes()...)
+		waveform = append(waveform, make([]byte, 11)...)
+		ls.pending = map[string]lifxHSBK{}
+		handle(target, lifxSetWaveform, waveform)
+		assert.Empty(t, ls.pending, "transient waveforms don't change the colour")
+	})
+}
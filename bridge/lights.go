@@ -7,7 +7,7 @@ import (
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
-	"go.uber.org/zap"
+	"lib.hemtjan.st/device"
 	"lib.hemtjan.st/server"
 )
 
@@ -102,8 +102,13 @@ type light struct {
 	Config           *lightConfig         `json:"config"`
 	UUID             string               `json:"uniqueid"`
 	SWVersion        string               `json:"swversion"`
+	SerialNumber     string               `json:"serialnumber,omitempty"`
 
-	topic string
+	topic    string
+	upstream string
+	briRange valueRange
+	ctRange  ctRange
+	cal      *calibration
 }
 
 func (*light) Render(w http.ResponseWriter, r *http.Request) error {
@@ -116,7 +121,7 @@ func (lights) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func newWhiteBulb(dev server.Device) (*light, error) {
+func newWhiteBulb(dev server.Device, p *lightProfile, c *calibration) (*light, error) {
 	on, err := StringToBool(dev.Feature("on").Value())
 	if err != nil {
 		return nil, err
@@ -125,12 +130,15 @@ func newWhiteBulb(dev server.Device) (*light, error) {
 	if err != nil {
 		return nil, err
 	}
+	briRange := featureRange(dev.Feature("brightness"), defaultBrightnessRange)
 
 	l := &light{
-		topic: dev.Info().Topic,
+		topic:    dev.Info().Topic,
+		briRange: briRange,
+		cal:      c,
 		State: lightState{
 			On:         on,
-			Brightness: ToPhilipsBrightness(bri),
+			Brightness: c.philipsBrightness(bri, briRange),
 			Reachable:  dev.IsReachable(),
 			Mode:       "homeautomation",
 			Effect:     "none",
@@ -140,38 +148,24 @@ func newWhiteBulb(dev server.Device) (*light, error) {
 			State:       "noupdates",
 			LastInstall: DateTimeToISO8600(now().UTC()),
 		},
-		Type:             whiteType,
+		Type:             p.Type,
 		Name:             dev.Name(),
-		Model:            whiteModel,
+		Model:            p.Model,
 		ManufacturerName: manufacturer,
-		ProductName:      whiteProductName,
+		ProductName:      p.ProductName,
 		Capabilities: &lightCapabilities{
 			Certified: true,
-			Control: &lightControl{
-				MinDimLevel: 6000,
-				MaxLumen:    900,
-			},
-			Streaming: &lightStreaming{
-				Proxy:    true,
-				Renderer: true,
-			},
-		},
-		Config: &lightConfig{
-			Archetype: "classicbulb",
-			Function:  "functional",
-			Direction: "omnidirectional",
-			Startup: lightStartup{
-				Mode:       "safety",
-				Configured: true,
-			},
+			Control:   p.control(),
+			Streaming: lightStreamingFor(p.Type),
 		},
+		Config:    p.config(),
 		SWVersion: lightSWVersion,
 		UUID:      dev.Info().Topic,
 	}
 	return l, nil
 }
 
-func newColorTemperatureBulb(dev server.Device) (*light, error) {
+func newColorTemperatureBulb(dev server.Device, p *lightProfile, c *calibration) (*light, error) {
 	on, err := StringToBool(dev.Feature("on").Value())
 	if err != nil {
 		return nil, err
@@ -180,17 +174,22 @@ func newColorTemperatureBulb(dev server.Device) (*light, error) {
 	if err != nil {
 		return nil, err
 	}
+	briRange := featureRange(dev.Feature("brightness"), defaultBrightnessRange)
 	ct, err := StringToInt(dev.Feature("colorTemperature").Value())
 	if err != nil {
 		return nil, err
 	}
+	ctRange := colorTemperatureRange(dev.Feature("colorTemperature"), p.CT)
 
 	l := &light{
-		topic: dev.Info().Topic,
+		topic:    dev.Info().Topic,
+		briRange: briRange,
+		cal:      c,
+		ctRange:  ctRange,
 		State: lightState{
 			On:             on,
-			Brightness:     ToPhilipsBrightness(bri),
-			MiredColorTemp: ct,
+			Brightness:     c.philipsBrightness(bri, briRange),
+			MiredColorTemp: c.philipsCT(ct, ctRange),
 			ColorMode:      "ct",
 			Mode:           "homeautomation",
 			Reachable:      dev.IsReachable(),
@@ -201,42 +200,25 @@ func newColorTemperatureBulb(dev server.Device) (*light, error) {
 			State:       "noupdates",
 			LastInstall: DateTimeToISO8600(now().UTC()),
 		},
-		Type:             temperatureType,
+		Type:             p.Type,
 		Name:             dev.Name(),
-		Model:            temperatureModel,
+		Model:            p.Model,
 		ManufacturerName: manufacturer,
-		ProductName:      temperatureProductName,
+		ProductName:      p.ProductName,
 		Capabilities: &lightCapabilities{
 			Certified: true,
-			Control: &lightControl{
-				MinDimLevel: 6000,
-				MaxLumen:    980,
-				MiredColorTemp: &lightMiredColorTemperature{
-					Min: 50,
-					Max: 400,
-				},
-			},
-			Streaming: &lightStreaming{
-				Proxy:    true,
-				Renderer: true,
-			},
-		},
-		Config: &lightConfig{
-			Archetype: "sultanbulb",
-			Function:  "mixed",
-			Direction: "omnidirectional",
-			Startup: lightStartup{
-				Mode:       "safety",
-				Configured: true,
-			},
+			Control:   p.control(),
+			Streaming: lightStreamingFor(p.Type),
 		},
+		Config:    p.config(),
 		SWVersion: lightSWVersion,
 		UUID:      dev.Info().Topic,
 	}
+	l.Capabilities.Control.MiredColorTemp = ctRange.mireds()
 	return l, nil
 }
 
-func newRGBBulb(dev server.Device) (*light, error) {
+func newRGBBulb(dev server.Device, p *lightProfile, c *calibration) (*light, error) {
 	on, err := StringToBool(dev.Feature("on").Value())
 	if err != nil {
 		return nil, err
@@ -245,6 +227,7 @@ func newRGBBulb(dev server.Device) (*light, error) {
 	if err != nil {
 		return nil, err
 	}
+	briRange := featureRange(dev.Feature("brightness"), defaultBrightnessRange)
 	hue, err := StringToInt(dev.Feature("hue").Value())
 	if err != nil {
 		return nil, err
@@ -255,12 +238,14 @@ func newRGBBulb(dev server.Device) (*light, error) {
 	}
 
 	l := &light{
-		topic: dev.Info().Topic,
+		topic:    dev.Info().Topic,
+		briRange: briRange,
+		cal:      c,
 		State: lightState{
 			On:         on,
-			Brightness: ToPhilipsBrightness(bri),
+			Brightness: c.philipsBrightness(bri, briRange),
 			ColorMode:  "xy",
-			XY:         HemtjanstHStoCIExy(hue, sat),
+			XY:         c.philipsXY(hue, sat),
 			Mode:       "homeautomation",
 			Reachable:  dev.IsReachable(),
 			Effect:     "none",
@@ -270,96 +255,152 @@ func newRGBBulb(dev server.Device) (*light, error) {
 			State:       "noupdates",
 			LastInstall: DateTimeToISO8600(now().UTC()),
 		},
-		Type:             rgbType,
+		Type:             p.Type,
 		Name:             dev.Name(),
-		Model:            rgbModel,
+		Model:            p.Model,
 		ManufacturerName: manufacturer,
-		ProductName:      rgbProductName,
+		ProductName:      p.ProductName,
 		Capabilities: &lightCapabilities{
 			Certified: true,
-			Control: &lightControl{
-				MinDimLevel:    6000,
-				MaxLumen:       600,
-				ColorGamutType: "I",
-				ColorGamut: [][]float64{
-					{0.6812357, 0.318186},
-					{0.3918985, 0.5250334},
-					{0.1502415, 0.027116},
-				},
-			},
-			Streaming: &lightStreaming{
-				Proxy:    true,
-				Renderer: true,
-			},
-		},
-		Config: &lightConfig{
-			Archetype: "sultanbulb",
-			Function:  "mixed",
-			Direction: "omnidirectional",
-			Startup: lightStartup{
-				Mode:       "safety",
-				Configured: true,
-			},
+			Control:   p.control(),
+			Streaming: lightStreamingFor(p.Type),
 		},
+		Config:    p.config(),
 		SWVersion: lightSWVersion,
 		UUID:      dev.Info().Topic,
 	}
 	return l, nil
 }
 
-func (s *Server) getAllLightsFromMQTT() lights {
-	devs := s.mqtt.DeviceByType("lightbulb")
-	s.config.Lock()
-	s.config.lights = len(devs)
-	s.config.Unlock()
-	bulbs := lights{}
-	for _, l := range devs {
-		if strings.HasPrefix(l.Info().Topic, "rpi") {
-			continue
-		}
-		var b *light
-		var err error
-		if l.Feature("hue").Exists() || l.Feature("saturation").Exists() {
-			b, err = newRGBBulb(l)
-		} else if l.Feature("colorTemperature").Exists() {
-			b, err = newColorTemperatureBulb(l)
-		} else if l.Feature("brightness").Exists() {
-			b, _ = newWhiteBulb(l)
-		}
-		if err != nil {
-			s.logger.Error(err.Error(), zap.String("device", l.Info().Topic))
-		}
-		if b != nil {
-			bulbs[TopicToStrInt(l.Info().Topic)] = b
-		}
+// setDeviceInfo replaces the impersonated manufacturer and model with what
+// the device announced itself as, and generates a Hue-format unique ID from
+// its serial number, or its topic if it didn't announce one
+func (l *light) setDeviceInfo(info *device.Info) {
+	if info.Manufacturer != "" {
+		l.ManufacturerName = info.Manufacturer
+	}
+	if info.Model != "" {
+		l.Model = lightBulbModel(info.Model)
+	}
+	l.SerialNumber = info.SerialNumber
+	if info.SerialNumber != "" {
+		l.UUID = HueUniqueID(info.SerialNumber)
+	} else {
+		l.UUID = HueUniqueID(info.Topic)
 	}
-	return bulbs
 }
 
-func (s *Server) getLight(id string) *light {
-	devs := s.mqtt.DeviceByType("lightbulb")
+// newLight creates a light for the device, picking the kind of light based
+// on the features it has and the profile it has been mapped to
+func (s *Server) newLight(d server.Device) (*light, error) {
+	topic := d.Info().Topic
+	cal := s.calibrationForLight(topic)
 	var l *light
-	for _, d := range devs {
-		if TopicToStrInt(d.Info().Topic) == id {
-			var err error
-			if d.Feature("hue").Exists() || d.Feature("saturation").Exists() {
-				l, err = newRGBBulb(d)
-			} else if d.Feature("colorTemperature").Exists() {
-				l, err = newColorTemperatureBulb(d)
-			} else if d.Feature("brightness").Exists() {
-				l, err = newWhiteBulb(d)
-			}
-			if err != nil {
-				s.logger.Error(err.Error(), zap.String("device", d.Info().Topic))
-			}
-			break
-		}
+	var err error
+	switch {
+	case d.Feature("hue").Exists() || d.Feature("saturation").Exists():
+		l, err = newRGBBulb(d, s.profileForLight(topic, rgbType), cal)
+	case d.Feature("colorTemperature").Exists():
+		l, err = newColorTemperatureBulb(d, s.profileForLight(topic, temperatureType), cal)
+	case d.Feature("brightness").Exists():
+		l, err = newWhiteBulb(d, s.profileForLight(topic, whiteType), cal)
+	}
+	if l == nil || err != nil {
+		return nil, err
+	}
+	s.identifyLight(l, d)
+	return l, nil
+}
+
+// placeholderLight returns an unreachable light for a device whose state
+// couldn't be read, so it's listed until it can be. It's what the device
+// info and profile say about it, with the state of a light that's off
+func (s *Server) placeholderLight(d server.Device) *light {
+	topic := d.Info().Topic
+	t := whiteType
+	switch {
+	case d.Feature("hue").Exists() || d.Feature("saturation").Exists():
+		t = rgbType
+	case d.Feature("colorTemperature").Exists():
+		t = temperatureType
+	}
+	p := s.profileForLight(topic, t)
+	l := &light{
+		topic:    topic,
+		briRange: featureRange(d.Feature("brightness"), defaultBrightnessRange),
+		cal:      s.calibrationForLight(topic),
+		State: lightState{
+			Brightness: 1,
+			Mode:       "homeautomation",
+			Effect:     "none",
+			Alert:      "none",
+		},
+		Type:             p.Type,
+		Name:             d.Name(),
+		Model:            p.Model,
+		ManufacturerName: manufacturer,
+		ProductName:      p.ProductName,
+		Capabilities: &lightCapabilities{
+			Certified: true,
+			Control:   p.control(),
+			Streaming: lightStreamingFor(p.Type),
+		},
+		Config:    p.config(),
+		SWVersion: lightSWVersion,
+		UUID:      topic,
 	}
+	s.identifyLight(l, d)
 	return l
 }
 
+// identifyLight sets the name and unique ID of the light the way the bridge
+// is configured to
+func (s *Server) identifyLight(l *light, d server.Device) {
+	topic := d.Info().Topic
+	s.config.RLock()
+	report := s.config.reportDeviceInfo
+	alexa := s.config.alexa
+	s.config.RUnlock()
+	if alexa {
+		l.Name = alexaName(l.Name, fmt.Sprintf("Light %s", s.lightID(topic)))
+		l.UUID = HueUniqueID(topic)
+	}
+	if report {
+		l.setDeviceInfo(d.Info())
+	}
+}
+
+func (s *Server) getAllLightsFromMQTT() lights {
+	return s.refreshLights()
+}
+
+// getAllLights returns the lights on Hemtjanst together with those
+// imported from the upstream bridge
+func (s *Server) getAllLights() lights {
+	ls := s.refreshLights()
+	for id, l := range s.upstreamLights() {
+		ls[id] = l
+	}
+	return ls
+}
+
+// upstreamLights returns the lights imported from the upstream bridge by
+// the ID they have here. They get one like the Hemtjanst lights do, so it
+// fits in an int32 and is small in Alexa mode
+func (s *Server) upstreamLights() lights {
+	ls := lights{}
+	for id, l := range s.upstream.getLights() {
+		ls[s.lightID(upstreamTopic("lights", id))] = l
+	}
+	return ls
+}
+
+func (s *Server) getLight(id string) *light {
+	return s.getAllLights()[id]
+}
+
 func (s *Server) getLights(w http.ResponseWriter, r *http.Request) {
-	bulbs := s.getAllLightsFromMQTT()
+	bulbs := scopeFromRequest(r).filterLights(s.getAllLights())
 	renderOK(w, r, bulbs)
 }
 
@@ -404,10 +445,29 @@ type lightStateUpdate struct {
 	ColorTemperatureInc *int       `json:"ct_inc"`
 	XYInc               *[]float64 `json:"xy_inc"`
 
-	no []string
+	no      []string
+	lenient bool
 }
 
 func (upd *lightStateUpdate) Bind(r *http.Request) error {
+	if isLenient(r) {
+		upd.lenient = true
+		upd.TransitionTime = nil
+		upd.Alert = nil
+		upd.Effect = nil
+		if upd.XY == nil && (upd.Hue != nil || upd.Saturation != nil) {
+			hue, sat := 0, 254
+			if upd.Hue != nil {
+				hue = *upd.Hue
+			}
+			if upd.Saturation != nil {
+				sat = *upd.Saturation
+			}
+			upd.XY = FloatPtr(HemtjanstHStoCIExy(hue*360/65536, sat*100/254))
+		}
+		upd.Hue = nil
+		upd.Saturation = nil
+	}
 	if upd.Hue != nil {
 		upd.no = append(upd.no, "hue")
 	}
@@ -466,10 +526,12 @@ func (s *Server) lightUpdateState(w http.ResponseWriter, r *http.Request) {
 }
 
 type lightUpdateStateResult struct {
-	DeviceIsOff      []string
-	InternalError    bool
-	InvalidParameter []string
-	Success          map[string]interface{}
+	DeviceIsOff       []string
+	DeviceUnreachable []string
+	InternalError     bool
+	InvalidParameter  []string
+	InvalidValue      map[string]interface{}
+	Success           map[string]interface{}
 }
 
 func (s *Server) renderLightStateUpdate(l *lightUpdateStateResult, group bool, id string) []render.Renderer {
@@ -489,12 +551,24 @@ func (s *Server) renderLightStateUpdate(l *lightUpdateStateResult, group bool, i
 		}
 		return list
 	}
+	if len(l.DeviceUnreachable) > 0 {
+		for _, p := range l.DeviceUnreachable {
+			list = append(list, errDeviceUnreachable(resource, p))
+		}
+		return list
+	}
 	if len(l.DeviceIsOff) > 0 {
 		for _, p := range l.DeviceIsOff {
 			list = append(list, errDeviceIsOff(resource, p))
 		}
 		return list
 	}
+	if len(l.InvalidValue) > 0 {
+		for p, v := range l.InvalidValue {
+			list = append(list, errInvalidValueforParam(resource, p, fmt.Sprint(v)))
+		}
+		return list
+	}
 	if l.InternalError {
 		return renderAsList(errInternalError(resource, "100"))
 	}
@@ -508,7 +582,69 @@ func (s *Server) renderLightStateUpdate(l *lightUpdateStateResult, group bool, i
 	return list
 }
 
+// params returns the names of the parameters set in the update
+func (upd *lightStateUpdate) params() []string {
+	params := []string{}
+	for _, p := range []struct {
+		name string
+		set  bool
+	}{
+		{"on", upd.On != nil},
+		{"bri", upd.Brightness != nil},
+		{"xy", upd.XY != nil},
+		{"ct", upd.ColorTemperature != nil},
+		{"bri_inc", upd.BrightnessInc != nil},
+		{"xy_inc", upd.XYInc != nil},
+		{"ct_inc", upd.ColorTemperatureInc != nil},
+	} {
+		if p.set {
+			params = append(params, p.name)
+		}
+	}
+	return params
+}
+
+// clampValues clamps the values in the update to what the Hue API, and
+// this light, accept
+func (l *light) clampValues(state *lightStateUpdate) {
+	if state.Brightness != nil {
+		state.Brightness = IntPtr(valueRange{Min: 0, Max: 254}.snap(*state.Brightness))
+	}
+	if state.ColorTemperature != nil && l.Capabilities != nil && l.Capabilities.Control.MiredColorTemp != nil {
+		ct := l.Capabilities.Control.MiredColorTemp
+		state.ColorTemperature = IntPtr(valueRange{Min: ct.Min, Max: ct.Max}.snap(*state.ColorTemperature))
+	}
+}
+
+// invalidValues returns the parameters in the update whose values fall
+// outside of what the Hue API, or this light, accepts
+func (l *light) invalidValues(state *lightStateUpdate) map[string]interface{} {
+	invalid := map[string]interface{}{}
+	if state.Brightness != nil && (*state.Brightness < 0 || *state.Brightness > 254) {
+		invalid["bri"] = *state.Brightness
+	}
+	if state.BrightnessInc != nil && (*state.BrightnessInc < -254 || *state.BrightnessInc > 254) {
+		invalid["bri_inc"] = *state.BrightnessInc
+	}
+	if l.Capabilities != nil && l.Capabilities.Control.MiredColorTemp != nil {
+		ct := l.Capabilities.Control.MiredColorTemp
+		r := valueRange{Min: ct.Min, Max: ct.Max}
+		if state.ColorTemperature != nil && !r.contains(*state.ColorTemperature) {
+			invalid["ct"] = *state.ColorTemperature
+		}
+		if state.ColorTemperatureInc != nil &&
+			(*state.ColorTemperatureInc < -65534 || *state.ColorTemperatureInc > 65534) {
+			invalid["ct_inc"] = *state.ColorTemperatureInc
+		}
+	}
+	return invalid
+}
+
 func (s *Server) updateLightState(light *light, state *lightStateUpdate) *lightUpdateStateResult {
+	if light.upstream != "" {
+		return s.upstream.updateLightState(light, state)
+	}
+
 	d := s.mqtt.Device(light.topic)
 	lUpdate := &lightUpdateStateResult{
 		Success: map[string]interface{}{},
@@ -547,6 +683,11 @@ func (s *Server) updateLightState(light *light, state *lightStateUpdate) *lightU
 		return lUpdate
 	}
 
+	if !light.State.Reachable {
+		lUpdate.DeviceUnreachable = state.params()
+		return lUpdate
+	}
+
 	on := false
 	if d.Feature("on").Value() == "1" {
 		on = true
@@ -575,22 +716,30 @@ func (s *Server) updateLightState(light *light, state *lightStateUpdate) *lightU
 		return lUpdate
 	}
 
+	if state.lenient {
+		light.clampValues(state)
+	}
+	lUpdate.InvalidValue = light.invalidValues(state)
+	if len(lUpdate.InvalidValue) > 0 {
+		return lUpdate
+	}
+
 	/// Turn on first so any other characteristic updates will propagate
 	if !on && state.On != nil && *state.On {
 		d.Feature("on").Set("1")
 		lUpdate.Success["on"] = true
 	}
 	if state.Brightness != nil {
-		d.Feature("brightness").Set(IntToStr(ToHemtjanstBrightness(*state.Brightness)))
+		d.Feature("brightness").Set(IntToStr(light.cal.hemtjanstBrightness(*state.Brightness, light.briRange)))
 		lUpdate.Success["bri"] = *state.Brightness
 	}
 	if state.ColorTemperature != nil {
-		d.Feature("colorTemperature").Set(IntToStr(*state.ColorTemperature))
+		d.Feature("colorTemperature").Set(IntToStr(light.cal.hemtjanstCT(*state.ColorTemperature, light.ctRange)))
 		lUpdate.Success["ct"] = *state.ColorTemperature
 	}
 	if state.XY != nil {
 		dt := *state.XY
-		hue, sat := CIExyToHemtjanstHS(dt[0], dt[1])
+		hue, sat := light.cal.hemtjanstHS(dt[0], dt[1])
 		d.Feature("hue").Set(IntToStr(hue))
 		d.Feature("saturation").Set(IntToStr(sat))
 		lUpdate.Success["xy"] = *state.XY
@@ -601,7 +750,8 @@ func (s *Server) updateLightState(light *light, state *lightStateUpdate) *lightU
 			lUpdate.InternalError = true
 			return lUpdate
 		}
-		d.Feature("brightness").Set(IntToStr(ToHemtjanstBrightness(ToPhilipsBrightness(v) + *state.BrightnessInc)))
+		bri := philipsBrightnessRange.snap(light.cal.philipsBrightness(v, light.briRange) + *state.BrightnessInc)
+		d.Feature("brightness").Set(IntToStr(light.cal.hemtjanstBrightness(bri, light.briRange)))
 		lUpdate.Success["bri_inc"] = *state.BrightnessInc
 	}
 	if state.ColorTemperatureInc != nil {
@@ -610,7 +760,8 @@ func (s *Server) updateLightState(light *light, state *lightStateUpdate) *lightU
 			lUpdate.InternalError = true
 			return lUpdate
 		}
-		d.Feature("colorTemperature").Set(IntToStr(v + *state.ColorTemperatureInc))
+		d.Feature("colorTemperature").Set(IntToStr(
+			light.cal.hemtjanstCT(light.cal.philipsCT(v, light.ctRange)+*state.ColorTemperatureInc, light.ctRange)))
 		lUpdate.Success["ct_inc"] = *state.ColorTemperatureInc
 	}
 	if state.XYInc != nil {
@@ -625,8 +776,8 @@ func (s *Server) updateLightState(light *light, state *lightStateUpdate) *lightU
 			lUpdate.InternalError = true
 			return lUpdate
 		}
-		xy := HemtjanstHStoCIExy(hue, sat)
-		xN, yN := CIExyToHemtjanstHS(xy[0]+dt[0], xy[1]+dt[1])
+		xy := light.cal.philipsXY(hue, sat)
+		xN, yN := light.cal.hemtjanstHS(xy[0]+dt[0], xy[1]+dt[1])
 		d.Feature("hue").Set(IntToStr(xN))
 		d.Feature("saturation").Set(IntToStr(yN))
 		lUpdate.Success["xy_inc"] = *state.XYInc
@@ -10,9 +10,21 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"lib.hemtjan.st/device"
 	"lib.hemtjan.st/testutils"
 )
 
+// reachableLights filters out the lights left behind by previous tests
+func reachableLights(ls lights) lights {
+	res := lights{}
+	for id, l := range ls {
+		if l.State.Reachable {
+			res[id] = l
+		}
+	}
+	return res
+}
+
 func TestGetAllLights(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	b, shutdown := NewTestingBridge(t, nil)
@@ -28,7 +40,7 @@ func TestGetAllLights(t *testing.T) {
 
 		b.mqtt.WaitForDevice(ctx, "test/light1")
 
-		lights := b.getAllLightsFromMQTT()
+		lights := reachableLights(b.getAllLightsFromMQTT())
 		assert.Len(t, lights, 1)
 		l, ok := lights[TopicToStrInt("test/light1")]
 		assert.True(t, ok)
@@ -47,7 +59,7 @@ func TestGetAllLights(t *testing.T) {
 
 		b.mqtt.WaitForDevice(ctx, "test/light2")
 
-		lights := b.getAllLightsFromMQTT()
+		lights := reachableLights(b.getAllLightsFromMQTT())
 		assert.Len(t, lights, 1)
 		l, ok := lights[TopicToStrInt("test/light2")]
 		assert.True(t, ok)
@@ -67,7 +79,7 @@ func TestGetAllLights(t *testing.T) {
 
 		b.mqtt.WaitForDevice(ctx, "test/light3")
 
-		lights := b.getAllLightsFromMQTT()
+		lights := reachableLights(b.getAllLightsFromMQTT())
 		assert.Len(t, lights, 1)
 		l, ok := lights[TopicToStrInt("test/light3")]
 		assert.True(t, ok)
@@ -78,6 +90,23 @@ func TestGetAllLights(t *testing.T) {
 		assert.Equal(t, 2, l.State.Brightness)
 		assert.Equal(t, []float64{0.3000000083898227, 0.6000000167796454}, l.State.XY)
 	})
+	t.Run("unreadable bulb", func(t *testing.T) {
+		clf, m := NewTestingTransport(t, nil)
+		defer clf()
+		cleanup, err := testutils.DevicesFromJSON("./testing_data/light-broken.json", m)
+		assert.NoError(t, err)
+		defer cleanup()
+
+		b.mqtt.WaitForDevice(ctx, "test/light4")
+
+		l, ok := b.getAllLightsFromMQTT()[TopicToStrInt("test/light4")]
+		if assert.True(t, ok, "a light whose state can't be read should still be listed") {
+			assert.False(t, l.State.Reachable)
+			assert.Equal(t, "Broken Light", l.Name)
+			assert.Equal(t, whiteType, l.Type)
+			assert.Equal(t, whiteModel, l.Model)
+		}
+	})
 	t.Run("through the API", func(t *testing.T) {
 		clf, m := NewTestingTransport(t, nil)
 		defer clf()
@@ -248,6 +277,19 @@ func TestLightStateUpdate(t *testing.T) {
 
 	username := registerTestingUser(t, b)
 
+	t.Run("unreachable light", func(t *testing.T) {
+		lt := b.getLight(TopicToStrInt("test/light1"))
+		assert.NotNil(t, lt)
+		unreachable := *lt
+		unreachable.State.Reachable = false
+		res := b.updateLightState(&unreachable, &lightStateUpdate{On: BoolPtr(true), Brightness: IntPtr(10)})
+		assert.Equal(t, []string{"on", "bri"}, res.DeviceUnreachable)
+		assert.Len(t, res.Success, 0)
+
+		rendered := b.renderLightStateUpdate(res, false, TopicToStrInt("test/light1"))
+		assert.Len(t, rendered, 2)
+		assert.Equal(t, 201, rendered[0].(*errorResp).Error.Type)
+	})
 	t.Run("invalid light", func(t *testing.T) {
 		q, err := json.Marshal(lightStateUpdate{On: BoolPtr(true)})
 		assert.NoError(t, err)
@@ -480,7 +522,7 @@ func TestLightStateUpdate(t *testing.T) {
 	})
 	t.Run("change ct", func(t *testing.T) {
 		cases := map[string]lightStateUpdate{
-			"colorTemp":     lightStateUpdate{On: BoolPtr(true), ColorTemperature: IntPtr(10)},
+			"colorTemp":     lightStateUpdate{On: BoolPtr(true), ColorTemperature: IntPtr(200)},
 			"colorTemp_inc": lightStateUpdate{On: BoolPtr(true), ColorTemperatureInc: IntPtr(10)},
 		}
 		for name, c := range cases {
@@ -505,6 +547,34 @@ func TestLightStateUpdate(t *testing.T) {
 			})
 		}
 	})
+	t.Run("invalid value", func(t *testing.T) {
+		cases := map[string]struct {
+			topic string
+			upd   lightStateUpdate
+		}{
+			"bri": {"test/light1", lightStateUpdate{On: BoolPtr(true), Brightness: IntPtr(300)}},
+			"ct":  {"test/light2", lightStateUpdate{On: BoolPtr(true), ColorTemperature: IntPtr(10)}},
+		}
+		for name, c := range cases {
+			t.Run(name, func(t *testing.T) {
+				upd := c.upd
+				lt := b.getLight(TopicToStrInt(c.topic))
+				assert.NotNil(t, lt)
+				res := b.updateLightState(lt, &upd)
+				assert.Len(t, res.InvalidValue, 1)
+				assert.Len(t, res.Success, 0)
+
+				q, err := json.Marshal(c.upd)
+				assert.NoError(t, err)
+				st, body := tReq(t, b, http.MethodPut, fmt.Sprintf("/api/%s/lights/%s/state", username, TopicToStrInt(c.topic)), q)
+				assert.Equal(t, http.StatusOK, st)
+				dec := []*errorResp{}
+				err = json.Unmarshal(body, &dec)
+				assert.NoError(t, err)
+				assert.Equal(t, 7, dec[0].Error.Type)
+			})
+		}
+	})
 	t.Run("change xy", func(t *testing.T) {
 		cases := map[string]lightStateUpdate{
 			"xy":     lightStateUpdate{On: BoolPtr(true), XY: FloatPtr([]float64{1, 1})},
@@ -592,6 +662,17 @@ func TestRenderLightStateUpdate(t *testing.T) {
 			assert.Len(t, res, 1)
 		})
 	})
+	t.Run("invalid value", func(t *testing.T) {
+		upd := &lightUpdateStateResult{InvalidValue: map[string]interface{}{"ct": 10}}
+		t.Run("group=false", func(t *testing.T) {
+			res := b.renderLightStateUpdate(upd, false, "test1")
+			assert.Len(t, res, 1)
+		})
+		t.Run("group=true", func(t *testing.T) {
+			res := b.renderLightStateUpdate(upd, true, "test1")
+			assert.Len(t, res, 1)
+		})
+	})
 	t.Run("success", func(t *testing.T) {
 		upd := &lightUpdateStateResult{Success: map[string]interface{}{
 			"on": true,
@@ -606,3 +687,40 @@ func TestRenderLightStateUpdate(t *testing.T) {
 		})
 	})
 }
+
+func TestSetDeviceInfo(t *testing.T) {
+	newTestLight := func() *light {
+		return &light{
+			Model:            rgbModel,
+			ManufacturerName: manufacturer,
+			UUID:             "test/light1",
+		}
+	}
+	t.Run("announced", func(t *testing.T) {
+		l := newTestLight()
+		l.setDeviceInfo(&device.Info{
+			Topic:        "test/light1",
+			Manufacturer: "IKEA",
+			Model:        "TRADFRI bulb E27 CWS opal 600lm",
+			SerialNumber: "000d6ffffe123456",
+		})
+		assert.Equal(t, "IKEA", l.ManufacturerName)
+		assert.Equal(t, lightBulbModel("TRADFRI bulb E27 CWS opal 600lm"), l.Model)
+		assert.Equal(t, "000d6ffffe123456", l.SerialNumber)
+		assert.Equal(t, HueUniqueID("000d6ffffe123456"), l.UUID)
+	})
+	t.Run("nothing announced", func(t *testing.T) {
+		l := newTestLight()
+		l.setDeviceInfo(&device.Info{Topic: "test/light1"})
+		assert.Equal(t, manufacturer, l.ManufacturerName)
+		assert.Equal(t, rgbModel, l.Model)
+		assert.Equal(t, "", l.SerialNumber)
+		assert.Equal(t, HueUniqueID("test/light1"), l.UUID)
+	})
+	t.Run("unique ID format", func(t *testing.T) {
+		id := HueUniqueID("test/light1")
+		assert.Equal(t, id, HueUniqueID("test/light1"))
+		assert.NotEqual(t, id, HueUniqueID("test/light2"))
+		assert.Regexp(t, `^00:17:88:01(:[0-9a-f]{2}){4}-0b$`, id)
+	})
+}
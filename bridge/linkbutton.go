@@ -0,0 +1,66 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// LinkButtonWindow is how long the link button stays pressed. New users can
+// only register while it is
+const LinkButtonWindow = 30 * time.Second
+
+// linkButtonFeature is the feature of a Hemtjanst button that's updated
+// when it's pushed
+const linkButtonFeature = "programmableSwitchEvent"
+
+// linkButtonPressed returns whether the link button is pressed at t. The
+// caller must hold the lock
+func (c *Config) linkButtonPressed(t time.Time) bool {
+	return t.Before(c.linkButtonUntil)
+}
+
+// PressLinkButton opens the pairing window for LinkButtonWindow, source is
+// what pressed it and is only used for logging. It returns when the window
+// closes again
+func (s *Server) PressLinkButton(source string) time.Time {
+	until := now().Add(LinkButtonWindow)
+	s.config.Lock()
+	s.config.linkButtonUntil = until
+	s.config.Unlock()
+	s.logger.Info(fmt.Sprintf("link button pressed by %s, pairing until %s",
+		source, DateTimeToISO8600(until.UTC())))
+	return until
+}
+
+// ReleaseLinkButton closes the pairing window before LinkButtonWindow has
+// passed, source is what released it and is only used for logging
+func (s *Server) ReleaseLinkButton(source string) {
+	s.config.Lock()
+	s.config.linkButtonUntil = time.Time{}
+	s.config.Unlock()
+	s.logger.Info(fmt.Sprintf("link button released by %s", source))
+}
+
+// watchLinkButtonDevice presses the link button whenever the configured
+// Hemtjanst button is pushed
+func (s *Server) watchLinkButtonDevice(ctx context.Context, topic string) {
+	d := s.mqtt.WaitForDevice(ctx, topic)
+	if d == nil {
+		return
+	}
+	ft := d.Feature(linkButtonFeature)
+	if !ft.Exists() {
+		s.logger.Error(fmt.Sprintf(
+			"link button device %s has no %s feature", topic, linkButtonFeature))
+		return
+	}
+	err := ft.OnUpdateFunc(func(string) {
+		s.PressLinkButton(fmt.Sprintf("button %s", topic))
+	})
+	if err != nil {
+		s.logger.Error(err.Error())
+		return
+	}
+	s.logger.Info(fmt.Sprintf("using %s as link button", topic))
+}
@@ -3,6 +3,7 @@ package bridge
 import (
 	"context"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi"
 )
@@ -30,12 +31,15 @@ func (s *Server) Authenticate(next http.Handler) http.Handler {
 		auth := s.config.authDisabled
 		s.config.RLock()
 		wt := *s.config.Whitelist
-		if _, ok := wt[userID]; ok {
+		entry, known := wt[userID]
+		s.config.RUnlock()
+		if known {
 			auth = true
+			s.usage.touch(userID, now())
 		}
-		s.config.RUnlock()
 
 		ctx = context.WithValue(ctx, AuthenticatedCtxKey, auth)
+		ctx = context.WithValue(ctx, ScopeCtxKey, entry.Scope)
 		r = r.WithContext(ctx)
 
 		if !auth && infoFromRequest(r).resource != "/config" {
@@ -46,3 +50,45 @@ func (s *Server) Authenticate(next http.Handler) http.Handler {
 	}
 	return http.HandlerFunc(fn)
 }
+
+// RestrictHTTP enforces the restrictions configured for the API when it's
+// served over plain HTTP
+func (s *Server) RestrictHTTP(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		s.config.RLock()
+		mode := s.config.httpAPIMode
+		routes := s.config.httpAPIRoutes
+		s.config.RUnlock()
+
+		if mode == HTTPAPIReadOnly {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				renderListOK(w, r, errMethod(r))
+				return
+			}
+		}
+
+		resource := infoFromRequest(r).resource
+		if resource == "/config" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(routes) > 0 {
+			allowed := false
+			for _, route := range routes {
+				if resource == route || strings.HasPrefix(resource, route+"/") {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				renderListOK(w, r, errInvalidResource(r))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,66 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestrictHTTP(t *testing.T) {
+	newRouter := func(t *testing.T, opts ...ConfigOption) http.Handler {
+		s := newTestServer(t, opts...)
+		ok := func(w http.ResponseWriter, r *http.Request) {
+			renderListOK(w, r, &successResp{Success: map[string]interface{}{"ok": true}})
+		}
+		r := chi.NewRouter()
+		r.Route("/api/{userID}", func(r chi.Router) {
+			r.Use(render.SetContentType(render.ContentTypeJSON))
+			r.Use(s.RestrictHTTP)
+			r.Get("/config", ok)
+			r.Get("/lights", ok)
+			r.Put("/lights/{lightID}/state", ok)
+			r.Get("/groups", ok)
+		})
+		return r
+	}
+	req := func(t *testing.T, h http.Handler, method, path string) []map[string]interface{} {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		dec := []map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &dec); err != nil {
+			t.Fatalf(err.Error())
+		}
+		return dec
+	}
+	errType := func(resp []map[string]interface{}) float64 {
+		e, ok := resp[0]["error"].(map[string]interface{})
+		if !ok {
+			return 0
+		}
+		return e["type"].(float64)
+	}
+
+	t.Run("full", func(t *testing.T) {
+		h := newRouter(t)
+		assert.Equal(t, 0.0, errType(req(t, h, http.MethodGet, "/api/user/lights")))
+		assert.Equal(t, 0.0, errType(req(t, h, http.MethodPut, "/api/user/lights/1/state")))
+	})
+	t.Run("read-only", func(t *testing.T) {
+		h := newRouter(t, HTTPAPI("read-only"))
+		assert.Equal(t, 0.0, errType(req(t, h, http.MethodGet, "/api/user/lights")))
+		assert.Equal(t, 4.0, errType(req(t, h, http.MethodPut, "/api/user/lights/1/state")))
+	})
+	t.Run("routes", func(t *testing.T) {
+		h := newRouter(t, HTTPAPIRoutes("lights", " /lightsaber"))
+		assert.Equal(t, 0.0, errType(req(t, h, http.MethodGet, "/api/user/config")))
+		assert.Equal(t, 0.0, errType(req(t, h, http.MethodGet, "/api/user/lights")))
+		assert.Equal(t, 0.0, errType(req(t, h, http.MethodPut, "/api/user/lights/1/state")))
+		assert.Equal(t, 3.0, errType(req(t, h, http.MethodGet, "/api/user/groups")))
+	})
+}
@@ -0,0 +1,251 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// lightProfile describes the Philips hardware a light impersonates. It
+// determines what the Hue apps show for a light: the icon (archetype), the
+// product name, the colour gamut and colour temperature limits and how
+// bright the fixture is.
+type lightProfile struct {
+	Model       lightBulbModel
+	Type        lightBulbType
+	ProductName lightBulbProductName
+	Archetype   string
+	Function    string
+	Direction   string
+	MinDimLevel int
+	MaxLumen    int
+	GamutType   lightBulbGamut
+	Gamut       [][]float64
+	CT          *lightMiredColorTemperature
+}
+
+var (
+	gamutA = [][]float64{{0.704, 0.296}, {0.2151, 0.7106}, {0.138, 0.08}}
+	gamutB = [][]float64{{0.675, 0.322}, {0.409, 0.518}, {0.167, 0.04}}
+	gamutC = [][]float64{{0.6915, 0.3083}, {0.17, 0.7}, {0.1532, 0.0475}}
+)
+
+// lightProfiles is the catalogue of hardware we know how to impersonate,
+// keyed on the model ID
+var lightProfiles = map[lightBulbModel]*lightProfile{
+	// Dimmable lights
+	whiteModel: {
+		Model: whiteModel, Type: whiteType, ProductName: whiteProductName,
+		Archetype: "classicbulb", Function: "functional", Direction: "omnidirectional",
+		MinDimLevel: 6000, MaxLumen: 900,
+	},
+	"LWB010": {
+		Model: "LWB010", Type: whiteType, ProductName: "Hue white lamp",
+		Archetype: "classicbulb", Function: "functional", Direction: "omnidirectional",
+		MinDimLevel: 5000, MaxLumen: 806,
+	},
+	"LWA001": {
+		Model: "LWA001", Type: whiteType, ProductName: "Hue white lamp",
+		Archetype: "classicbulb", Function: "functional", Direction: "omnidirectional",
+		MinDimLevel: 5000, MaxLumen: 800,
+	},
+	"LWG004": {
+		Model: "LWG004", Type: whiteType, ProductName: "Hue white spot",
+		Archetype: "spotbulb", Function: "functional", Direction: "downwards",
+		MinDimLevel: 5000, MaxLumen: 350,
+	},
+	"LWF001": {
+		Model: "LWF001", Type: whiteType, ProductName: "Hue filament bulb",
+		Archetype: "vintagebulb", Function: "decorative", Direction: "omnidirectional",
+		MinDimLevel: 5000, MaxLumen: 550,
+	},
+
+	// Colour temperature lights
+	temperatureModel: {
+		Model: temperatureModel, Type: temperatureType, ProductName: temperatureProductName,
+		Archetype: "sultanbulb", Function: "mixed", Direction: "omnidirectional",
+		MinDimLevel: 6000, MaxLumen: 980,
+		CT: &lightMiredColorTemperature{Min: 50, Max: 400},
+	},
+	"LTA001": {
+		Model: "LTA001", Type: temperatureType, ProductName: "Hue white ambiance lamp",
+		Archetype: "classicbulb", Function: "mixed", Direction: "omnidirectional",
+		MinDimLevel: 200, MaxLumen: 800,
+		CT: &lightMiredColorTemperature{Min: 153, Max: 454},
+	},
+	"LTG002": {
+		Model: "LTG002", Type: temperatureType, ProductName: "Hue ambiance spot",
+		Archetype: "spotbulb", Function: "mixed", Direction: "downwards",
+		MinDimLevel: 200, MaxLumen: 350,
+		CT: &lightMiredColorTemperature{Min: 153, Max: 454},
+	},
+	"LTW012": {
+		Model: "LTW012", Type: temperatureType, ProductName: "Hue ambiance candle",
+		Archetype: "candlebulb", Function: "mixed", Direction: "omnidirectional",
+		MinDimLevel: 1000, MaxLumen: 470,
+		CT: &lightMiredColorTemperature{Min: 153, Max: 454},
+	},
+
+	// Colour lights
+	rgbModel: {
+		Model: rgbModel, Type: rgbType, ProductName: rgbProductName,
+		Archetype: "sultanbulb", Function: "mixed", Direction: "omnidirectional",
+		MinDimLevel: 6000, MaxLumen: 600,
+		GamutType: "I",
+		Gamut: [][]float64{
+			{0.6812357, 0.318186},
+			{0.3918985, 0.5250334},
+			{0.1502415, 0.027116},
+		},
+	},
+	"LCT015": {
+		Model: "LCT015", Type: rgbType, ProductName: "Hue color lamp",
+		Archetype: "sultanbulb", Function: "mixed", Direction: "omnidirectional",
+		MinDimLevel: 1000, MaxLumen: 806,
+		GamutType: "C", Gamut: gamutC,
+	},
+	"LCA001": {
+		Model: "LCA001", Type: rgbType, ProductName: "Hue color lamp",
+		Archetype: "sultanbulb", Function: "mixed", Direction: "omnidirectional",
+		MinDimLevel: 200, MaxLumen: 800,
+		GamutType: "C", Gamut: gamutC,
+	},
+	"LCT003": {
+		Model: "LCT003", Type: rgbType, ProductName: "Hue spot GU10",
+		Archetype: "spotbulb", Function: "mixed", Direction: "downwards",
+		MinDimLevel: 5000, MaxLumen: 250,
+		GamutType: "B", Gamut: gamutB,
+	},
+	"LCG002": {
+		Model: "LCG002", Type: rgbType, ProductName: "Hue color spot",
+		Archetype: "spotbulb", Function: "mixed", Direction: "downwards",
+		MinDimLevel: 1000, MaxLumen: 350,
+		GamutType: "C", Gamut: gamutC,
+	},
+	"LCT012": {
+		Model: "LCT012", Type: rgbType, ProductName: "Hue color candle",
+		Archetype: "candlebulb", Function: "mixed", Direction: "omnidirectional",
+		MinDimLevel: 1000, MaxLumen: 470,
+		GamutType: "C", Gamut: gamutC,
+	},
+	"LST001": {
+		Model: "LST001", Type: rgbType, ProductName: "Hue lightstrip",
+		Archetype: "huelightstrip", Function: "decorative", Direction: "omnidirectional",
+		MinDimLevel: 5000, MaxLumen: 120,
+		GamutType: "A", Gamut: gamutA,
+	},
+	"LST002": {
+		Model: "LST002", Type: rgbType, ProductName: "Hue lightstrip plus",
+		Archetype: "huelightstrip", Function: "mixed", Direction: "omnidirectional",
+		MinDimLevel: 40, MaxLumen: 1600,
+		GamutType: "C", Gamut: gamutC,
+	},
+	"LLC020": {
+		Model: "LLC020", Type: rgbType, ProductName: "Hue go",
+		Archetype: "huego", Function: "decorative", Direction: "omnidirectional",
+		MinDimLevel: 1000, MaxLumen: 300,
+		GamutType: "C", Gamut: gamutC,
+	},
+}
+
+// defaultProfiles is what we fall back to when a light has not been mapped
+// to a profile, or has been mapped to one it can't support
+var defaultProfiles = map[lightBulbType]*lightProfile{
+	whiteType:       lightProfiles[whiteModel],
+	temperatureType: lightProfiles[temperatureModel],
+	rgbType:         lightProfiles[rgbModel],
+}
+
+// control returns the capabilities.control section for this profile
+func (p *lightProfile) control() *lightControl {
+	c := &lightControl{
+		MinDimLevel:    p.MinDimLevel,
+		MaxLumen:       p.MaxLumen,
+		ColorGamutType: p.GamutType,
+		ColorGamut:     p.Gamut,
+	}
+	if p.CT != nil {
+		c.MiredColorTemp = &lightMiredColorTemperature{
+			Min: p.CT.Min,
+			Max: p.CT.Max,
+		}
+	}
+	return c
+}
+
+// config returns the config section for this profile
+func (p *lightProfile) config() *lightConfig {
+	return &lightConfig{
+		Archetype: p.Archetype,
+		Function:  p.Function,
+		Direction: p.Direction,
+		Startup: lightStartup{
+			Mode:       "safety",
+			Configured: true,
+		},
+	}
+}
+
+// profileForLight returns the profile a light with the given topic should
+// use. If the light has been mapped to a profile of a different type than the
+// one we detected from its features, the default profile for the detected
+// type is returned instead
+func (s *Server) profileForLight(topic string, t lightBulbType) *lightProfile {
+	s.config.RLock()
+	model, ok := s.config.lightProfiles[topic]
+	s.config.RUnlock()
+	if !ok {
+		return defaultProfiles[t]
+	}
+	p := lightProfiles[model]
+	if p.Type != t {
+		s.logger.Warn(fmt.Sprintf(
+			"light %s is mapped to profile %s of type %s but is a %s, ignoring",
+			topic, model, p.Type, t))
+		return defaultProfiles[t]
+	}
+	return p
+}
+
+func (s *Server) loadLightProfilesFromFile() (map[string]lightBulbModel, error) {
+	path := s.config.lightProfilesPath
+	if path == "" {
+		return map[string]lightBulbModel{}, nil
+	}
+	if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
+		s.logger.Info(fmt.Sprintf("light profile mapping does not exist at %s", path))
+		return map[string]lightBulbModel{}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contents of %s: %v", path, err)
+	}
+	var mp map[string]lightBulbModel
+	err = json.Unmarshal(data, &mp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s as JSON: %v", path, err)
+	}
+	if err := validateLightProfiles(mp); err != nil {
+		return nil, fmt.Errorf("invalid light profile mapping in %s: %v", path, err)
+	}
+	s.logger.Info(fmt.Sprintf("light profile mapping loaded from: %s", path))
+	return mp, nil
+}
+
+// validateLightProfiles ensures every topic maps to a profile in our
+// catalogue
+func validateLightProfiles(mp map[string]lightBulbModel) error {
+	topics := make([]string, 0, len(mp))
+	for topic := range mp {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		if _, ok := lightProfiles[mp[topic]]; !ok {
+			return fmt.Errorf("unknown profile %s for light %s", mp[topic], topic)
+		}
+	}
+	return nil
+}
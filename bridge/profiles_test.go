@@ -0,0 +1,107 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLightProfiles(t *testing.T) {
+	t.Run("catalogue", func(t *testing.T) {
+		for model, p := range lightProfiles {
+			assert.Equal(t, model, p.Model)
+			assert.NotEmpty(t, p.ProductName, string(model))
+			assert.NotEmpty(t, p.Archetype, string(model))
+			switch p.Type {
+			case whiteType:
+				assert.Nil(t, p.CT, string(model))
+				assert.Nil(t, p.Gamut, string(model))
+			case temperatureType:
+				assert.NotNil(t, p.CT, string(model))
+				assert.Nil(t, p.Gamut, string(model))
+			case rgbType:
+				assert.Len(t, p.Gamut, 3, string(model))
+				assert.NotEmpty(t, p.GamutType, string(model))
+			default:
+				t.Errorf("profile %s has unknown type %s", model, p.Type)
+			}
+		}
+	})
+	t.Run("defaults", func(t *testing.T) {
+		for typ, p := range defaultProfiles {
+			assert.Equal(t, typ, p.Type)
+		}
+	})
+	t.Run("validate", func(t *testing.T) {
+		assert.NoError(t, validateLightProfiles(map[string]lightBulbModel{
+			"test/light1": "LST002",
+		}))
+		assert.Error(t, validateLightProfiles(map[string]lightBulbModel{
+			"test/light1": "nope",
+		}))
+	})
+}
+
+func TestProfileForLight(t *testing.T) {
+	s := newTestServer(t)
+	s.config.lightProfiles = map[string]lightBulbModel{
+		"test/strip": "LST002",
+		"test/spot":  "LWG004",
+	}
+
+	t.Run("unmapped", func(t *testing.T) {
+		assert.Equal(t, rgbModel, s.profileForLight("test/other", rgbType).Model)
+		assert.Equal(t, whiteModel, s.profileForLight("test/other", whiteType).Model)
+	})
+	t.Run("mapped", func(t *testing.T) {
+		p := s.profileForLight("test/strip", rgbType)
+		assert.Equal(t, lightBulbModel("LST002"), p.Model)
+		assert.Equal(t, "huelightstrip", p.config().Archetype)
+		assert.Equal(t, 1600, p.control().MaxLumen)
+		assert.Equal(t, lightBulbGamut("C"), p.control().ColorGamutType)
+	})
+	t.Run("mapped to wrong type", func(t *testing.T) {
+		p := s.profileForLight("test/spot", temperatureType)
+		assert.Equal(t, temperatureModel, p.Model)
+	})
+}
+
+func TestLoadLightProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestServer(t)
+
+	t.Run("no path", func(t *testing.T) {
+		mp, err := s.loadLightProfilesFromFile()
+		assert.NoError(t, err)
+		assert.Len(t, mp, 0)
+	})
+	t.Run("missing file", func(t *testing.T) {
+		s.config.lightProfilesPath = filepath.Join(dir, "missing.json")
+		mp, err := s.loadLightProfilesFromFile()
+		assert.NoError(t, err)
+		assert.Len(t, mp, 0)
+	})
+	t.Run("valid", func(t *testing.T) {
+		path := filepath.Join(dir, "valid.json")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(`{"test/light1": "LCT015"}`), 0600))
+		s.config.lightProfilesPath = path
+		mp, err := s.loadLightProfilesFromFile()
+		assert.NoError(t, err)
+		assert.Equal(t, lightBulbModel("LCT015"), mp["test/light1"])
+	})
+	t.Run("unknown profile", func(t *testing.T) {
+		path := filepath.Join(dir, "unknown.json")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(`{"test/light1": "XYZ001"}`), 0600))
+		s.config.lightProfilesPath = path
+		_, err := s.loadLightProfilesFromFile()
+		assert.Error(t, err)
+	})
+}
@@ -1,15 +1,20 @@
 package bridge
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
-	"github.com/jinzhu/copier"
 )
 
+var errUnknownUser = errors.New("unknown user")
+
 type registrationReq struct {
 	DeviceType        string `json:"devicetype"`
 	GenerateClientKey *bool  `json:"generateclientkey"`
@@ -22,10 +27,13 @@ func (rr *registrationReq) Bind(r *http.Request) error {
 	return nil
 }
 
+type registrationSuccess struct {
+	Username  string `json:"username"`
+	ClientKey string `json:"clientkey,omitempty"`
+}
+
 type registrationResp struct {
-	Success struct {
-		Username string `json:"username"`
-	} `json:"success"`
+	Success registrationSuccess `json:"success"`
 }
 
 func (rr *registrationResp) Render(w http.ResponseWriter, r *http.Request) error {
@@ -44,6 +52,17 @@ func (s *Server) registerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.config.Lock()
+	defer s.config.Unlock()
+	if !s.config.authDisabled && !s.config.linkButtonPressed(now()) {
+		renderListOK(w, r, errLinkButtonNotPressed(r))
+		return
+	}
+	if len(*s.config.Whitelist) >= maxWhitelist {
+		renderListOK(w, r, errWhitelistFull(r))
+		return
+	}
+
 	u := uuid.New().String()
 	entry := whitelist{
 		Name:       data.DeviceType,
@@ -51,32 +70,83 @@ func (s *Server) registerUser(w http.ResponseWriter, r *http.Request) {
 		CreatedAt:  DateTimeToISO8600(now().UTC()),
 		LastUsedAt: DateTimeToISO8600(now().UTC()),
 	}
-
-	s.config.Lock()
-	defer s.config.Unlock()
-	wt := *s.config.Whitelist
-	oldwt := map[string]whitelist{}
-	copier.Copy(&oldwt, &wt)
+	if data.GenerateClientKey != nil && *data.GenerateClientKey {
+		key, err := newClientKey()
+		if err != nil {
+			s.logger.Error(err.Error())
+			renderListOK(w, r, errInternalError(infoFromRequest(r).resource, "100"))
+			return
+		}
+		entry.ClientKey = key
+	}
+	oldwt := *s.config.Whitelist
+	wt := copyWhitelist(oldwt)
 	wt[u] = entry
-	err := s.saveWhitelistToFile()
+	s.config.Whitelist = &wt
+	err := s.saveWhitelist()
 	if err != nil {
 		s.logger.Error(err.Error())
 		s.config.Whitelist = &oldwt
 		renderListOK(w, r, errInternalError(infoFromRequest(r).resource, "100"))
 		return
 	}
-	s.config.Whitelist = &wt
 
 	regResp := &registrationResp{
-		Success: struct {
-			Username string `json:"username"`
-		}{
-			Username: u,
+		Success: registrationSuccess{
+			Username:  u,
+			ClientKey: entry.ClientKey,
 		},
 	}
 	renderListOK(w, r, regResp)
 }
 
+// newClientKey returns a new clientkey, 16 random bytes as 32 hex
+// characters like a real bridge hands out
+func newClientKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate clientkey: %v", err)
+	}
+	return strings.ToUpper(hex.EncodeToString(b)), nil
+}
+
+// clientKey returns the pre-shared key to use when streaming for the user
+func (s *Server) clientKey(username string) ([]byte, bool) {
+	s.config.RLock()
+	defer s.config.RUnlock()
+	entry, ok := (*s.config.Whitelist)[username]
+	if !ok || entry.ClientKey == "" {
+		return nil, false
+	}
+	key, err := hex.DecodeString(entry.ClientKey)
+	if err != nil {
+		return nil, false
+	}
+	return key, true
+}
+
+// setClientKey replaces the clientkey of the user and persists the
+// whitelist. An empty key revokes it
+func (s *Server) setClientKey(username, key string) error {
+	s.config.Lock()
+	defer s.config.Unlock()
+	oldwt := *s.config.Whitelist
+	entry, ok := oldwt[username]
+	if !ok {
+		return errUnknownUser
+	}
+	wt := copyWhitelist(oldwt)
+	entry.ClientKey = key
+	wt[username] = entry
+	s.config.Whitelist = &wt
+	err := s.saveWhitelist()
+	if err != nil {
+		s.config.Whitelist = &oldwt
+		return err
+	}
+	return nil
+}
+
 type deleteResp struct {
 	Success string `json:"success"`
 }
@@ -90,17 +160,16 @@ func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
 	defer s.config.Unlock()
 
 	deleteID := chi.RouteContext(r.Context()).URLParam("deleteID")
-	wt := *s.config.Whitelist
-	oldwt := map[string]whitelist{}
-	copier.Copy(&oldwt, &wt)
+	oldwt := *s.config.Whitelist
+	wt := copyWhitelist(oldwt)
 	delete(wt, deleteID)
-	err := s.saveWhitelistToFile()
+	s.config.Whitelist = &wt
+	err := s.saveWhitelist()
 	if err != nil {
 		s.logger.Error(err.Error())
 		s.config.Whitelist = &oldwt
 		renderListOK(w, r, errInternalError(infoFromRequest(r).resource, "100"))
 		return
 	}
-	s.config.Whitelist = &wt
 	renderListOK(w, r, &deleteResp{Success: fmt.Sprintf("/config/whitelist/%s deleted.", deleteID)})
 }
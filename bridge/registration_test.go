@@ -19,6 +19,7 @@ func registerTestingUser(t *testing.T, s *Server) string {
 		t.Fatalf(err.Error())
 	}
 
+	s.PressLinkButton(t.Name())
 	st, body := tReq(t, s, http.MethodPost, "/api", enc)
 	if st != http.StatusOK {
 		t.Fatalf("expected registration to return 200 OK, got %d", st)
@@ -68,11 +69,30 @@ func TestRegistration(t *testing.T) {
 			assert.Len(t, dec, 1)
 			assert.Equal(t, 5, dec[0].Error.Type)
 		})
+		t.Run("link button not pressed", func(t *testing.T) {
+			register := &registrationReq{DeviceType: t.Name()}
+			enc, err := json.Marshal(register)
+			assert.NoError(t, err)
+
+			b.config.Lock()
+			b.config.linkButtonUntil = time.Time{}
+			b.config.Unlock()
+
+			st, body := tReq(t, b, http.MethodPost, "/api", enc)
+			assert.Equal(t, http.StatusOK, st)
+
+			dec := []errorResp{}
+			err = json.Unmarshal(body, &dec)
+			assert.NoError(t, err)
+			assert.Len(t, dec, 1)
+			assert.Equal(t, 101, dec[0].Error.Type)
+		})
 		t.Run("properly", func(t *testing.T) {
 			register := &registrationReq{DeviceType: t.Name()}
 			enc, err := json.Marshal(register)
 			assert.NoError(t, err)
 
+			b.PressLinkButton(t.Name())
 			st, body := tReq(t, b, http.MethodPost, "/api", enc)
 			assert.Equal(t, http.StatusOK, st)
 
@@ -81,6 +101,57 @@ func TestRegistration(t *testing.T) {
 			assert.NoError(t, err)
 			assert.Len(t, dec, 1)
 		})
+		t.Run("with clientkey", func(t *testing.T) {
+			register := &registrationReq{DeviceType: t.Name(), GenerateClientKey: BoolPtr(true)}
+			enc, err := json.Marshal(register)
+			assert.NoError(t, err)
+
+			b.PressLinkButton(t.Name())
+			st, body := tReq(t, b, http.MethodPost, "/api", enc)
+			assert.Equal(t, http.StatusOK, st)
+
+			dec := []registrationResp{}
+			err = json.Unmarshal(body, &dec)
+			assert.NoError(t, err)
+			if !assert.Len(t, dec, 1) {
+				t.FailNow()
+			}
+			assert.Len(t, dec[0].Success.ClientKey, 32)
+			psk, ok := b.clientKey(dec[0].Success.Username)
+			assert.True(t, ok)
+			assert.Len(t, psk, 16)
+		})
+		t.Run("whitelist full", func(t *testing.T) {
+			register := &registrationReq{DeviceType: t.Name()}
+			enc, err := json.Marshal(register)
+			assert.NoError(t, err)
+
+			b.config.Lock()
+			oldwt := b.config.Whitelist
+			wt := map[string]whitelist{}
+			for i := 0; i < maxWhitelist; i++ {
+				wt[fmt.Sprint(i)] = whitelist{Name: t.Name()}
+			}
+			b.config.Whitelist = &wt
+			b.config.Unlock()
+
+			defer func() {
+				b.config.Lock()
+				b.config.Whitelist = oldwt
+				b.config.Unlock()
+			}()
+
+			b.PressLinkButton(t.Name())
+			st, body := tReq(t, b, http.MethodPost, "/api", enc)
+			assert.Equal(t, http.StatusOK, st)
+
+			dec := []errorResp{}
+			err = json.Unmarshal(body, &dec)
+			assert.NoError(t, err)
+			assert.Len(t, dec, 1)
+			assert.Equal(t, 301, dec[0].Error.Type)
+			assert.Equal(t, "user could not be created. Whitelist is full", dec[0].Error.Description)
+		})
 		t.Run("unsuccessfully due to bad whitelist", func(t *testing.T) {
 			register := &registrationReq{DeviceType: t.Name()}
 			enc, err := json.Marshal(register)
@@ -96,6 +167,7 @@ func TestRegistration(t *testing.T) {
 				b.config.Unlock()
 			}()
 
+			b.PressLinkButton(t.Name())
 			st, body := tReq(t, b, http.MethodPost, "/api", enc)
 			assert.Equal(t, http.StatusOK, st)
 
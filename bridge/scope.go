@@ -0,0 +1,183 @@
+package bridge
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ScopeCtxKey is the context.Context key to store the scope of the
+	// whitelisted user making the request
+	ScopeCtxKey = &contextKey{"Scope"}
+)
+
+// Access is what a whitelisted user is allowed to do
+type Access string
+
+const (
+	// AccessFull allows every request
+	AccessFull Access = "full"
+	// AccessReadOnly only allows requests that don't change anything
+	AccessReadOnly Access = "read-only"
+)
+
+// scope restricts what a whitelisted user can do. A nil scope, or one
+// without any restrictions, gives full control
+type scope struct {
+	Access Access `json:"access,omitempty"`
+	// Lights and Groups limit the user to these lights and groups, which
+	// includes rooms. If either is set, the user can't change anything
+	// else and only sees these lights and groups
+	Lights []string `json:"lights,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+func (sc *scope) validate() error {
+	switch sc.Access {
+	case "", AccessFull, AccessReadOnly:
+	default:
+		return fmt.Errorf("access must be one of %s or %s, got %s",
+			AccessFull, AccessReadOnly, sc.Access)
+	}
+	return nil
+}
+
+func (sc *scope) readOnly() bool {
+	return sc != nil && sc.Access == AccessReadOnly
+}
+
+func (sc *scope) limited() bool {
+	return sc != nil && (len(sc.Lights) > 0 || len(sc.Groups) > 0)
+}
+
+func (sc *scope) allowsLight(id string) bool {
+	return !sc.limited() || contains(sc.Lights, id)
+}
+
+func (sc *scope) allowsGroup(id string) bool {
+	return !sc.limited() || contains(sc.Groups, id)
+}
+
+// allowsResource returns whether the scope allows the method on the
+// resource, and if not which error type to return
+func (sc *scope) allowsResource(method, resource string) (bool, int) {
+	read := false
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		read = true
+	}
+	if sc.readOnly() && !read {
+		return false, 4
+	}
+	if !sc.limited() {
+		return true, 0
+	}
+
+	parts := strings.Split(strings.TrimPrefix(resource, "/"), "/")
+	if len(parts) >= 2 && parts[1] != "new" {
+		switch parts[0] {
+		case "lights":
+			return sc.allowsLight(parts[1]), 1
+		case "groups":
+			return sc.allowsGroup(parts[1]), 1
+		}
+	}
+	return read, 1
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// userScope returns the current scope of a user that's connected to one of
+// the event streams, and false if the user isn't whitelisted any more.
+// Anyone stays connected while authentication is disabled
+func (s *Server) userScope(username string) (*scope, bool) {
+	s.config.RLock()
+	defer s.config.RUnlock()
+	if entry, ok := (*s.config.Whitelist)[username]; ok && username != "" {
+		return entry.Scope, true
+	}
+	return nil, s.config.authDisabled
+}
+
+// scopeFromRequest returns the scope of the user making the request
+func scopeFromRequest(r *http.Request) *scope {
+	sc, _ := r.Context().Value(ScopeCtxKey).(*scope)
+	return sc
+}
+
+// EnforceScope rejects requests the scope of the whitelisted user doesn't
+// allow. Authenticate must run before it
+func (s *Server) EnforceScope(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ok, errType := scopeFromRequest(r).allowsResource(r.Method, infoFromRequest(r).resource)
+		if !ok {
+			switch errType {
+			case 4:
+				renderListOK(w, r, errMethod(r))
+			default:
+				renderListOK(w, r, errUnauthorized(r))
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// filterLights returns the lights the scope allows
+func (sc *scope) filterLights(ls lights) lights {
+	if !sc.limited() {
+		return ls
+	}
+	res := lights{}
+	for id, l := range ls {
+		if sc.allowsLight(id) {
+			res[id] = l
+		}
+	}
+	return res
+}
+
+// filterGroups returns the groups the scope allows
+func (sc *scope) filterGroups(gs groups) groups {
+	if !sc.limited() {
+		return gs
+	}
+	res := groups{}
+	for id, g := range gs {
+		if sc.allowsGroup(id) {
+			res[id] = g
+		}
+	}
+	return res
+}
+
+// setScope replaces the scope of the user and persists the whitelist. A
+// nil scope gives the user full control
+func (s *Server) setScope(username string, sc *scope) error {
+	s.config.Lock()
+	defer s.config.Unlock()
+	oldwt := *s.config.Whitelist
+	entry, ok := oldwt[username]
+	if !ok {
+		return errUnknownUser
+	}
+	wt := copyWhitelist(oldwt)
+	entry.Scope = sc
+	wt[username] = entry
+	s.config.Whitelist = &wt
+	err := s.saveWhitelist()
+	if err != nil {
+		s.config.Whitelist = &oldwt
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopeAllowsResource(t *testing.T) {
+	readOnly := &scope{Access: AccessReadOnly}
+	limited := &scope{Lights: []string{"1"}, Groups: []string{"2"}}
+
+	tests := []struct {
+		name     string
+		sc       *scope
+		method   string
+		resource string
+		ok       bool
+		errType  int
+	}{
+		{"full", nil, http.MethodPut, "/lights/1/state", true, 0},
+		{"read-only get", readOnly, http.MethodGet, "/lights", true, 0},
+		{"read-only put", readOnly, http.MethodPut, "/lights/1/state", false, 4},
+		{"read-only delete", readOnly, http.MethodDelete, "/config/whitelist/a", false, 4},
+		{"limited light", limited, http.MethodPut, "/lights/1/state", true, 1},
+		{"limited other light", limited, http.MethodPut, "/lights/3/state", false, 1},
+		{"limited get other light", limited, http.MethodGet, "/lights/3", false, 1},
+		{"limited group", limited, http.MethodPut, "/groups/2/action", true, 1},
+		{"limited other group", limited, http.MethodPut, "/groups/0/action", false, 1},
+		{"limited list", limited, http.MethodGet, "/lights", true, 1},
+		{"limited new lights", limited, http.MethodGet, "/lights/new", true, 1},
+		{"limited search", limited, http.MethodPost, "/lights", false, 1},
+		{"limited whitelist", limited, http.MethodDelete, "/config/whitelist/a", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, errType := tt.sc.allowsResource(tt.method, tt.resource)
+			assert.Equal(t, tt.ok, ok)
+			if !ok {
+				assert.Equal(t, tt.errType, errType)
+			}
+		})
+	}
+}
+
+func TestScopeFilter(t *testing.T) {
+	ls := lights{"1": &light{}, "2": &light{}}
+	gs := groups{"1": &group{}, "2": &group{}}
+
+	var full *scope
+	assert.Len(t, full.filterLights(ls), 2)
+	assert.Len(t, full.filterGroups(gs), 2)
+
+	limited := &scope{Lights: []string{"1"}}
+	assert.Equal(t, lights{"1": ls["1"]}, limited.filterLights(ls))
+	assert.Len(t, limited.filterGroups(gs), 0)
+}
+
+func TestEnforceScope(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Whitelist = &map[string]whitelist{
+		"full":     {Name: "full"},
+		"readonly": {Name: "readonly", Scope: &scope{Access: AccessReadOnly}},
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		renderListOK(w, r, &successResp{Success: map[string]interface{}{"ok": true}})
+	}
+	r := chi.NewRouter()
+	r.Route("/api/{userID}", func(r chi.Router) {
+		r.Use(render.SetContentType(render.ContentTypeJSON))
+		r.Use(s.Authenticate)
+		r.Use(s.EnforceScope)
+		r.Put("/lights/{lightID}/state", ok)
+		r.Get("/config", s.getAuthenticatedConfig)
+	})
+	errType := func(user string) float64 {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/"+user+"/lights/1/state", nil))
+		dec := []map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &dec); err != nil {
+			t.Fatalf(err.Error())
+		}
+		e, ok := dec[0]["error"].(map[string]interface{})
+		if !ok {
+			return 0
+		}
+		return e["type"].(float64)
+	}
+	assert.Equal(t, 0.0, errType("full"))
+	assert.Equal(t, 4.0, errType("readonly"))
+	assert.Equal(t, 1.0, errType("nope"))
+
+	t.Run("whitelist", func(t *testing.T) {
+		whitelisted := func(user string) map[string]interface{} {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/"+user+"/config", nil))
+			dec := map[string]interface{}{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &dec); err != nil {
+				t.Fatalf(err.Error())
+			}
+			wt, _ := dec["whitelist"].(map[string]interface{})
+			return wt
+		}
+		wt := whitelisted("readonly")
+		assert.NotContains(t, wt, "full", "a read-only user mustn't learn the key of a full user")
+		assert.Contains(t, wt, "readonly")
+		wt = whitelisted("full")
+		assert.Contains(t, wt, "full")
+		assert.Contains(t, wt, "readonly")
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		a := s.newAdminRouter()
+		put := func(user, body string) int {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut, "/whitelist/"+user+"/scope", bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			a.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		assert.Equal(t, http.StatusOK, put("full", `{"lights": ["2"]}`))
+		assert.Equal(t, 1.0, errType("full"))
+		assert.Equal(t, http.StatusOK, put("readonly", `{"access": "full"}`))
+		assert.Nil(t, (*s.config.Whitelist)["readonly"].Scope)
+		assert.Equal(t, 0.0, errType("readonly"))
+		assert.Equal(t, http.StatusBadRequest, put("readonly", `{"access": "all"}`))
+		assert.Equal(t, http.StatusNotFound, put("nope", `{}`))
+	})
+}
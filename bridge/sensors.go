@@ -24,6 +24,8 @@ type sensorConfig struct {
 type sensorState struct {
 	Daylight    *bool  `json:"daylight,omitempty"`
 	ButtonEvent *int   `json:"buttonevent,omitempty"`
+	Presence    *bool  `json:"presence,omitempty"`
+	Temperature *int   `json:"temperature,omitempty"`
 	LastUpdated string `json:"lastupdated"`
 }
 
@@ -142,16 +144,24 @@ func (s *Server) sensorRename(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) sensorByID(w http.ResponseWriter, r *http.Request) {
 	sensorID := chi.RouteContext(r.Context()).URLParam("sensorID")
-	if sensorID != "1" {
+	sen, ok := s.createSensors()[sensorID]
+	if !ok {
 		renderListOK(w, r, errInvalidResource(r))
 		return
 	}
-	renderOK(w, r, s.newDaylightSensor())
+	renderOK(w, r, sen)
 }
 
-func (s *Server) getAllSensors(w http.ResponseWriter, r *http.Request) {
-	sensors := sensors{
-		"1": s.newDaylightSensor(),
+func (s *Server) createSensors() sensors {
+	sens := sensors{}
+	// Sensors aren't shown to Alexa, so they don't take up a small ID
+	for id, sen := range s.upstream.getSensors() {
+		sens[TopicToStrInt(upstreamTopic("sensors", id))] = sen
 	}
-	renderOK(w, r, sensors)
+	sens["1"] = s.newDaylightSensor()
+	return sens
+}
+
+func (s *Server) getAllSensors(w http.ResponseWriter, r *http.Request) {
+	renderOK(w, r, s.createSensors())
 }
@@ -3,13 +3,10 @@ package bridge // import "hemtjan.st/fargton/bridge"
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,11 +24,23 @@ var errParamMissing = errors.New("missing required parameter")
 
 // Server represents the HTTP API
 type Server struct {
-	config      *Config
-	logger      *zap.Logger
-	httpRouter  *chi.Mux
-	httpsRouter *chi.Mux
-	mqtt        *server.Manager
+	config        *Config
+	logger        *zap.Logger
+	httpRouter    *chi.Mux
+	httpsRouter   *chi.Mux
+	adminRouter   *chi.Mux
+	deconzRouter  *chi.Mux
+	mqtt          *server.Manager
+	registry      *lightRegistry
+	ids           *idMap
+	usage         *whitelistUsage
+	announcer     *announcer
+	certs         *certReloader
+	entertainment *entertainmentAreas
+	stream        *stream
+	events        *eventHub
+	deconz        *deconzHub
+	upstream      *upstreamBridge
 }
 
 // NewServer returns a new Server
@@ -39,11 +48,27 @@ func NewServer(c *Config, m *server.Manager, l *zap.Logger) *Server {
 	r1 := chi.NewRouter()
 	r2 := chi.NewRouter()
 	s := &Server{
-		config:      c,
-		logger:      l,
-		httpRouter:  r1,
-		httpsRouter: r2,
-		mqtt:        m,
+		config:        c,
+		logger:        l,
+		httpRouter:    r1,
+		httpsRouter:   r2,
+		mqtt:          m,
+		registry:      newLightRegistry(),
+		ids:           newIDMap(),
+		usage:         newWhitelistUsage(),
+		announcer:     &announcer{},
+		certs:         newCertReloader(c, l),
+		entertainment: newEntertainmentAreas(),
+		stream:        newStream(),
+		events:        newEventHub(),
+		deconz:        newDeconzHub(),
+	}
+
+	s.adminRouter = s.newAdminRouter()
+	s.deconzRouter = s.newDeconzRouter()
+
+	if s.config.upstreamAddress != "" {
+		s.upstream = newUpstreamBridge(s.config.upstreamAddress, s.config.upstreamUsername)
 	}
 
 	if s.config.authDisabled {
@@ -66,7 +91,8 @@ func NewServer(c *Config, m *server.Manager, l *zap.Logger) *Server {
 		r.Use(middleware.SetHeader("Access-Control-Allow-Credentials", "true"))
 		r.Use(middleware.SetHeader("Access-Control-Allow-Methods",
 			"POST, GET, OPTIONS, PUT, DELETE, HEAD"))
-		r.Use(middleware.SetHeader("Access-Control-Allow-Headers", "Content-Type"))
+		r.Use(middleware.SetHeader("Access-Control-Allow-Headers",
+			"Content-Type, "+clipKeyHeader))
 	}
 
 	r1.Route("/description.xml", func(r chi.Router) {
@@ -74,58 +100,88 @@ func NewServer(c *Config, m *server.Manager, l *zap.Logger) *Server {
 		r.Get("/", s.descriptionXML)
 	})
 
-	r1.With(render.SetContentType(render.ContentTypeJSON)).
-		Get("/api/nouser/config", s.getUnauthenticatedConfig)
+	s.config.RLock()
+	mode := s.config.httpAPIMode
+	s.config.RUnlock()
+	switch mode {
+	case HTTPAPIOff:
+		r1.With(render.SetContentType(render.ContentTypeJSON)).
+			Get("/api/nouser/config", s.getUnauthenticatedConfig)
+	default:
+		r1.Route("/api", func(r chi.Router) {
+			s.apiRoutes(r, true)
+		})
+	}
 
 	r2.Route("/api", func(r chi.Router) {
-		r.Use(render.SetContentType(render.ContentTypeJSON))
-		r.Post("/", s.registerUser)
-		r.Route("/{userID}", func(r chi.Router) {
-			r.Use(s.Authenticate)
-			r.Get("/", s.getConfigAndData)
-			r.Get("/config", s.getAuthenticatedConfig)
-			r.Delete("/config/whitelist/{deleteID}", s.deleteUser)
-			r.Get("/lights/new", s.getNewLights)
-			r.Get("/lights/{lightID}", s.lightByID)
-			r.Put("/lights/{lightID}", s.lightRename)
-			r.Put("/lights/{lightID}/state", s.lightUpdateState)
-			r.Get("/lights", s.getLights)
-			r.Post("/lights", s.searchLights)
-			r.Get("/groups", s.getGroups)
-			r.Get("/groups/{groupID}", s.groupByID)
-			r.Put("/groups/{groupID}", s.groupRename)
-			r.Put("/groups/{groupID}/action", s.groupUpdateState)
-			r.Get("/schedules", s.getDummies)
-			r.Get("/scenes", s.getDummies)
-			r.Get("/sensors/new", s.getNewSensors)
-			r.Put("/sensors/{sensorID}", s.sensorRename)
-			r.Get("/sensors/{sensorID}", s.sensorByID)
-			r.Get("/sensors", s.getAllSensors)
-			r.Post("/sensors", s.searchSensors)
-			r.Get("/rules", s.getDummies)
-			r.Get("/resourcelinks", s.getDummies)
-			r.Get("/capabilities", s.getCapabilities)
-		})
+		s.apiRoutes(r, false)
 	})
+	r2.Route("/clip/v2", s.clipRoutes)
+	r2.With(s.AuthenticateClip).Get("/eventstream/clip/v2", s.eventStream)
 
 	return s
 }
 
-func createListener(c *Config, l *zap.Logger, withTLS bool) (net.Listener, error) {
+// apiRoutes mounts the Hue REST API. Requests made over plain HTTP are
+// subject to the restrictions configured for it
+func (s *Server) apiRoutes(r chi.Router, plain bool) {
+	r.Use(render.SetContentType(render.ContentTypeJSON))
+	s.config.RLock()
+	alexa := s.config.alexa
+	s.config.RUnlock()
+	if plain && alexa {
+		r.Use(Lenient)
+	}
+	r.Post("/", s.registerUser)
+	r.Route("/{userID}", func(r chi.Router) {
+		r.Use(s.Authenticate)
+		r.Use(s.EnforceScope)
+		if plain {
+			r.Use(s.RestrictHTTP)
+		}
+		r.Get("/", s.getConfigAndData)
+		r.Get("/config", s.getAuthenticatedConfig)
+		r.Put("/config", s.updateConfig)
+		r.Delete("/config/whitelist/{deleteID}", s.deleteUser)
+		r.Get("/lights/new", s.getNewLights)
+		r.Get("/lights/{lightID}", s.lightByID)
+		r.Put("/lights/{lightID}", s.lightRename)
+		r.Put("/lights/{lightID}/state", s.lightUpdateState)
+		r.Get("/lights", s.getLights)
+		r.Post("/lights", s.searchLights)
+		r.Get("/groups", s.getGroups)
+		r.Post("/groups", s.createGroup)
+		r.Get("/groups/{groupID}", s.groupByID)
+		r.Put("/groups/{groupID}", s.groupRename)
+		r.Delete("/groups/{groupID}", s.deleteGroup)
+		r.Put("/groups/{groupID}/action", s.groupUpdateState)
+		r.Get("/schedules", s.getDummies)
+		r.Get("/scenes", s.getDummies)
+		r.Get("/sensors/new", s.getNewSensors)
+		r.Put("/sensors/{sensorID}", s.sensorRename)
+		r.Get("/sensors/{sensorID}", s.sensorByID)
+		r.Get("/sensors", s.getAllSensors)
+		r.Post("/sensors", s.searchSensors)
+		r.Get("/rules", s.getDummies)
+		r.Get("/resourcelinks", s.getDummies)
+		r.Get("/capabilities", s.getCapabilities)
+	})
+}
+
+// createListener listens for plain HTTP, or for TLS with the certificates
+// certs serves if it's given
+func createListener(c *Config, l *zap.Logger, certs *certReloader) (net.Listener, error) {
 	var listener net.Listener
 	var err error
 	var port int
 
+	withTLS := certs != nil
 	switch withTLS {
 	case false:
 		listener, err = net.Listen("tcp", c.address)
 	case true:
-		cert, err := tls.LoadX509KeyPair(c.tlsPubKey, c.tlsPrivKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load TLS key/cert: %v", err)
-		}
 		tlsCfg := &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			GetCertificate: certs.GetCertificate,
 		}
 		listener, err = tls.Listen("tcp", c.tlsAddress, tlsCfg)
 	}
@@ -152,24 +208,113 @@ func createListener(c *Config, l *zap.Logger, withTLS bool) (net.Listener, error
 // Start the HTTP listener and return a shutdown function we can call
 // to shut everything down again
 func (s *Server) Start(sleep time.Duration) (func(context.Context), error) {
-	wt, err := s.loadWhitelistFromFile()
+	wt, err := s.loadWhitelist()
 	if err != nil {
 		return nil, err
 	}
 	s.config.Lock()
 	s.config.Whitelist = wt
 	s.config.Unlock()
+	if err := s.flushWhitelist(now()); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadSettings(); err != nil {
+		return nil, err
+	}
+
+	ids, err := s.loadIDMapFromFile()
+	if err != nil {
+		return nil, err
+	}
+	s.ids = ids
+
+	// Entertainment groups reserve their IDs in the ID map, so it's loaded
+	// first
+	if err := s.loadEntertainment(); err != nil {
+		return nil, err
+	}
+
+	lp, err := s.loadLightProfilesFromFile()
+	if err != nil {
+		return nil, err
+	}
+	s.config.Lock()
+	s.config.lightProfiles = lp
+	s.config.Unlock()
+
+	cals, err := s.loadCalibrationFromFile()
+	if err != nil {
+		return nil, err
+	}
+	s.config.Lock()
+	s.config.calibrations = cals
+	s.config.Unlock()
 
-	listener, err := createListener(s.config, s.logger, false)
+	listener, err := createListener(s.config, s.logger, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	listenerTLS, err := createListener(s.config, s.logger, true)
+	if err := s.ensureCertificate(); err != nil {
+		return nil, err
+	}
+	if _, err := s.certs.load(); err != nil {
+		return nil, err
+	}
+
+	listenerTLS, err := createListener(s.config, s.logger, s.certs)
 	if err != nil {
 		return nil, err
 	}
 
+	s.config.RLock()
+	alexa := s.config.alexa
+	port := s.config.port
+	adminAddress := s.config.adminAddress
+	linkButtonDevice := s.config.linkButtonDevice
+	streamingAddress := s.config.streamingAddress
+	deconzAddress := s.config.deconzAddress
+	lifxAddress := s.config.lifxAddress
+	s.config.RUnlock()
+
+	var listenerAdmin net.Listener
+	if adminAddress != "" {
+		listenerAdmin, err = net.Listen("tcp", adminAddress)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var listenerDeconz net.Listener
+	if deconzAddress != "" {
+		listenerDeconz, err = s.createDeconzListener()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var listenerLIFX net.PacketConn
+	if lifxAddress != "" {
+		listenerLIFX, err = s.createLIFXListener()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var listenerStream net.Listener
+	if streamingAddress != "" {
+		listenerStream, err = s.createStreamListener()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if alexa && port != 80 {
+		s.logger.Warn(fmt.Sprintf(
+			"Alexa compatibility is enabled but the HTTP API is on port %d, the Echo only uses port 80", port))
+	}
+
 	ctx, ctxCancel := context.WithCancel(context.Background())
 	s.logger.Info("starting MQTT")
 	go s.mqtt.Start(ctx)
@@ -177,12 +322,9 @@ func (s *Server) Start(sleep time.Duration) (func(context.Context), error) {
 	s.logger.Info("started MQT")
 	s.logger.Info("fetching initial device data from MQTT, this may take a bit...")
 	devs := s.mqtt.DeviceByType("lightbulb")
-	s.config.lights = len(devs)
-	s.config.groups = len(devs)
 	wgDev := sync.WaitGroup{}
 	for _, dev := range devs {
-		fts := []string{"on", "colorTemperature", "brightness", "hue", "saturation"}
-		for _, ft := range fts {
+		for _, ft := range watchedFeatures {
 			wgDev.Add(1)
 			go func(ft string) {
 				defer wgDev.Done()
@@ -195,6 +337,10 @@ func (s *Server) Start(sleep time.Duration) (func(context.Context), error) {
 	wgDev.Wait()
 	s.logger.Info("done fetching device data")
 
+	if linkButtonDevice != "" {
+		go s.watchLinkButtonDevice(ctx, linkButtonDevice)
+	}
+
 	h1 := &http.Server{
 		Handler: s.httpRouter,
 	}
@@ -219,8 +365,36 @@ func (s *Server) Start(sleep time.Duration) (func(context.Context), error) {
 	s.logger.Info(fmt.Sprintf(
 		"started Hue HTTPS REST API server on https://%s", listenerTLS.Addr().String()))
 
+	h3 := &http.Server{
+		Handler: s.adminRouter,
+	}
+	if listenerAdmin != nil {
+		s.logger.Info("initialising admin API")
+		go func() {
+			if err := h3.Serve(listenerAdmin); err != http.ErrServerClosed {
+				s.logger.Fatal(err.Error())
+			}
+		}()
+		s.logger.Info(fmt.Sprintf(
+			"started admin API server on http://%s", listenerAdmin.Addr().String()))
+	}
+
+	h4 := &http.Server{
+		Handler: s.deconzRouter,
+	}
+	if listenerDeconz != nil {
+		s.logger.Info("initialising deCONZ REST API")
+		go func() {
+			if err := h4.Serve(listenerDeconz); err != http.ErrServerClosed {
+				s.logger.Fatal(err.Error())
+			}
+		}()
+		s.logger.Info(fmt.Sprintf(
+			"started deCONZ REST API server on http://%s", listenerDeconz.Addr().String()))
+	}
+
 	s.logger.Info("initialising mDNS responder for Hue bridge discovery")
-	rp, err := newMDNSResponder(s.config)
+	rp, hdl, err := newMDNSResponder(s.config)
 	if err != nil {
 		s.logger.Fatal(err.Error())
 	}
@@ -230,20 +404,114 @@ func (s *Server) Start(sleep time.Duration) (func(context.Context), error) {
 			s.logger.Error(err.Error())
 		}
 	}()
+	go reannounceMDNS(ctx, s.config, s.logger, rp, hdl, s.announcer.subscribe())
 	s.logger.Info("started mDNS responder")
 
 	s.logger.Info("initialising SSDP/UPnP responder")
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	quitSSDP := make(chan bool)
+	announceSSDP := s.announcer.subscribe()
 	go func() {
 		defer wg.Done()
-		newSSDPResponder(s.config, s.logger, quitSSDP)
+		if alexa {
+			// The advertisers answer searches too, without the headers
+			// the Echo looks for, so only one of them can run
+			newSSDPSearchResponder(s.config, s.logger, quitSSDP, announceSSDP)
+			return
+		}
+		newSSDPResponder(s.config, s.logger, quitSSDP, announceSSDP)
 	}()
 	s.logger.Info("started SSDP/UPnP responder")
 
+	s.logger.Info("initialising whitelist flusher")
+	wg.Add(1)
+	quitFlush := make(chan bool)
+	go func() {
+		defer wg.Done()
+		s.newWhitelistFlusher(quitFlush)
+	}()
+	s.logger.Info("started whitelist flusher")
+
+	s.logger.Info("initialising TLS certificate reloader")
+	wg.Add(1)
+	quitCerts := make(chan bool)
+	go func() {
+		defer wg.Done()
+		s.certs.watch(quitCerts)
+	}()
+	s.logger.Info("started TLS certificate reloader")
+
+	quitStream := make(chan bool)
+	quitForward := make(chan bool)
+	if listenerStream != nil {
+		s.logger.Info("initialising Entertainment API streaming server")
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.serveStream(listenerStream, quitStream)
+		}()
+		go func() {
+			defer wg.Done()
+			s.newStreamForwarder(quitForward)
+		}()
+		s.logger.Info("started Entertainment API streaming server")
+	}
+
+	s.logger.Info("initialising CLIP v2 event stream")
+	wg.Add(1)
+	quitEvents := make(chan bool)
+	go func() {
+		defer wg.Done()
+		s.watchEvents(quitEvents)
+	}()
+	s.logger.Info("started CLIP v2 event stream")
+
+	quitLIFX := make(chan bool)
+	if listenerLIFX != nil {
+		s.logger.Info("initialising LIFX LAN server")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveLIFX(listenerLIFX, quitLIFX)
+		}()
+		s.logger.Info("started LIFX LAN server")
+	}
+
+	quitUpstream := make(chan bool)
+	if s.upstream != nil {
+		s.logger.Info("initialising upstream bridge poller")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.pollUpstream(quitUpstream)
+		}()
+		s.logger.Info("started upstream bridge poller")
+	}
+
 	return func(ctx context.Context) {
 		quitSSDP <- true
+		quitFlush <- true
+		quitCerts <- true
+		if listenerStream != nil {
+			close(quitStream)
+			s.stream.stop()
+			listenerStream.Close()
+			quitForward <- true
+			s.logger.Info("stopped Entertainment API streaming server")
+		}
+		quitEvents <- true
+		if listenerLIFX != nil {
+			close(quitLIFX)
+			listenerLIFX.Close()
+			s.logger.Info("stopped LIFX LAN server")
+		}
+		if s.upstream != nil {
+			quitUpstream <- true
+			s.logger.Info("stopped upstream bridge poller")
+		}
+		s.events.close()
+		s.deconz.close()
 		wg.Wait()
 		ctxCancel()
 		s.logger.Info("stopped mDNS responder")
@@ -252,6 +520,14 @@ func (s *Server) Start(sleep time.Duration) (func(context.Context), error) {
 		s.logger.Info("stopped Hue HTTP REST API server")
 		h2.Shutdown(ctx)
 		s.logger.Info("stopped Hue HTTPS REST API server")
+		if listenerAdmin != nil {
+			h3.Shutdown(ctx)
+			s.logger.Info("stopped admin API server")
+		}
+		if listenerDeconz != nil {
+			h4.Shutdown(ctx)
+			s.logger.Info("stopped deCONZ REST API server")
+		}
 	}, nil
 }
 
@@ -295,12 +571,13 @@ func (*configAndDataResp) Render(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *Server) getConfigAndData(w http.ResponseWriter, r *http.Request) {
-	config := createAuthenticatedConfig(s.config)
-	devs := s.getAllLightsFromMQTT()
-	groups := s.createGroups()
-	sensors := sensors{
-		"1": s.newDaylightSensor(),
-	}
+	s.config.RLock()
+	config := createAuthenticatedConfig(s.config, infoFromRequest(r).uid, scopeFromRequest(r))
+	s.config.RUnlock()
+	sc := scopeFromRequest(r)
+	devs := sc.filterLights(s.getAllLights())
+	groups := sc.filterGroups(s.createGroups())
+	sensors := s.createSensors()
 	d := s.createDummies()
 
 	resp := &configAndDataResp{
@@ -352,50 +629,6 @@ func infoFromRequest(r *http.Request) *rInfo {
 	return info
 }
 
-func (s *Server) loadWhitelistFromFile() (*map[string]whitelist, error) {
-	path := s.config.whitelistConfigPath
-	if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
-		s.logger.Info(fmt.Sprintf("whitelist does not exist at %s", path))
-		return &map[string]whitelist{}, nil
-	}
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open %s: %v", path, err)
-	}
-
-	defer f.Close()
-	data, err := ioutil.ReadAll(f)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read contents of %s: %v", path, err)
-	}
-	var wt map[string]whitelist
-	err = json.Unmarshal(data, &wt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode %s as JSON: %v", path, err)
-	}
-	s.logger.Info(fmt.Sprintf("whitelist loaded from: %s", path))
-	return &wt, nil
-}
-
-func (s *Server) saveWhitelistToFile() error {
-	if s.config.whitelistConfigPath == "" {
-		s.logger.Debug("no whitelist config path specified, not persisting to disk")
-		return nil
-	}
-	data, err := json.Marshal(s.config.Whitelist)
-	if err != nil {
-		return fmt.Errorf("failed to encode as JSON: %v", err)
-	}
-	path := s.config.whitelistConfigPath
-	s.logger.Debug("writing file")
-	err = ioutil.WriteFile(path, data, 0600)
-	s.logger.Debug("wrote file")
-	if err != nil {
-		return fmt.Errorf("failed to write whitelist to %s: %v", path, err)
-	}
-	return nil
-}
-
 func renderAsList(renderers ...render.Renderer) []render.Renderer {
 	list := []render.Renderer{}
 	for _, ren := range renderers {
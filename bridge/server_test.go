@@ -95,11 +95,41 @@ func NewTestingBridge(t *testing.T,
 	}
 }
 
+// newTestServer returns a bridge that isn't started, for testing handlers
+// and state without MQTT
+func newTestServer(t *testing.T, opts ...ConfigOption) *Server {
+	t.Helper()
+	c, err := NewConfig(append([]ConfigOption{Name(t.Name())}, opts...)...)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return NewServer(c, nil, zap.NewNop())
+}
+
 func tReq(t *testing.T,
 	s *Server,
 	method string,
 	endpoint string,
 	body []byte,
+) (int, []byte) {
+	t.Helper()
+	return tReqURL(t, method, fmt.Sprintf("https://%s:%d%s", testingHost, s.config.tlsPort, endpoint), body)
+}
+
+func tReqHTTP(t *testing.T,
+	s *Server,
+	method string,
+	endpoint string,
+	body []byte,
+) (int, []byte) {
+	t.Helper()
+	return tReqURL(t, method, fmt.Sprintf("http://%s:%d%s", testingHost, s.config.port, endpoint), body)
+}
+
+func tReqURL(t *testing.T,
+	method string,
+	url string,
+	body []byte,
 ) (int, []byte) {
 	t.Helper()
 	hc := &http.Client{
@@ -113,7 +143,7 @@ func tReq(t *testing.T,
 	}
 	rr, err := http.NewRequest(
 		method,
-		fmt.Sprintf("https://%s:%d%s", testingHost, s.config.tlsPort, endpoint),
+		url,
 		bytes.NewBuffer(body),
 	)
 	if err != nil {
@@ -166,6 +196,21 @@ func TestNewServer(t *testing.T) {
 		assert.Equal(t, 1, errDec[0].Error.Type)
 	})
 
+	t.Run("plain HTTP", func(t *testing.T) {
+		st, body := tReqHTTP(t, b, http.MethodGet, "/api/nouser/config", nil)
+		assert.Equal(t, http.StatusOK, st)
+		dec := unauthenticatedConfig{}
+		err := json.Unmarshal(body, &dec)
+		assert.NoError(t, err)
+
+		username := registerTestingUser(t, b)
+		st, body = tReqHTTP(t, b, http.MethodGet, fmt.Sprintf("/api/%s/lights", username), nil)
+		assert.Equal(t, http.StatusOK, st)
+		lightsDec := lights{}
+		err = json.Unmarshal(body, &lightsDec)
+		assert.NoError(t, err)
+	})
+
 	t.Run("method not allowed", func(t *testing.T) {
 		st, body := tReq(t, b, http.MethodPut, "/api", nil)
 		assert.Equal(t, http.StatusOK, st)
@@ -200,7 +245,7 @@ func TestWhitelist(t *testing.T) {
 		}
 		b.config.whitelistConfigPath = filepath.Join(dir, "whitelist.json")
 		b.config.Unlock()
-		err := b.saveWhitelistToFile()
+		err := b.saveWhitelist()
 		assert.NoError(t, err)
 
 		f, err := ioutil.ReadFile(filepath.Join(dir, "whitelist.json"))
@@ -215,7 +260,7 @@ func TestWhitelist(t *testing.T) {
 		b.config.Lock()
 		b.config.whitelistConfigPath = filepath.Join(dir, "whitelist.json")
 		b.config.Unlock()
-		res, err := b.loadWhitelistFromFile()
+		res, err := b.loadWhitelist()
 		assert.NoError(t, err)
 		assert.Len(t, *res, 1)
 	})
@@ -0,0 +1,222 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/render"
+)
+
+// settingsSchema is how the settings changed through the API are stored.
+// There are no settings from before they were versioned
+var settingsSchema = &schema{
+	Version: 1,
+	Migrations: []migration{
+		func(data json.RawMessage) (json.RawMessage, error) { return data, nil },
+	},
+}
+
+// zigbeeChannels are the channels a Hue bridge can be moved to
+var zigbeeChannels = []int{11, 15, 20, 25}
+
+// settings is the part of the configuration that can be changed through
+// the API. Once stored it takes precedence over the command line. MAC is
+// only set once the identity of another bridge was restored
+type settings struct {
+	Name     string `json:"name"`
+	Timezone string `json:"timezone"`
+	MAC      string `json:"mac,omitempty"`
+}
+
+// loadSettings applies the stored settings to the configuration
+func (s *Server) loadSettings() error {
+	path := s.config.settingsPath
+	if path == "" {
+		return nil
+	}
+	st := settings{}
+	err := loadObject(s.config.store, path, settingsSchema, &st)
+	if err == errNotStored {
+		s.logger.Info(fmt.Sprintf("settings do not exist at %s", path))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load settings from %s: %v", path, err)
+	}
+	tz, err := time.LoadLocation(st.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone in settings at %s: %v", path, err)
+	}
+	var mac net.HardwareAddr
+	if st.MAC != "" {
+		if mac, err = net.ParseMAC(st.MAC); err != nil {
+			return fmt.Errorf("invalid MAC in settings at %s: %v", path, err)
+		}
+	}
+
+	s.config.Lock()
+	if st.Name != "" {
+		s.config.Name = st.Name
+	}
+	s.config.timezone = tz
+	if mac != nil {
+		s.config.setMAC(MACAddr(mac))
+		s.config.adoptedMAC = MACAddr(mac)
+	}
+	s.config.Unlock()
+	s.logger.Info(fmt.Sprintf("settings loaded from: %s", path))
+	return nil
+}
+
+// saveSettings persists the settings, the caller must hold the lock
+func (s *Server) saveSettings() error {
+	path := s.config.settingsPath
+	if path == "" {
+		s.logger.Debug("no settings path specified, not persisting to disk")
+		return nil
+	}
+	st := settings{
+		Name:     s.config.Name,
+		Timezone: s.config.timezone.String(),
+	}
+	if s.config.adoptedMAC != nil {
+		st.MAC = net.HardwareAddr(s.config.adoptedMAC).String()
+	}
+	if err := saveObject(s.config.store, path, settingsSchema, st); err != nil {
+		return fmt.Errorf("failed to write settings to %s: %v", path, err)
+	}
+	return nil
+}
+
+// validBridgeName returns whether n can be used as the name of the bridge,
+// the Hue API allows 4 to 16 characters
+func validBridgeName(n string) bool {
+	l := utf8.RuneCountInString(n)
+	return l >= 4 && l <= 16
+}
+
+func (s *Server) updateConfig(w http.ResponseWriter, r *http.Request) {
+	if !r.Context().Value(AuthenticatedCtxKey).(bool) {
+		renderListOK(w, r, errUnauthorized(r))
+		return
+	}
+
+	params := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		renderListOK(w, r, errInvalidJSON())
+		return
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var (
+		name       *string
+		tz         *time.Location
+		linkButton *bool
+	)
+	resp := make([]render.Renderer, len(keys))
+	persisted := map[string]int{}
+	for i, k := range keys {
+		address := fmt.Sprintf("/config/%s", k)
+		raw := params[k]
+		switch k {
+		case "name":
+			n := ""
+			if err := json.Unmarshal(raw, &n); err != nil || !validBridgeName(n) {
+				resp[i] = errInvalidValueforParam(address, k, string(raw))
+				continue
+			}
+			name = &n
+			persisted[k] = i
+			resp[i] = &successResp{Success: map[string]interface{}{address: n}}
+		case "timezone":
+			t := ""
+			if err := json.Unmarshal(raw, &t); err != nil || !knownTimezone(t) {
+				resp[i] = errInvalidValueforParam(address, k, string(raw))
+				continue
+			}
+			loc, err := time.LoadLocation(t)
+			if err != nil {
+				resp[i] = errInvalidValueforParam(address, k, t)
+				continue
+			}
+			tz = loc
+			persisted[k] = i
+			resp[i] = &successResp{Success: map[string]interface{}{address: t}}
+		case "linkbutton":
+			b := false
+			if err := json.Unmarshal(raw, &b); err != nil {
+				resp[i] = errInvalidValueforParam(address, k, string(raw))
+				continue
+			}
+			linkButton = &b
+			resp[i] = &successResp{Success: map[string]interface{}{address: b}}
+		case "zigbeechannel":
+			// We don't have a radio, accept the channels a Hue bridge
+			// would and pretend we moved
+			ch := 0
+			if err := json.Unmarshal(raw, &ch); err != nil || !validZigbeeChannel(ch) {
+				resp[i] = errInvalidValueforParam(address, k, string(raw))
+				continue
+			}
+			resp[i] = &successResp{Success: map[string]interface{}{address: ch}}
+		default:
+			resp[i] = errParameterReadOnly(r, k)
+		}
+	}
+
+	if linkButton != nil {
+		if *linkButton {
+			s.PressLinkButton("API")
+		} else {
+			s.ReleaseLinkButton("API")
+		}
+	}
+
+	if name != nil || tz != nil {
+		s.config.Lock()
+		oldName, oldTZ := s.config.Name, s.config.timezone
+		if name != nil {
+			s.config.Name = *name
+		}
+		if tz != nil {
+			s.config.timezone = tz
+		}
+		err := s.saveSettings()
+		if err != nil {
+			s.config.Name, s.config.timezone = oldName, oldTZ
+		}
+		renamed := s.config.Name != oldName
+		s.config.Unlock()
+
+		if err != nil {
+			s.logger.Error(err.Error())
+			for k, i := range persisted {
+				resp[i] = errInternalError(fmt.Sprintf("/config/%s", k), "failed to persist settings")
+			}
+		} else if renamed {
+			s.logger.Info(fmt.Sprintf("bridge renamed from %s to %s", oldName, *name))
+			s.announcer.announce()
+		}
+	}
+
+	renderListOK(w, r, resp...)
+}
+
+// validZigbeeChannel returns whether ch is one of zigbeeChannels
+func validZigbeeChannel(ch int) bool {
+	for _, c := range zigbeeChannels {
+		if c == ch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateConfig(t *testing.T) {
+	st := NewMemoryStore()
+	s := newTestServer(t, Name("Philips hue"), Storage(st), SettingsPath("settings.json"))
+	s.config.Whitelist = &map[string]whitelist{"user": {Name: "user"}}
+	announced := s.announcer.subscribe()
+
+	r := chi.NewRouter()
+	r.Route("/api", func(r chi.Router) {
+		s.apiRoutes(r, false)
+	})
+	put := func(user, body string) []map[string]interface{} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/"+user+"/config", bytes.NewBufferString(body)))
+		dec := []map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &dec); err != nil {
+			t.Fatalf("%s: %s", err, rec.Body.String())
+		}
+		return dec
+	}
+	errType := func(item map[string]interface{}) float64 {
+		e, ok := item["error"].(map[string]interface{})
+		if !ok {
+			return 0
+		}
+		return e["type"].(float64)
+	}
+
+	t.Run("settings", func(t *testing.T) {
+		resp := put("user", `{"name": "Living room", "timezone": "Europe/Stockholm"}`)
+		if assert.Len(t, resp, 2) {
+			assert.Equal(t, map[string]interface{}{"/config/name": "Living room"}, resp[0]["success"])
+			assert.Equal(t, map[string]interface{}{"/config/timezone": "Europe/Stockholm"}, resp[1]["success"])
+		}
+		assert.Equal(t, "Living room", s.config.Name)
+		assert.Equal(t, "Europe/Stockholm", s.config.timezone.String())
+		assert.Len(t, announced, 1)
+		<-announced
+
+		restarted := newTestServer(t, Storage(st), SettingsPath("settings.json"))
+		assert.NoError(t, restarted.loadSettings())
+		assert.Equal(t, "Living room", restarted.config.Name)
+		assert.Equal(t, "Europe/Stockholm", restarted.config.timezone.String())
+	})
+	t.Run("same name", func(t *testing.T) {
+		resp := put("user", `{"name": "Living room"}`)
+		assert.Equal(t, 0.0, errType(resp[0]))
+		assert.Len(t, announced, 0)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		resp := put("user", `{"name": "abc", "timezone": "Mars/Olympus", "zigbeechannel": 12}`)
+		if assert.Len(t, resp, 3) {
+			for _, item := range resp {
+				assert.Equal(t, 7.0, errType(item))
+			}
+		}
+		assert.Equal(t, "Living room", s.config.Name)
+		assert.Equal(t, "Europe/Stockholm", s.config.timezone.String())
+
+		resp = put("user", `{"timezone": "Local"}`)
+		assert.Equal(t, 7.0, errType(resp[0]), "only the timezones in the capabilities can be set")
+		assert.Equal(t, "Europe/Stockholm", s.config.timezone.String())
+	})
+	t.Run("read-only", func(t *testing.T) {
+		resp := put("user", `{"zigbeechannel": 20, "bridgeid": "nope"}`)
+		if assert.Len(t, resp, 2) {
+			assert.Equal(t, 8.0, errType(resp[0]))
+			assert.Equal(t, map[string]interface{}{"/config/zigbeechannel": 20.0}, resp[1]["success"])
+		}
+		assert.Equal(t, "012345FFFE6789AB", s.config.BridgeID)
+	})
+	t.Run("link button", func(t *testing.T) {
+		put("user", `{"linkbutton": true}`)
+		assert.True(t, s.config.linkButtonPressed(now()))
+		put("user", `{"linkbutton": false}`)
+		assert.False(t, s.config.linkButtonPressed(now()))
+	})
+	t.Run("unauthorized", func(t *testing.T) {
+		resp := put("nope", `{"name": "Hijacked"}`)
+		assert.Equal(t, 1.0, errType(resp[0]))
+		assert.Equal(t, "Living room", s.config.Name)
+	})
+	t.Run("invalid JSON", func(t *testing.T) {
+		resp := put("user", `nope`)
+		assert.Equal(t, 2.0, errType(resp[0]))
+	})
+}
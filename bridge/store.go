@@ -0,0 +1,192 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// errNotStored is returned by a Store when nothing is stored under a name
+var errNotStored = errors.New("not stored")
+
+// Store persists the objects the bridge owns, like the whitelist. Writes
+// must be atomic: after a crash either the old or the new data is stored,
+// never a mix of both.
+type Store interface {
+	// Read returns the data stored under name, or errNotStored
+	Read(name string) ([]byte, error)
+	// Write atomically replaces the data stored under name
+	Write(name string, data []byte) error
+}
+
+// fileStore stores every object in its own file. Names are paths, relative
+// to dir unless they're absolute
+type fileStore struct {
+	dir string
+}
+
+// NewFileStore returns a Store that keeps its objects in files in dir
+func NewFileStore(dir string) Store {
+	return &fileStore{dir: dir}
+}
+
+func (fs *fileStore) path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(fs.dir, name)
+}
+
+func (fs *fileStore) Read(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fs.path(name))
+	if err != nil && os.IsNotExist(err) {
+		return nil, errNotStored
+	}
+	return data, err
+}
+
+// Write writes the data to a temporary file next to the destination, syncs
+// it and renames it over the destination. The directory is synced after so
+// the rename survives a crash too
+func (fs *fileStore) Write(name string, data []byte) error {
+	path := fs.path(name)
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// memoryStore keeps everything in memory, it's meant for tests
+type memoryStore struct {
+	data map[string][]byte
+	sync.Mutex
+}
+
+// NewMemoryStore returns a Store that keeps its objects in memory
+func NewMemoryStore() Store {
+	return &memoryStore{data: map[string][]byte{}}
+}
+
+func (ms *memoryStore) Read(name string) ([]byte, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	data, ok := ms.data[name]
+	if !ok {
+		return nil, errNotStored
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (ms *memoryStore) Write(name string, data []byte) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.data[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// migration upgrades data of one schema version to the next
+type migration func(data json.RawMessage) (json.RawMessage, error)
+
+// schema describes how an object type is stored. Migrations[i] upgrades
+// version i to version i+1, so Version must equal len(Migrations). Data
+// stored before we versioned it is version 0
+type schema struct {
+	Version    int
+	Migrations []migration
+}
+
+// versioned is how objects are stored
+type versioned struct {
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// decode unwraps the stored data and migrates it to the current version
+func (sc *schema) decode(stored []byte) (json.RawMessage, error) {
+	env := map[string]json.RawMessage{}
+	v := versioned{}
+	if err := json.Unmarshal(stored, &env); err == nil && len(env) == 2 &&
+		env["version"] != nil && env["data"] != nil {
+		if err := json.Unmarshal(stored, &v); err != nil {
+			return nil, err
+		}
+	} else {
+		v.Data = stored
+	}
+	if v.Version > sc.Version {
+		return nil, fmt.Errorf(
+			"stored with schema version %d but we only know up to %d", v.Version, sc.Version)
+	}
+	data := v.Data
+	for i := v.Version; i < sc.Version; i++ {
+		var err error
+		data, err = sc.Migrations[i](data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate from schema version %d: %v", i, err)
+		}
+	}
+	return data, nil
+}
+
+// encode wraps the data with the current version
+func (sc *schema) encode(data json.RawMessage) ([]byte, error) {
+	return json.Marshal(versioned{Version: sc.Version, Data: data})
+}
+
+// loadObject decodes the object stored under name into v. It returns
+// errNotStored if there's nothing stored
+func loadObject(st Store, name string, sc *schema, v interface{}) error {
+	stored, err := st.Read(name)
+	if err != nil {
+		return err
+	}
+	data, err := sc.decode(stored)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveObject atomically stores v under name
+func saveObject(st Store, name string, sc *schema, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode as JSON: %v", err)
+	}
+	stored, err := sc.encode(data)
+	if err != nil {
+		return err
+	}
+	return st.Write(name, stored)
+}
@@ -0,0 +1,121 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Store{
+		"file":   NewFileStore(dir),
+		"memory": NewMemoryStore(),
+	}
+	for name, st := range stores {
+		t.Run(name, func(t *testing.T) {
+			_, err := st.Read("nope.json")
+			assert.Equal(t, errNotStored, err)
+
+			assert.NoError(t, st.Write("obj.json", []byte("a")))
+			assert.NoError(t, st.Write("obj.json", []byte("b")))
+			data, err := st.Read("obj.json")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("b"), data)
+		})
+	}
+
+	t.Run("file", func(t *testing.T) {
+		files, err := ioutil.ReadDir(dir)
+		assert.NoError(t, err)
+		if assert.Len(t, files, 1, "temporary files should be gone") {
+			assert.Equal(t, "obj.json", files[0].Name())
+			assert.Equal(t, os.FileMode(0600), files[0].Mode().Perm())
+		}
+		st := NewFileStore("elsewhere")
+		data, err := st.Read(filepath.Join(dir, "obj.json"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("b"), data)
+	})
+}
+
+func TestSchema(t *testing.T) {
+	type obj struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	sc := &schema{
+		Version: 2,
+		Migrations: []migration{
+			func(data json.RawMessage) (json.RawMessage, error) { return data, nil },
+			func(data json.RawMessage) (json.RawMessage, error) {
+				o := obj{}
+				if err := json.Unmarshal(data, &o); err != nil {
+					return nil, err
+				}
+				o.Count = 1
+				return json.Marshal(o)
+			},
+		},
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		st := NewMemoryStore()
+		assert.NoError(t, saveObject(st, "obj", sc, obj{Name: "a", Count: 5}))
+		data, _ := st.Read("obj")
+		assert.JSONEq(t, `{"version": 2, "data": {"name": "a", "count": 5}}`, string(data))
+		o := obj{}
+		assert.NoError(t, loadObject(st, "obj", sc, &o))
+		assert.Equal(t, obj{Name: "a", Count: 5}, o)
+	})
+	t.Run("unversioned", func(t *testing.T) {
+		st := NewMemoryStore()
+		assert.NoError(t, st.Write("obj", []byte(`{"name": "a"}`)))
+		o := obj{}
+		assert.NoError(t, loadObject(st, "obj", sc, &o))
+		assert.Equal(t, obj{Name: "a", Count: 1}, o)
+	})
+	t.Run("migrate", func(t *testing.T) {
+		st := NewMemoryStore()
+		assert.NoError(t, st.Write("obj", []byte(`{"version": 1, "data": {"name": "a"}}`)))
+		o := obj{}
+		assert.NoError(t, loadObject(st, "obj", sc, &o))
+		assert.Equal(t, obj{Name: "a", Count: 1}, o)
+	})
+	t.Run("newer", func(t *testing.T) {
+		st := NewMemoryStore()
+		assert.NoError(t, st.Write("obj", []byte(`{"version": 3, "data": {}}`)))
+		assert.Error(t, loadObject(st, "obj", sc, &obj{}))
+	})
+	t.Run("not stored", func(t *testing.T) {
+		assert.Equal(t, errNotStored, loadObject(NewMemoryStore(), "obj", sc, &obj{}))
+	})
+}
+
+func TestWhitelistStore(t *testing.T) {
+	st := NewMemoryStore()
+	s := newTestServer(t, Storage(st), WhitelistConfigPath("whitelist.json"))
+
+	assert.NoError(t, st.Write("whitelist.json", []byte(`{"a": {"name": "legacy"}}`)))
+	wt, err := s.loadWhitelist()
+	assert.NoError(t, err)
+	assert.Equal(t, "legacy", (*wt)["a"].Name)
+
+	s.config.Whitelist = wt
+	assert.NoError(t, s.saveWhitelist())
+	data, _ := st.Read("whitelist.json")
+	assert.Contains(t, string(data), `"version":1`)
+
+	wt, err = s.loadWhitelist()
+	assert.NoError(t, err)
+	assert.Equal(t, "legacy", (*wt)["a"].Name)
+}
@@ -0,0 +1,328 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/pion/dtls/v2"
+)
+
+// DefaultStreamingRate is how many times a second streamed colours are
+// forwarded to the lights. Most Hemtjänst lights can't keep up with the 25
+// messages a second apps send
+const DefaultStreamingRate = 10
+
+const (
+	// maxStreamingRate is the most messages a second apps send
+	maxStreamingRate = 50
+	// streamHandshakeTimeout is how long a client gets to finish the DTLS
+	// handshake
+	streamHandshakeTimeout = 5 * time.Second
+	// streamIdleTimeout is how long a stream stays active without
+	// messages, the same as a real bridge
+	streamIdleTimeout = 10 * time.Second
+	// streamBufferSize fits the largest message of either version
+	streamBufferSize = 1024
+)
+
+var errStreamInactive = errors.New("no active stream for identity")
+
+// stream is the Entertainment API session that's streaming, and the colours
+// it sent that haven't been forwarded to the lights yet
+type stream struct {
+	conn    net.Conn
+	pending map[string]streamColor
+	// sent is what was last set on the features of every light, so only
+	// changes are published
+	sent map[string]map[string]string
+	sync.Mutex
+}
+
+func newStream() *stream {
+	return &stream{
+		pending: map[string]streamColor{},
+		sent:    map[string]map[string]string{},
+	}
+}
+
+// start makes conn the session, closing the one it replaces
+func (st *stream) start(conn net.Conn) {
+	st.Lock()
+	defer st.Unlock()
+	if st.conn != nil {
+		st.conn.Close()
+	}
+	st.conn = conn
+	st.pending = map[string]streamColor{}
+	st.sent = map[string]map[string]string{}
+}
+
+// end forgets conn and returns whether it was still the session
+func (st *stream) end(conn net.Conn) bool {
+	st.Lock()
+	defer st.Unlock()
+	if st.conn != conn {
+		return false
+	}
+	st.conn = nil
+	return true
+}
+
+// stop closes the session, if there is one
+func (st *stream) stop() {
+	st.Lock()
+	defer st.Unlock()
+	if st.conn != nil {
+		st.conn.Close()
+		st.conn = nil
+	}
+}
+
+// update stores the colours conn sent. It returns false if another session
+// replaced conn
+func (st *stream) update(conn net.Conn, colors map[string]streamColor) bool {
+	st.Lock()
+	defer st.Unlock()
+	if st.conn != conn {
+		return false
+	}
+	for id, c := range colors {
+		st.pending[id] = c
+	}
+	return true
+}
+
+// take returns the colours that haven't been forwarded yet and what was last
+// sent to the lights
+func (st *stream) take() (map[string]streamColor, map[string]map[string]string) {
+	st.Lock()
+	defer st.Unlock()
+	pending := st.pending
+	st.pending = map[string]streamColor{}
+	return pending, st.sent
+}
+
+// streamTargets maps the channels of the message to the lights of the group
+// that's streaming. Version 1 addresses lights by ID, which only has room
+// for the lower 16 bits of ours. Version 2 addresses them by channel, which
+// is their position in the group
+func streamTargets(msg *streamMessage, ids []string) map[string]streamColor {
+	res := map[string]streamColor{}
+	for _, ch := range msg.Channels {
+		if ch.Channel < 0 {
+			for _, id := range ids {
+				n, err := strconv.Atoi(id)
+				if err == nil && IntToStr(int(uint16(n))) == ch.Light {
+					res[id] = ch.Color
+				}
+			}
+			continue
+		}
+		if ch.Channel < len(ids) {
+			res[ids[ch.Channel]] = ch.Color
+		}
+	}
+	return res
+}
+
+// philips returns the colour as a Philips Hue brightness, 0 meaning off,
+// and CIE xy
+func (c streamColor) philips() (int, float64, float64) {
+	if c.Space == colorSpaceXY {
+		bri := int(math.Round(float64(c.Values[2]) / math.MaxUint16 * 254))
+		return bri, float64(c.Values[0]) / math.MaxUint16, float64(c.Values[1]) / math.MaxUint16
+	}
+	rgb := colorful.Color{
+		R: float64(c.Values[0]) / math.MaxUint16,
+		G: float64(c.Values[1]) / math.MaxUint16,
+		B: float64(c.Values[2]) / math.MaxUint16,
+	}
+	x, y, _ := rgb.Xyy()
+	bri := int(math.Round(math.Max(rgb.R, math.Max(rgb.G, rgb.B)) * 254))
+	return bri, x, y
+}
+
+type featureValue struct {
+	feature string
+	value   string
+}
+
+// streamValues returns the features to set on the light to show the colour,
+// in the order they should be set
+func streamValues(l *light, c streamColor) []featureValue {
+	bri, x, y := c.philips()
+	if bri == 0 {
+		return []featureValue{{"on", "0"}}
+	}
+	res := []featureValue{
+		{"on", "1"},
+		{"brightness", IntToStr(l.cal.hemtjanstBrightness(bri, l.briRange))},
+	}
+	if l.Type == rgbType {
+		hue, sat := l.cal.hemtjanstHS(x, y)
+		res = append(res, featureValue{"hue", IntToStr(hue)}, featureValue{"saturation", IntToStr(sat)})
+	}
+	return res
+}
+
+// forwardStream sets the colours that were streamed since the last call on
+// the lights. Lights come from the registry instead of MQTT since this runs
+// many times a second
+func (s *Server) forwardStream() {
+	pending, sent := s.stream.take()
+	if len(pending) == 0 {
+		return
+	}
+	s.registry.Lock()
+	ls := s.registry.lights()
+	s.registry.Unlock()
+
+	for id, c := range pending {
+		l, ok := ls[id]
+		if !ok || !l.State.Reachable {
+			continue
+		}
+		last, ok := sent[id]
+		if !ok {
+			last = map[string]string{}
+			sent[id] = last
+		}
+		d := s.mqtt.Device(l.topic)
+		for _, fv := range streamValues(l, c) {
+			if last[fv.feature] == fv.value {
+				continue
+			}
+			d.Feature(fv.feature).Set(fv.value)
+			last[fv.feature] = fv.value
+		}
+	}
+}
+
+// newStreamForwarder forwards what's streamed to the lights at the
+// configured rate until quit
+func (s *Server) newStreamForwarder(quit chan bool) {
+	s.config.RLock()
+	rate := s.config.streamingRate
+	s.config.RUnlock()
+
+	tick := time.NewTicker(time.Second / time.Duration(rate))
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			s.forwardStream()
+		case <-quit:
+			s.logger.Info("stopped stream forwarder")
+			return
+		}
+	}
+}
+
+// streamPSK returns the clientkey of the user that activated the stream,
+// identity is the username the client sent
+func (s *Server) streamPSK(identity []byte) ([]byte, error) {
+	_, owner, _ := s.streamingLights()
+	if owner == "" || owner != string(identity) {
+		return nil, errStreamInactive
+	}
+	key, ok := s.clientKey(owner)
+	if !ok {
+		return nil, fmt.Errorf("user %s has no clientkey", owner)
+	}
+	return key, nil
+}
+
+// createStreamListener listens for DTLS on the streaming address. Only
+// users that activated a stream can connect, using their clientkey
+func (s *Server) createStreamListener() (net.Listener, error) {
+	s.config.RLock()
+	address := s.config.streamingAddress
+	s.config.RUnlock()
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := dtls.Listen("udp", addr, &dtls.Config{
+		PSK:          s.streamPSK,
+		CipherSuites: []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+		ConnectContextMaker: func() (context.Context, func()) {
+			return context.WithTimeout(context.Background(), streamHandshakeTimeout)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info(fmt.Sprintf("streaming server listening on: %s", listener.Addr().String()))
+	return listener, nil
+}
+
+// serveStream accepts streams until the listener is closed. Only one
+// session streams at a time, a new one replaces it
+func (s *Server) serveStream(l net.Listener, quit chan bool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			s.logger.Warn(fmt.Sprintf("failed to accept stream: %v", err))
+			continue
+		}
+		go s.handleStream(conn)
+	}
+}
+
+// handleStream reads messages from the session until it goes idle, fails
+// or is replaced. A session that goes idle or fails deactivates the stream
+func (s *Server) handleStream(conn net.Conn) {
+	defer conn.Close()
+	identity := ""
+	if dc, ok := conn.(*dtls.Conn); ok {
+		identity = string(dc.ConnectionState().IdentityHint)
+	}
+	groupID, owner, _ := s.streamingLights()
+	if groupID == "" || owner != identity {
+		s.logger.Warn(fmt.Sprintf("refusing stream from %s, it's not active for %s",
+			conn.RemoteAddr(), identity))
+		return
+	}
+
+	s.stream.start(conn)
+	s.logger.Info(fmt.Sprintf("streaming to group %s from %s", groupID, conn.RemoteAddr()))
+	buf := make([]byte, streamBufferSize)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if s.stream.end(conn) {
+				s.stopStream(groupID, owner)
+				s.logger.Info(fmt.Sprintf("stream to group %s ended: %v", groupID, err))
+			}
+			return
+		}
+		msg, err := parseHueStream(buf[:n])
+		if err != nil {
+			s.logger.Debug(fmt.Sprintf("ignoring stream message: %v", err))
+			continue
+		}
+		// The lights of the group can change while it's streaming
+		id, o, ids := s.streamingLights()
+		if id != groupID || o != owner {
+			s.stream.end(conn)
+			return
+		}
+		if !s.stream.update(conn, streamTargets(msg, ids)) {
+			return
+		}
+	}
+}
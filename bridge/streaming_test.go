@@ -0,0 +1,131 @@
+package bridge
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamTargets(t *testing.T) {
+	ids := []string{"3", "65539", "1234567"}
+	red := streamColor{Space: colorSpaceRGB, Values: [3]uint16{0xffff, 0, 0}}
+	blue := streamColor{Space: colorSpaceRGB, Values: [3]uint16{0, 0, 0xffff}}
+
+	t.Run("version 1", func(t *testing.T) {
+		msg := &streamMessage{Major: 1, Channels: []streamChannel{
+			{Light: "54919", Channel: -1, Color: red},
+			{Light: "42", Channel: -1, Color: blue},
+		}}
+		assert.Equal(t, map[string]streamColor{"1234567": red}, streamTargets(msg, ids))
+
+		msg = &streamMessage{Major: 1, Channels: []streamChannel{{Light: "3", Channel: -1, Color: blue}}}
+		assert.Equal(t, map[string]streamColor{"3": blue, "65539": blue}, streamTargets(msg, ids),
+			"lights with the same lower 16 bits share a channel")
+	})
+	t.Run("version 2", func(t *testing.T) {
+		msg := &streamMessage{Major: 2, Channels: []streamChannel{
+			{Channel: 1, Color: red},
+			{Channel: 2, Color: blue},
+			{Channel: 3, Color: red},
+		}}
+		assert.Equal(t, map[string]streamColor{"65539": red, "1234567": blue}, streamTargets(msg, ids))
+	})
+}
+
+func TestStreamValues(t *testing.T) {
+	rgb := &light{Type: rgbType, briRange: defaultBrightnessRange}
+	white := &light{Type: whiteType, briRange: defaultBrightnessRange}
+
+	t.Run("off", func(t *testing.T) {
+		off := streamColor{Space: colorSpaceRGB}
+		assert.Equal(t, []featureValue{{"on", "0"}}, streamValues(rgb, off))
+		off = streamColor{Space: colorSpaceXY, Values: [3]uint16{0x5000, 0x5000, 0}}
+		assert.Equal(t, []featureValue{{"on", "0"}}, streamValues(white, off))
+	})
+	t.Run("RGB", func(t *testing.T) {
+		red := streamColor{Space: colorSpaceRGB, Values: [3]uint16{0xffff, 0, 0}}
+		bri, x, y := red.philips()
+		assert.Equal(t, 254, bri)
+		assert.InDelta(t, 0.64, x, 0.001)
+		assert.InDelta(t, 0.33, y, 0.001)
+
+		hue, sat := CIExyToHemtjanstHS(x, y)
+		assert.Equal(t, []featureValue{
+			{"on", "1"},
+			{"brightness", IntToStr(brightnessToHemtjanst(254, defaultBrightnessRange))},
+			{"hue", IntToStr(hue)},
+			{"saturation", IntToStr(sat)},
+		}, streamValues(rgb, red))
+		assert.Len(t, streamValues(white, red), 2, "white lights only get brightness")
+	})
+	t.Run("xy", func(t *testing.T) {
+		c := streamColor{Space: colorSpaceXY, Values: [3]uint16{0x8000, 0x4000, 0x8000}}
+		bri, x, y := c.philips()
+		assert.Equal(t, 127, bri)
+		assert.InDelta(t, 0.5, x, 0.001)
+		assert.InDelta(t, 0.25, y, 0.001)
+	})
+}
+
+func TestStreamSession(t *testing.T) {
+	key := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	s := newTestServer(t, StreamingAddress("127.0.0.1:0"))
+	(*s.config.Whitelist)["streamer"] = whitelist{ClientKey: "0123456789ABCDEF0123456789ABCDEF"}
+	(*s.config.Whitelist)["other"] = whitelist{ClientKey: "0123456789ABCDEF0123456789ABCDEF"}
+	s.entertainment.Areas["200"] = &entertainmentArea{Lights: []string{"1", "2"}, owner: "streamer"}
+
+	l, err := s.createStreamListener()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	quit := make(chan bool)
+	defer func() {
+		close(quit)
+		l.Close()
+	}()
+	go s.serveStream(l, quit)
+
+	dial := func(identity string) (*dtls.Conn, error) {
+		return dtls.Dial("udp", l.Addr().(*net.UDPAddr), &dtls.Config{
+			PSK:             func([]byte) ([]byte, error) { return key, nil },
+			PSKIdentityHint: []byte(identity),
+			CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+		})
+	}
+
+	t.Run("not the owner", func(t *testing.T) {
+		_, err := dial("other")
+		assert.Error(t, err)
+	})
+	t.Run("stream", func(t *testing.T) {
+		conn, err := dial("streamer")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		msg := append(hueStreamHeader(2, colorSpaceRGB), make([]byte, hueStreamV2ConfigSize)...)
+		msg = append(msg, 0x01, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00)
+		_, err = conn.Write(msg)
+		assert.NoError(t, err)
+
+		var pending map[string]streamColor
+		for i := 0; i < 50 && len(pending) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+			pending, _ = s.stream.take()
+		}
+		assert.Equal(t, map[string]streamColor{
+			"2": {Space: colorSpaceRGB, Values: [3]uint16{0xffff, 0, 0}},
+		}, pending)
+
+		conn.Close()
+		id := "200"
+		for i := 0; i < 50 && id != ""; i++ {
+			time.Sleep(10 * time.Millisecond)
+			id, _, _ = s.streamingLights()
+		}
+		assert.Equal(t, "", id, "closing the session should deactivate the stream")
+	})
+}
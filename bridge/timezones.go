@@ -0,0 +1,134 @@
+package bridge
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// zoneinfoDirs are where the system tzdata usually lives, the same places
+// the time package looks
+var zoneinfoDirs = []string{
+	"/usr/share/zoneinfo/",
+	"/usr/share/lib/zoneinfo/",
+	"/usr/lib/locale/TZ/",
+}
+
+var (
+	timezonesOnce sync.Once
+	timezonesList []string
+)
+
+// tzifMagic is how every zoneinfo file starts
+var tzifMagic = []byte("TZif")
+
+// timezones returns the IANA names of all timezones we can load, sorted. The
+// list is built once from ZONEINFO or the system tzdata. Like
+// time.LoadLocation it falls back to the zoneinfo.zip of the Go installation
+// the binary was built with, which is usually only there on the build host.
+// On images without any of them, like scratch or distroless, it's just UTC
+func timezones() []string {
+	timezonesOnce.Do(func() {
+		names := map[string]bool{}
+		if dir := os.Getenv("ZONEINFO"); dir != "" {
+			listZoneinfo(dir, names)
+		}
+		for _, dir := range zoneinfoDirs {
+			if len(names) > 0 {
+				break
+			}
+			listZoneinfoDir(dir, names)
+		}
+		if len(names) == 0 {
+			listZoneinfo(filepath.Join(runtime.GOROOT(), "lib", "time", "zoneinfo.zip"), names)
+		}
+		names["UTC"] = true
+
+		for n := range names {
+			timezonesList = append(timezonesList, n)
+		}
+		sort.Strings(timezonesList)
+	})
+	return timezonesList
+}
+
+// knownTimezone returns whether name is one of the timezones we list, so
+// names time.LoadLocation also takes, like Local, aren't accepted
+func knownTimezone(name string) bool {
+	tzs := timezones()
+	i := sort.SearchStrings(tzs, name)
+	return i < len(tzs) && tzs[i] == name
+}
+
+// listZoneinfo adds the timezones in path, which is a directory or a
+// zoneinfo.zip like ZONEINFO can point to
+func listZoneinfo(path string, names map[string]bool) {
+	if strings.HasSuffix(path, ".zip") {
+		listZoneinfoZip(path, names)
+		return
+	}
+	listZoneinfoDir(path, names)
+}
+
+func listZoneinfoDir(dir string, names map[string]bool) {
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		name, _ := filepath.Rel(dir, path)
+		name = filepath.ToSlash(name)
+		if info.IsDir() {
+			if name != "." && !validZoneName(name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !validZoneName(name) {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		magic := make([]byte, len(tzifMagic))
+		if _, err := io.ReadFull(f, magic); err == nil && bytes.Equal(magic, tzifMagic) {
+			names[name] = true
+		}
+		return nil
+	})
+}
+
+func listZoneinfoZip(path string, names map[string]bool) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+	for _, f := range z.File {
+		if !f.FileInfo().IsDir() && validZoneName(f.Name) {
+			names[f.Name] = true
+		}
+	}
+}
+
+// validZoneName filters out what's in zoneinfo but isn't a timezone, like
+// the leap second variants and the files describing the local timezone
+func validZoneName(name string) bool {
+	first := strings.SplitN(name, "/", 2)[0]
+	switch first {
+	case "posix", "right", "SystemV", "localtime", "posixrules", "Factory":
+		return false
+	}
+	// Skip files like zone.tab, iso3166.tab and leap-seconds.list
+	if strings.Contains(name, ".") || first == strings.ToLower(first) {
+		return false
+	}
+	return true
+}
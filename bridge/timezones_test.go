@@ -0,0 +1,58 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimezones(t *testing.T) {
+	t.Run("dir", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "zoneinfo")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer os.RemoveAll(dir)
+
+		files := map[string]string{
+			"Europe/Stockholm":               "TZif2",
+			"America/Argentina/Buenos_Aires": "TZif2",
+			"UTC":                            "TZif2",
+			"Broken":                         "nope",
+			"posix/Europe/Oslo":              "TZif2",
+			"right/UTC":                      "TZif2",
+			"localtime":                      "TZif2",
+			"zone.tab":                       "TZif2",
+			"leapseconds":                    "TZif2",
+		}
+		for name, content := range files {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+
+		names := map[string]bool{}
+		listZoneinfo(dir, names)
+		assert.Equal(t, map[string]bool{
+			"Europe/Stockholm":               true,
+			"America/Argentina/Buenos_Aires": true,
+			"UTC":                            true,
+		}, names)
+	})
+	t.Run("list", func(t *testing.T) {
+		tzs := timezones()
+		assert.Contains(t, tzs, "UTC")
+		assert.True(t, sort.StringsAreSorted(tzs))
+		assert.True(t, knownTimezone("UTC"))
+		assert.False(t, knownTimezone("Local"))
+		assert.False(t, knownTimezone(""))
+	})
+}
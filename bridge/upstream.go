@@ -0,0 +1,276 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUpstreamPollInterval is how often the upstream bridge is
+	// polled by default
+	DefaultUpstreamPollInterval = 2 * time.Second
+	// upstreamTimeout is how long a request to the upstream bridge may
+	// take
+	upstreamTimeout = 5 * time.Second
+)
+
+// upstreamTopic is the topic an upstream light or sensor is given its ID
+// for, like a Hemtjanst light by its MQTT topic
+func upstreamTopic(resource, id string) string {
+	return fmt.Sprintf("upstream/%s/%s", resource, id)
+}
+
+// upstreamBridge is a real Hue bridge whose lights and sensors are
+// presented next to the Hemtjanst ones
+type upstreamBridge struct {
+	// base is the URL of the API of the upstream bridge for our user
+	base   string
+	client *http.Client
+	// lights and sensors are keyed by their ID on the upstream bridge
+	lights  lights
+	sensors sensors
+	// refresh asks for a poll right away, after a light was changed
+	refresh chan bool
+	sync.RWMutex
+}
+
+func newUpstreamBridge(address, username string) *upstreamBridge {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return &upstreamBridge{
+		base:    fmt.Sprintf("%s/api/%s", strings.TrimSuffix(address, "/"), username),
+		client:  &http.Client{Timeout: upstreamTimeout},
+		lights:  lights{},
+		sensors: sensors{},
+		refresh: make(chan bool, 1),
+	}
+}
+
+// getLights returns a copy of the upstream lights
+func (u *upstreamBridge) getLights() lights {
+	res := lights{}
+	if u == nil {
+		return res
+	}
+	u.RLock()
+	defer u.RUnlock()
+	for id, l := range u.lights {
+		cp := *l
+		res[id] = &cp
+	}
+	return res
+}
+
+// getSensors returns the upstream sensors
+func (u *upstreamBridge) getSensors() sensors {
+	res := sensors{}
+	if u == nil {
+		return res
+	}
+	u.RLock()
+	defer u.RUnlock()
+	for id, sen := range u.sensors {
+		res[id] = sen
+	}
+	return res
+}
+
+func (u *upstreamBridge) get(resource string, v interface{}) error {
+	resp, err := u.client.Get(u.base + resource)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream bridge returned %s for %s", resp.Status, resource)
+	}
+	// An error, like an unauthorized user, comes back as a list
+	raw := json.RawMessage{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return err
+	}
+	if len(raw) > 0 && raw[0] == '[' {
+		errs := []*errorResp{}
+		if err := json.Unmarshal(raw, &errs); err == nil && len(errs) > 0 {
+			return fmt.Errorf("upstream bridge returned an error for %s: %s",
+				resource, errs[0].Error.Description)
+		}
+		return fmt.Errorf("upstream bridge returned a list for %s", resource)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// poll fetches the lights and sensors of the upstream bridge and returns
+// whether anything changed. If it fails, the lights are kept around but
+// unreachable
+func (u *upstreamBridge) poll() (bool, error) {
+	ls := lights{}
+	sens := sensors{}
+	err := u.get("/lights", &ls)
+	if err == nil {
+		err = u.get("/sensors", &sens)
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	if err != nil {
+		changed := false
+		for _, l := range u.lights {
+			changed = changed || l.State.Reachable
+			l.State.Reachable = false
+		}
+		return changed, err
+	}
+
+	before, _ := json.Marshal([]interface{}{u.lights, u.sensors})
+	u.lights = lights{}
+	for id, l := range ls {
+		if l == nil {
+			continue
+		}
+		l.upstream = id
+		// Only lights on Hemtjanst can be streamed to
+		if l.Capabilities != nil {
+			l.Capabilities.Streaming = &lightStreaming{}
+		}
+		u.lights[id] = l
+	}
+	u.sensors = sensors{}
+	for id, sen := range sens {
+		// The bridge has a daylight sensor of its own
+		if sen.Type == "Daylight" {
+			continue
+		}
+		u.sensors[id] = sen
+	}
+	after, _ := json.Marshal([]interface{}{u.lights, u.sensors})
+	return !bytes.Equal(before, after), nil
+}
+
+// updateLightState sends the update to the upstream bridge and translates
+// its response
+func (u *upstreamBridge) updateLightState(l *light, state *lightStateUpdate) *lightUpdateStateResult {
+	res := &lightUpdateStateResult{
+		Success:      map[string]interface{}{},
+		InvalidValue: map[string]interface{}{},
+	}
+	if !l.State.Reachable {
+		res.DeviceUnreachable = state.params()
+		return res
+	}
+	body := upstreamBody(state)
+	b, err := json.Marshal(body)
+	if err != nil {
+		res.InternalError = true
+		return res
+	}
+	req, err := http.NewRequest(http.MethodPut,
+		fmt.Sprintf("%s/lights/%s/state", u.base, l.upstream), bytes.NewReader(b))
+	if err != nil {
+		res.InternalError = true
+		return res
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		res.DeviceUnreachable = state.params()
+		return res
+	}
+	defer resp.Body.Close()
+
+	results := []struct {
+		Success map[string]interface{} `json:"success"`
+		Error   *innerErrResp          `json:"error"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		res.InternalError = true
+		return res
+	}
+	for _, r := range results {
+		for addr, v := range r.Success {
+			res.Success[addr[strings.LastIndex(addr, "/")+1:]] = v
+		}
+		if r.Error == nil {
+			continue
+		}
+		param := r.Error.Address[strings.LastIndex(r.Error.Address, "/")+1:]
+		switch r.Error.Type {
+		case 6:
+			res.InvalidParameter = append(res.InvalidParameter, param)
+		case 7:
+			res.InvalidValue[param] = body[param]
+		case 201:
+			res.DeviceIsOff = append(res.DeviceIsOff, param)
+		default:
+			res.InternalError = true
+		}
+	}
+
+	select {
+	case u.refresh <- true:
+	default:
+	}
+	return res
+}
+
+// upstreamBody returns the parameters set in the update with their values,
+// everything the upstream bridge understands is passed on
+func upstreamBody(state *lightStateUpdate) map[string]interface{} {
+	body := map[string]interface{}{}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return body
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return body
+	}
+	for p, v := range body {
+		if v == nil {
+			delete(body, p)
+		}
+	}
+	return body
+}
+
+// pollUpstream polls the upstream bridge until quit, and tells the event
+// stream when something changed
+func (s *Server) pollUpstream(quit chan bool) {
+	s.config.RLock()
+	interval := s.config.upstreamPollInterval
+	s.config.RUnlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	poll := func() {
+		changed, err := s.upstream.poll()
+		if err != nil && !failing {
+			s.logger.Warn(fmt.Sprintf("failed to poll upstream bridge: %v", err))
+		}
+		if err == nil && failing {
+			s.logger.Info("upstream bridge is reachable again")
+		}
+		failing = err != nil
+		if changed {
+			s.events.notify()
+		}
+	}
+
+	poll()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-s.upstream.refresh:
+			poll()
+		case <-ticker.C:
+			poll()
+		}
+	}
+}
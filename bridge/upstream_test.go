@@ -0,0 +1,155 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const upstreamLights = `{
+	"1": {
+		"state": {"on": true, "bri": 144, "xy": [0.4, 0.4], "ct": 366, "reachable": true, "colormode": "xy"},
+		"type": "Extended color light",
+		"name": "Kitchen",
+		"modelid": "LCT015",
+		"capabilities": {"certified": true, "streaming": {"renderer": true, "proxy": true}},
+		"uniqueid": "00:17:88:01:00:aa:bb:cc-0b"
+	},
+	"2": null
+}`
+
+const upstreamSensors = `{
+	"1": {"state": {"daylight": true}, "config": {"on": true}, "name": "Daylight", "type": "Daylight"},
+	"5": {"state": {"presence": false, "lastupdated": "2019-04-07T00:00:00"}, "config": {"on": true},
+		"name": "Hallway sensor", "type": "ZLLPresence", "modelid": "SML001"}
+}`
+
+func newFakeUpstream(t *testing.T, put func(body map[string]interface{}) string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/user/lights":
+			w.Write([]byte(upstreamLights))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/user/sensors":
+			w.Write([]byte(upstreamSensors))
+		case r.Method == http.MethodPut && r.URL.Path == "/api/user/lights/1/state":
+			b, _ := ioutil.ReadAll(r.Body)
+			body := map[string]interface{}{}
+			assert.NoError(t, json.Unmarshal(b, &body))
+			w.Write([]byte(put(body)))
+		default:
+			w.Write([]byte(`[{"error": {"type": 1, "address": "/", "description": "unauthorized user"}}]`))
+		}
+	}))
+}
+
+func TestUpstreamID(t *testing.T) {
+	srv := newFakeUpstream(t, nil)
+	defer srv.Close()
+
+	for _, alexa := range []bool{false, true} {
+		s := newTestServer(t, AlexaCompatibility(alexa))
+		s.upstream = newUpstreamBridge(srv.URL, "user")
+		_, err := s.upstream.poll()
+		assert.NoError(t, err)
+
+		ls := s.upstreamLights()
+		if assert.Len(t, ls, 1) {
+			for id, l := range ls {
+				n, err := strconv.ParseInt(id, 10, 32)
+				assert.NoError(t, err, "the Android Hue app can't handle IDs larger than an int32")
+				assert.Equal(t, "1", l.upstream)
+				if alexa {
+					assert.Equal(t, int64(1), n)
+				}
+			}
+		}
+		sens := s.createSensors()
+		assert.Len(t, sens, 2)
+		assert.Equal(t, "ZLLPresence", sens[TopicToStrInt("upstream/sensors/5")].Type)
+	}
+
+	assert.Equal(t, "http://192.168.1.2/api/user", newUpstreamBridge("192.168.1.2", "user").base)
+	assert.Equal(t, "https://hue.local/api/user", newUpstreamBridge("https://hue.local/", "user").base)
+}
+
+func TestUpstreamPoll(t *testing.T) {
+	srv := newFakeUpstream(t, nil)
+	u := newUpstreamBridge(srv.URL, "user")
+
+	changed, err := u.poll()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	ls := u.getLights()
+	if assert.Len(t, ls, 1) {
+		l := ls["1"]
+		assert.Equal(t, "Kitchen", l.Name)
+		assert.Equal(t, "1", l.upstream)
+		assert.Equal(t, 144, l.State.Brightness)
+		assert.False(t, l.Capabilities.Streaming.Renderer, "imported lights can't be streamed to")
+	}
+	sens := u.getSensors()
+	if assert.Len(t, sens, 1, "the daylight sensor shouldn't be imported") {
+		assert.Equal(t, "ZLLPresence", sens["5"].Type)
+	}
+
+	changed, err = u.poll()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	srv.Close()
+	changed, err = u.poll()
+	assert.Error(t, err)
+	assert.True(t, changed)
+	assert.False(t, u.getLights()["1"].State.Reachable)
+
+	u = newUpstreamBridge(srv.URL, "nobody")
+	srv = newFakeUpstream(t, nil)
+	defer srv.Close()
+	u.base = srv.URL + "/api/nobody"
+	_, err = u.poll()
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "unauthorized user"))
+	}
+}
+
+func TestUpstreamUpdateLightState(t *testing.T) {
+	srv := newFakeUpstream(t, func(body map[string]interface{}) string {
+		if _, ok := body["ct"]; ok {
+			return `[{"error": {"type": 6, "address": "/lights/1/state/ct", "description": "parameter, ct, not available"}}]`
+		}
+		if body["bri"] == float64(300) {
+			return `[{"error": {"type": 7, "address": "/lights/1/state/bri", "description": "invalid value, 300, for parameter, bri"}}]`
+		}
+		if _, ok := body["xy"]; ok {
+			return `[{"error": {"type": 201, "address": "/lights/1/state/xy", "description": "parameter, xy, is not modifiable. Device is set to off."}}]`
+		}
+		return `[{"success": {"/lights/1/state/on": true}}, {"success": {"/lights/1/state/bri": 200}}]`
+	})
+	defer srv.Close()
+	u := newUpstreamBridge(srv.URL, "user")
+	l := &light{upstream: "1", State: lightState{Reachable: true}}
+
+	res := u.updateLightState(l, &lightStateUpdate{On: BoolPtr(true), Brightness: IntPtr(200)})
+	assert.Equal(t, map[string]interface{}{"on": true, "bri": float64(200)}, res.Success)
+	assert.Len(t, u.refresh, 1, "a change should be picked up right away")
+
+	res = u.updateLightState(l, &lightStateUpdate{ColorTemperature: IntPtr(300)})
+	assert.Equal(t, []string{"ct"}, res.InvalidParameter)
+
+	res = u.updateLightState(l, &lightStateUpdate{Brightness: IntPtr(300)})
+	assert.Equal(t, map[string]interface{}{"bri": float64(300)}, res.InvalidValue)
+
+	res = u.updateLightState(l, &lightStateUpdate{XY: &[]float64{0.3, 0.3}})
+	assert.Equal(t, []string{"xy"}, res.DeviceIsOff)
+
+	l.State.Reachable = false
+	res = u.updateLightState(l, &lightStateUpdate{On: BoolPtr(true)})
+	assert.Equal(t, []string{"on"}, res.DeviceUnreachable)
+}
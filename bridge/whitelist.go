@@ -0,0 +1,191 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// whitelistFlushInterval is how often the last use dates of whitelist
+// entries are written to the whitelist
+const whitelistFlushInterval = time.Minute
+
+// whitelistSchema is how the whitelist is stored. Version 0 is the bare
+// map of entries we wrote before the whitelist was versioned
+var whitelistSchema = &schema{
+	Version: 1,
+	Migrations: []migration{
+		func(data json.RawMessage) (json.RawMessage, error) { return data, nil },
+	},
+}
+
+func (s *Server) loadWhitelist() (*map[string]whitelist, error) {
+	path := s.config.whitelistConfigPath
+	wt := map[string]whitelist{}
+	if path == "" {
+		return &wt, nil
+	}
+	err := loadObject(s.config.store, path, whitelistSchema, &wt)
+	if err == errNotStored {
+		s.logger.Info(fmt.Sprintf("whitelist does not exist at %s", path))
+		return &wt, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load whitelist from %s: %v", path, err)
+	}
+	if wt == nil {
+		wt = map[string]whitelist{}
+	}
+	s.logger.Info(fmt.Sprintf("whitelist loaded from: %s", path))
+	return &wt, nil
+}
+
+// saveWhitelist persists the whitelist, the caller must hold the lock
+func (s *Server) saveWhitelist() error {
+	path := s.config.whitelistConfigPath
+	if path == "" {
+		s.logger.Debug("no whitelist config path specified, not persisting to disk")
+		return nil
+	}
+	err := saveObject(s.config.store, path, whitelistSchema, s.config.Whitelist)
+	if err != nil {
+		return fmt.Errorf("failed to write whitelist to %s: %v", path, err)
+	}
+	return nil
+}
+
+// whitelistUsage collects when whitelist entries were last used so we don't
+// have to write the whitelist to disk on every request
+type whitelistUsage struct {
+	used map[string]time.Time
+	sync.Mutex
+}
+
+func newWhitelistUsage() *whitelistUsage {
+	return &whitelistUsage{
+		used: map[string]time.Time{},
+	}
+}
+
+// touch records that the entry was used at t
+func (u *whitelistUsage) touch(id string, t time.Time) {
+	u.Lock()
+	defer u.Unlock()
+	u.used[id] = t
+}
+
+// drain returns what was used since the last drain
+func (u *whitelistUsage) drain() map[string]time.Time {
+	u.Lock()
+	defer u.Unlock()
+	used := u.used
+	u.used = map[string]time.Time{}
+	return used
+}
+
+// putBack returns drained usage that couldn't be saved, unless the entry
+// has been used since
+func (u *whitelistUsage) putBack(used map[string]time.Time) {
+	u.Lock()
+	defer u.Unlock()
+	for id, t := range used {
+		if t.After(u.used[id]) {
+			u.used[id] = t
+		}
+	}
+}
+
+// copyWhitelist returns a copy of the whitelist that can be changed without
+// affecting the original
+func copyWhitelist(wt map[string]whitelist) map[string]whitelist {
+	res := make(map[string]whitelist, len(wt))
+	for id, entry := range wt {
+		res[id] = entry
+	}
+	return res
+}
+
+// lastUse returns when the entry was last used, falling back to when it was
+// created
+func (w whitelist) lastUse() (time.Time, bool) {
+	for _, v := range []string{w.LastUsedAt, w.CreatedAt} {
+		if t, err := ISO8600ToDateTime(v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// flushWhitelist updates the last use dates of the whitelist, removes
+// entries that expired at t and persists the whitelist if anything changed
+func (s *Server) flushWhitelist(t time.Time) error {
+	used := s.usage.drain()
+
+	s.config.Lock()
+	defer s.config.Unlock()
+	oldwt := *s.config.Whitelist
+	wt := copyWhitelist(oldwt)
+
+	changed := false
+	for id, ut := range used {
+		entry, ok := wt[id]
+		if !ok {
+			continue
+		}
+		entry.LastUsedAt = DateTimeToISO8600(ut.UTC())
+		wt[id] = entry
+		changed = true
+	}
+
+	expired := []string{}
+	if expiry := s.config.whitelistExpiry; expiry > 0 {
+		for id, entry := range wt {
+			last, ok := entry.lastUse()
+			if !ok || t.Sub(last) <= expiry {
+				continue
+			}
+			expired = append(expired, id)
+			delete(wt, id)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	s.config.Whitelist = &wt
+	err := s.saveWhitelist()
+	if err != nil {
+		s.config.Whitelist = &oldwt
+		s.usage.putBack(used)
+		return err
+	}
+	for _, id := range expired {
+		entry := oldwt[id]
+		s.logger.Info(fmt.Sprintf("removed whitelist entry %s (%s), last used %s",
+			id, entry.Name, entry.LastUsedAt))
+	}
+	return nil
+}
+
+// newWhitelistFlusher periodically flushes the whitelist until told to quit,
+// flushing one last time before it returns
+func (s *Server) newWhitelistFlusher(quit chan bool) {
+	tick := time.NewTicker(whitelistFlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-quit:
+			if err := s.flushWhitelist(now()); err != nil {
+				s.logger.Error(err.Error())
+			}
+			s.logger.Info("stopped whitelist flusher")
+			return
+		case <-tick.C:
+			if err := s.flushWhitelist(now()); err != nil {
+				s.logger.Error(err.Error())
+			}
+		}
+	}
+}
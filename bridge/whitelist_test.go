@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWhitelistUsage(t *testing.T) {
+	u := newWhitelistUsage()
+	t1 := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	u.touch("a", t1)
+	u.touch("a", t1.Add(time.Minute))
+	u.touch("b", t1)
+	assert.Equal(t, map[string]time.Time{
+		"a": t1.Add(time.Minute),
+		"b": t1,
+	}, u.drain())
+	assert.Len(t, u.drain(), 0)
+
+	u.touch("a", t1.Add(time.Hour))
+	u.putBack(map[string]time.Time{"a": t1, "b": t1})
+	assert.Equal(t, map[string]time.Time{
+		"a": t1.Add(time.Hour),
+		"b": t1,
+	}, u.drain(), "later uses should win over the ones put back")
+}
+
+func TestFlushWhitelist(t *testing.T) {
+	t1 := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	newServer := func(t *testing.T, opts ...ConfigOption) *Server {
+		s := newTestServer(t, opts...)
+		s.config.Whitelist = &map[string]whitelist{
+			"fresh": {
+				Name:       "fresh",
+				CreatedAt:  "2019-09-01T12:00:00",
+				LastUsedAt: "2019-09-30T12:00:00",
+			},
+			"stale": {
+				Name:       "stale",
+				CreatedAt:  "2019-01-01T12:00:00",
+				LastUsedAt: "2019-01-01T12:00:00",
+			},
+			"unknown": {
+				Name: "unknown",
+			},
+		}
+		return s
+	}
+
+	t.Run("last use", func(t *testing.T) {
+		s := newServer(t)
+		s.usage.touch("fresh", t1)
+		s.usage.touch("deleted", t1)
+		assert.NoError(t, s.flushWhitelist(t1))
+		wt := *s.config.Whitelist
+		assert.Len(t, wt, 3)
+		assert.Equal(t, "2019-10-01T12:00:00", wt["fresh"].LastUsedAt)
+		assert.Equal(t, "2019-01-01T12:00:00", wt["stale"].LastUsedAt)
+	})
+	t.Run("expiry", func(t *testing.T) {
+		s := newServer(t, WhitelistExpiry(30*24*time.Hour))
+		s.usage.touch("stale", t1.Add(-31*24*time.Hour))
+		assert.NoError(t, s.flushWhitelist(t1))
+		wt := *s.config.Whitelist
+		assert.Len(t, wt, 2)
+		assert.Contains(t, wt, "fresh")
+		assert.Contains(t, wt, "unknown")
+	})
+	t.Run("failed save", func(t *testing.T) {
+		s := newServer(t, WhitelistExpiry(30*24*time.Hour), WhitelistConfigPath("/harhar/nope.derp"))
+		s.usage.touch("fresh", t1)
+		assert.Error(t, s.flushWhitelist(t1))
+		assert.Len(t, *s.config.Whitelist, 3)
+		assert.Equal(t, map[string]time.Time{"fresh": t1}, s.usage.drain(),
+			"the last use should be saved next time")
+	})
+}
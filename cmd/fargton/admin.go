@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// runCommand runs a command against the admin API of a running bridge
+func runCommand(address string, args []string) error {
+	switch args[0] {
+	case "linkbutton":
+		return adminRequest(address, http.MethodPost, "/linkbutton", nil)
+	case "clientkey":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: clientkey rotate|revoke <username>")
+		}
+		path := fmt.Sprintf("/whitelist/%s/clientkey", url.PathEscape(args[2]))
+		switch args[1] {
+		case "rotate":
+			return adminRequest(address, http.MethodPost, path, nil)
+		case "revoke":
+			return adminRequest(address, http.MethodDelete, path, nil)
+		}
+		return fmt.Errorf("unknown clientkey command %s, available commands: rotate, revoke", args[1])
+	case "scope":
+		if len(args) != 3 {
+			return fmt.Errorf(`usage: scope <username> '{"access": "read-only", "lights": ["1"], "groups": ["2"]}'`)
+		}
+		path := fmt.Sprintf("/whitelist/%s/scope", url.PathEscape(args[1]))
+		return adminRequest(address, http.MethodPut, path, strings.NewReader(args[2]))
+	case "backup":
+		return adminRequest(address, http.MethodGet, "/backup", nil)
+	case "restore":
+		if len(args) < 2 || len(args) > 3 {
+			return fmt.Errorf("usage: restore <file> [keep|archive]")
+		}
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		path := "/restore"
+		if len(args) == 3 {
+			path = fmt.Sprintf("/restore?identity=%s", url.QueryEscape(args[2]))
+		}
+		return adminRequest(address, http.MethodPost, path, f)
+	}
+	return fmt.Errorf("unknown command %s, available commands: linkbutton, clientkey, scope, backup, restore", args[0])
+}
+
+// adminRequest sends a request to the admin API and prints the response
+func adminRequest(address, method, path string, body io.Reader) error {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", address, path), body)
+	if err != nil {
+		return err
+	}
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c := &http.Client{Timeout: 10 * time.Second}
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the admin API on %s: %v", address, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, data)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -5,6 +5,8 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
@@ -19,12 +21,37 @@ func main() {
 	flgAddress := flag.String("bridge.listen-address", "0.0.0.0:0", "address:port the bridge will listen on")
 	flgMAC := flag.String("bridge.mac", "00:17:88:a1:b2:c3", "MAC address for this bridge (only used for config)")
 	flgIP := flag.String("bridge.ip", "", "IP address to advertise the bridge on")
+	flgTimezone := flag.String("bridge.timezone", "UTC", "IANA timezone the bridge is in, like Europe/Stockholm, anything but UTC needs tzdata on the host")
+
+	flgHTTPAPI := flag.String("bridge.http-api", "full", "how much of the API to serve over plain HTTP: full, read-only or off")
+	flgHTTPAPIRoutes := flag.String("bridge.http-api-routes", "", "comma separated list of resources to restrict the plain HTTP API to, like /lights,/groups")
 
 	flgTLSAddress := flag.String("bridge.tls-listen-address", "0.0.0.0:0", "address:port the bridge will listen on for TLS connections")
-	flgTLSPrivKey := flag.String("bridge.tls-private-key", "./private.key", "path to TLS private key")
-	flgTLSPubKey := flag.String("bridge.tls-public-key", "./public.crt", "path to TLS public key")
+	flgTLSPrivKey := flag.String("bridge.tls-private-key", "./private.key", "path to TLS private key, generated if missing")
+	flgTLSPubKey := flag.String("bridge.tls-public-key", "./public.crt", "path to TLS public key, generated if missing")
+	flgStreamingAddress := flag.String("bridge.streaming-listen-address", "0.0.0.0:2100", "address:port the Entertainment API will listen on for DTLS streams, empty to disable streaming")
+	flgStreamingRate := flag.Int("bridge.streaming-rate", bridge.DefaultStreamingRate, "how many times a second streamed colours are sent to the lights, at most 50")
 
 	flgWhitelist := flag.String("bridge.whitelist", "./whitelist.json", "path to where we will load and store whitelist entries")
+	flgEntertainment := flag.String("bridge.entertainment", "./entertainment.json", "path to where we will load and store entertainment groups")
+	flgSettings := flag.String("bridge.settings", "./settings.json", "path to where we will load and store the name and timezone set through the API")
+	flgWhitelistExpiry := flag.Int("bridge.whitelist-expiry", 0, "remove whitelist entries that haven't been used for this many days, 0 to keep them forever")
+
+	flgLightProfiles := flag.String("bridge.light-profiles", "", "path to a JSON file mapping light topics to the Hue model they should impersonate")
+	flgCalibration := flag.String("bridge.calibration", "", "path to a JSON file with per-light brightness curves and colour offsets")
+	flgGracePeriod := flag.Duration("bridge.grace-period", bridge.DefaultGracePeriod, "how long unreachable lights are kept before they're removed")
+	flgDeviceInfo := flag.Bool("bridge.report-device-info", false, "Report the manufacturer, model and serial number announced by devices instead of impersonating Philips hardware")
+
+	flgAlexa := flag.Bool("bridge.alexa", false, "Enable Amazon Echo compatibility, requires the HTTP API on port 80")
+	flgIDMap := flag.String("bridge.id-map", "./idmap.json", "path to where we will load and store the light IDs used for Alexa compatibility")
+
+	flgAdminAddress := flag.String("bridge.admin-listen-address", "127.0.0.1:8420", "address:port the admin API will listen on, keep this private")
+	flgDeconzAddress := flag.String("bridge.deconz-listen-address", "", "address:port the deCONZ compatible REST API and websocket will listen on, empty to disable")
+	flgLIFXAddress := flag.String("bridge.lifx-listen-address", "", "address:port the LIFX LAN server will listen on, LIFX clients only use port 56700, empty to disable")
+	flgUpstreamAddress := flag.String("bridge.upstream-address", "", "address of a Hue bridge whose lights and sensors are imported, empty to disable")
+	flgUpstreamUsername := flag.String("bridge.upstream-username", "", "username registered on the upstream Hue bridge")
+	flgUpstreamPollInterval := flag.Duration("bridge.upstream-poll-interval", bridge.DefaultUpstreamPollInterval, "how often the upstream Hue bridge is polled for changes")
+	flgLinkButtonDevice := flag.String("bridge.link-button-device", "", "topic of a Hemtjänst button that presses the link button")
 
 	flgAuth := flag.Bool("bridge.auth-disable", false, "Disable checking requests against whitelist")
 
@@ -40,6 +67,13 @@ func main() {
 	l, _ := zap.NewDevelopment()
 	defer l.Sync()
 
+	if flag.NArg() > 0 {
+		if err := runCommand(*flgAdminAddress, flag.Args()); err != nil {
+			l.Fatal(err.Error())
+		}
+		return
+	}
+
 	m, err := mqtt.New(context.Background(), mqttCfg())
 	if err != nil {
 		l.Fatal(err.Error())
@@ -51,12 +85,32 @@ func main() {
 		bridge.Name(*flgName),
 		bridge.Address(*flgAddress),
 		bridge.TLSAddress(*flgTLSAddress),
+		bridge.HTTPAPI(*flgHTTPAPI),
+		bridge.HTTPAPIRoutes(strings.Split(*flgHTTPAPIRoutes, ",")...),
 		bridge.MAC(*flgMAC),
 		bridge.AdvertiseIP(*flgIP),
+		bridge.Timezone(*flgTimezone),
 		bridge.TLSPublicKeyPath(*flgTLSPubKey),
 		bridge.TLSPrivateKeyPath(*flgTLSPrivKey),
+		bridge.StreamingAddress(*flgStreamingAddress),
+		bridge.StreamingRate(*flgStreamingRate),
 		bridge.DisableAuthentication(*flgAuth),
 		bridge.WhitelistConfigPath(*flgWhitelist),
+		bridge.SettingsPath(*flgSettings),
+		bridge.EntertainmentPath(*flgEntertainment),
+		bridge.WhitelistExpiry(time.Duration(*flgWhitelistExpiry)*24*time.Hour),
+		bridge.LightProfilesPath(*flgLightProfiles),
+		bridge.CalibrationPath(*flgCalibration),
+		bridge.ReportDeviceInfo(*flgDeviceInfo),
+		bridge.GracePeriod(*flgGracePeriod),
+		bridge.AlexaCompatibility(*flgAlexa),
+		bridge.IDMapPath(*flgIDMap),
+		bridge.AdminAddress(*flgAdminAddress),
+		bridge.DeconzAddress(*flgDeconzAddress),
+		bridge.LIFXAddress(*flgLIFXAddress),
+		bridge.UpstreamBridge(*flgUpstreamAddress, *flgUpstreamUsername),
+		bridge.UpstreamPollInterval(*flgUpstreamPollInterval),
+		bridge.LinkButtonDevice(*flgLinkButtonDevice),
 		bridge.Latitude(*flgLatitude),
 		bridge.Longitude(*flgLongitude),
 		bridge.APIVersion(*flgAPIVersion),
@@ -78,6 +132,22 @@ func main() {
 	}
 	l.Info("completed server startup")
 
+	press := make(chan os.Signal, 1)
+	signal.Notify(press, syscall.SIGUSR1)
+	go func() {
+		for range press {
+			s.PressLinkButton("SIGUSR1")
+		}
+	}()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			s.ReloadCertificate()
+		}
+	}()
+
 	<-stop
 	l.Info("initiating server shutdown")
 
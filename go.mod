@@ -7,11 +7,13 @@ require (
 	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/go-chi/render v1.0.1
 	github.com/google/uuid v1.1.1
-	github.com/jinzhu/copier v0.0.0-20180308034124-7e38e58719c3
+	github.com/gorilla/websocket v1.4.1
 	github.com/kelvins/sunrisesunset v0.0.0-20170601204625-14f1915ad4b4
 	github.com/koron/go-ssdp v0.0.0-20180514024734-4a0ed625a78b
 	github.com/lucasb-eyer/go-colorful v1.0.2
-	github.com/stretchr/testify v1.3.0
+	github.com/pion/dtls/v2 v2.2.7
+	github.com/stretchr/testify v1.8.3
 	go.uber.org/zap v1.10.0
+	golang.org/x/net v0.17.0 // indirect
 	lib.hemtjan.st v0.5.3
 )